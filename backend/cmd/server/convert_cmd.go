@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"kugo-music-converter/internal/algo/kgg"
+	"kugo-music-converter/internal/apperr"
+	"kugo-music-converter/internal/config"
+	"kugo-music-converter/internal/handler"
+	"kugo-music-converter/internal/service"
+	"kugo-music-converter/internal/utils"
+)
+
+const (
+	exitOK          = 0
+	exitFailed      = 1
+	exitUsage       = 2
+	summaryToStdout = "-"
+)
+
+// runConvertCommand 实现 `server convert`，不启动 HTTP 服务直接批量转换
+func runConvertCommand(args []string) int {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	configPath := fs.String("config", "", "配置文件路径")
+	outputDir := fs.String("output", "", "输出目录（必填）")
+	outputFormat := fs.String("format", "mp3", "输出格式: "+strings.Join(service.OutputFormats(), "/"))
+	defaults := config.DefaultConfig().Encode
+	encodeFlags := cliEncodeFlags{
+		mp3Quality:      fs.Int("mp3-quality", defaults.MP3Quality, "MP3 VBR 质量: 0/2/5/7"),
+		aacBitrate:      fs.Int("aac-bitrate", defaults.AACBitrate, "M4A(AAC) 码率 kbps: 64~320"),
+		opusBitrate:     fs.Int("opus-bitrate", defaults.OpusBitrate, "Opus 码率 kbps: 32~256"),
+		vorbisQuality:   fs.Int("vorbis-quality", defaults.VorbisQuality, "Ogg Vorbis 质量: 0~10"),
+		rateMode:        fs.String("rate-mode", defaults.RateMode, "码率模式: vbr/cbr/abr"),
+		bitrate:         fs.Int("bitrate", defaults.Bitrate, "cbr/abr 模式目标码率 kbps"),
+		sampleRate:      fs.Int("sample-rate", defaults.SampleRate, "目标采样率 Hz（0 保持源文件）"),
+		channels:        fs.Int("channels", defaults.Channels, "目标声道数（0 保持源文件）"),
+		bitDepth:        fs.Int("bit-depth", defaults.BitDepth, "无损格式目标位深 16/24/32（0 跟随源文件）"),
+		flacCompression: fs.Int("flac-compression", defaults.FLACCompression, "FLAC 压缩等级 0~12"),
+	}
+	loudDefaults := config.DefaultConfig().Loudness
+	loudnessFlags := cliLoudnessFlags{
+		mode:       fs.String("loudness", loudDefaults.Mode, "响度处理: off/normalize/replaygain"),
+		targetLUFS: fs.Float64("target-lufs", loudDefaults.TargetLUFS, "normalize 模式目标响度 LUFS"),
+		truePeak:   fs.Float64("true-peak", loudDefaults.TruePeak, "normalize 模式真峰值上限 dBTP"),
+		albumGroup: fs.String("album-group", loudDefaults.AlbumGroup, "replaygain 专辑增益分组: folder/album"),
+	}
+	verify := fs.Bool("verify", false, "转换后校验输出 (容器、FLAC MD5、时长)，默认取配置")
+	manifest := fs.Bool("manifest", false, "在输出目录写入 .kugo-manifest.jsonl 转换清单，默认取配置")
+	preserve := fs.Bool("preserve-structure", false, "目录输入时在输出目录下保留源文件夹结构，默认取配置")
+	bestPerGroup := fs.String("best-per-group", "", "重复文件每组只转换音质最好的一个: header/content（默认全部转换）")
+	concurrency := fs.Int("concurrency", 0, "并发数（默认取配置）")
+	skipSpaceCheck := fs.Bool("skip-space-check", false, "磁盘剩余空间不足时仍然开始转换")
+	recursive := fs.Bool("recursive", false, "递归扫描输入目录")
+	filter := fs.String("filter", "", "目录扫描扩展名筛选，如 .kgg,.ncm（默认全部支持格式）")
+	dbPath := fs.String("db", "", "KGMusicV3.db 路径")
+	keyPath := fs.String("key", "", "kgg.key 密钥文件路径")
+	ffmpegBin := fs.String("ffmpeg", "", "ffmpeg 可执行文件路径")
+	summaryPath := fs.String("summary", summaryToStdout, "JSON 汇总输出路径（- 表示标准输出）")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: server convert [选项] <文件或目录>...")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "错误: 至少需要一个输入文件或目录")
+		fs.Usage()
+		return exitUsage
+	}
+	if strings.TrimSpace(*outputDir) == "" {
+		fmt.Fprintln(os.Stderr, "错误: 必须通过 --output 指定输出目录")
+		return exitUsage
+	}
+	format, err := service.NormalizeOutputFormat(*outputFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误: 不支持的输出格式 %q，可选 %s\n", *outputFormat, strings.Join(service.OutputFormats(), "/"))
+		return exitUsage
+	}
+
+	dedupeMode, err := service.NormalizeDuplicateMode(*bestPerGroup)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误: %v\n", err)
+		return exitUsage
+	}
+
+	cfg, err := config.LoadConfig(*configPath, "", *ffmpegBin, false, *ffmpegBin != "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "加载配置失败: %v\n", err)
+		return exitUsage
+	}
+	if !initCLITempDir(cfg) {
+		return exitFailed
+	}
+	defer service.RemoveTempDir()
+
+	absOutputDir, err := filepath.Abs(*outputDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "输出目录无效: %v\n", err)
+		return exitUsage
+	}
+	if err := os.MkdirAll(absOutputDir, 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "无法创建输出目录: %v\n", err)
+		return exitUsage
+	}
+
+	items, dropped := collectCLIItems(context.Background(), fs.Args(), *recursive, *filter, cfg)
+	if len(items) == 0 {
+		fmt.Fprintln(os.Stderr, "错误: 没有可转换的文件")
+		return exitUsage
+	}
+
+	var keyMap map[string]string
+	var keySource string
+	if cliHasKGG(items) {
+		keyMap, keySource, err = loadCLIKeyMap(*dbPath, *keyPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "加载 KGG 密钥失败: %v\n", err)
+			return exitUsage
+		}
+	}
+
+	transcode := encodeFlags.options(fs, format, cfg.Encode)
+	if err := transcode.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "错误: %v\n", err)
+		return exitUsage
+	}
+	loudness := loudnessFlags.options(fs, cfg.Loudness)
+	if err := loudness.Validate(format); err != nil {
+		fmt.Fprintf(os.Stderr, "错误: %v\n", err)
+		return exitUsage
+	}
+	workers := *concurrency
+	if workers <= 0 {
+		workers = cfg.Concurrency
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ffmpegPath := resolveCLIFFmpeg(cfg.FFmpegBin)
+	caps := service.ProbeFFmpeg(ctx, ffmpegPath)
+	if !caps.Available {
+		if loudness.Enabled() {
+			fmt.Fprintf(os.Stderr, "错误: 响度处理需要 ffmpeg: %s\n", ffmpegPath)
+			return exitUsage
+		}
+		fmt.Fprintf(os.Stderr, "警告: 未找到可用的 ffmpeg (%s)，仅支持 copy、同格式直出与 FLAC/WAV 互转\n", ffmpegPath)
+	} else if missing := caps.MissingFor(format); len(missing) > 0 {
+		fmt.Fprintf(os.Stderr, "错误: 输出格式 %s 需要 ffmpeg 支持: %s\n", format, strings.Join(missing, ","))
+		return exitUsage
+	}
+	converter := service.NewConverter(service.NewDecryptService(cfg), ffmpegPath)
+	converter.SetFFmpegCapabilities(caps)
+	params := service.ConvertParams{
+		OutputDir:         absOutputDir,
+		Transcode:         transcode,
+		KeyMap:            keyMap,
+		Loudness:          loudness,
+		Verify:            cfg.VerifyOutput,
+		WriteManifest:     cfg.WriteManifest,
+		KeyMapSource:      keySource,
+		PreserveStructure: cfg.PreserveStructure,
+	}
+	fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "verify":
+			params.Verify = *verify
+		case "manifest":
+			params.WriteManifest = *manifest
+		case "preserve-structure":
+			params.PreserveStructure = *preserve
+		}
+	})
+	if loudness.Mode == service.LoudnessReplayGain {
+		params.AlbumGain = service.NewAlbumGainTracker(loudness.AlbumGroup)
+	}
+
+	var duplicates []service.DuplicateGroup
+	var skipped []service.BatchItem
+	if dedupeMode != "" {
+		items, duplicates, skipped = selectCLIBestPerGroup(ctx, converter, items, dedupeMode, keyMap, keySource)
+	}
+
+	if !checkCLIDiskSpace(items, transcode.Format, workers, absOutputDir, *skipSpaceCheck) {
+		return exitFailed
+	}
+	params.Temp = service.TempUsage.Child()
+
+	var printMu sync.Mutex
+	lastPercent := -1
+	summary := service.RunBatch(ctx, service.BatchOptions{
+		Items:        items,
+		Concurrency:  workers,
+		OutputDir:    absOutputDir,
+		OutputFormat: transcode.Format,
+		MP3Quality:   transcode.MP3Quality,
+		ErrorMapper:  apperr.ToBatchFileError,
+		Convert: func(ctx context.Context, item service.BatchItem, progress func(phase string, filePercent int)) (service.ConvertResult, error) {
+			return converter.ConvertItem(ctx, item, params, progress)
+		},
+		OnProgress: func(evt service.BatchProgressEvent) {
+			printMu.Lock()
+			defer printMu.Unlock()
+			if evt.Percent == lastPercent {
+				return
+			}
+			lastPercent = evt.Percent
+			fmt.Fprintf(os.Stderr, "[%d/%d] %3d%% %-9s %s\n", evt.Current, evt.Total, evt.Percent, evt.Phase, evt.File)
+		},
+		OnFileDone: func(evt service.BatchFileDoneEvent) {
+			printMu.Lock()
+			defer printMu.Unlock()
+			lastPercent = evt.Percent
+			if evt.Status == "ok" {
+				fmt.Fprintf(os.Stderr, "[%d/%d] %3d%% ok        %s -> %s\n", evt.Current, evt.Total, evt.Percent, evt.File, evt.Output)
+				if evt.KeySource != "" {
+					fmt.Fprintf(os.Stderr, "          密钥来源: %s\n", evt.KeySource)
+				}
+				return
+			}
+			detail := ""
+			if evt.Error != nil {
+				detail = evt.Error.Code + ": " + evt.Error.Detail
+			}
+			fmt.Fprintf(os.Stderr, "[%d/%d] %3d%% error     %s (%s)\n", evt.Current, evt.Total, evt.Percent, evt.File, detail)
+		},
+	})
+
+	if params.AlbumGain != nil && !summary.Cancelled {
+		fmt.Fprintln(os.Stderr, "写入专辑增益...")
+		params.AlbumGain.Apply(ctx, ffmpegPath)
+	}
+
+	summary.Dropped = dropped
+	summary.TempPeakBytes = params.Temp.Peak()
+	summary.Duplicates = duplicates
+	for _, item := range skipped {
+		summary.SkippedDuplicates = append(summary.SkippedDuplicates, item.OriginPath)
+	}
+	fmt.Fprintf(os.Stderr, "完成: 成功 %d，失败 %d，共 %d，耗时 %dms\n", summary.Success, summary.Failed, summary.Total, summary.DurationMs)
+
+	if err := writeCLISummary(*summaryPath, summary); err != nil {
+		fmt.Fprintf(os.Stderr, "写入汇总失败: %v\n", err)
+		return exitFailed
+	}
+
+	if summary.Failed > 0 || summary.Cancelled {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// initCLITempDir 在配置的 temp_dir (相对路径基于当前目录，为空时为系统临时目录) 下创建本进程的临时目录，
+// 并清理之前运行遗留的临时文件
+func initCLITempDir(cfg *config.Config) bool {
+	if _, err := service.InitTempDir(cfg.TempDir); err != nil {
+		fmt.Fprintf(os.Stderr, "创建临时目录失败: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// checkCLIDiskSpace 估算临时目录与输出目录所需空间，不足时报错 (skip 时只警告)，余量偏少时警告
+func checkCLIDiskSpace(items []service.BatchItem, format string, workers int, outputDir string, skip bool) bool {
+	est := service.EstimateSpace(items, format, workers)
+	for _, check := range service.CheckSpace(utils.TempDir(), outputDir, est) {
+		detail := fmt.Sprintf("%s 所在磁盘剩余 %s，预计需要 %s", strings.Join(check.Dirs, "、"),
+			utils.FormatBytes(check.Free), utils.FormatBytes(check.Required))
+		if check.Insufficient() && !skip {
+			fmt.Fprintf(os.Stderr, "错误: 磁盘空间不足，%s (可用 --skip-space-check 跳过检查)\n", detail)
+			return false
+		}
+		if check.Low() {
+			fmt.Fprintf(os.Stderr, "警告: 磁盘剩余空间偏少，%s\n", detail)
+		}
+	}
+	return true
+}
+
+// cliEncodeFlags 保存编码相关参数，只有命令行显式指定的值才覆盖配置文件
+type cliEncodeFlags struct {
+	mp3Quality      *int
+	aacBitrate      *int
+	opusBitrate     *int
+	vorbisQuality   *int
+	rateMode        *string
+	bitrate         *int
+	sampleRate      *int
+	channels        *int
+	bitDepth        *int
+	flacCompression *int
+}
+
+func (f cliEncodeFlags) options(fs *flag.FlagSet, format string, enc config.EncodeConfig) service.TranscodeOptions {
+	opts := service.EncodeDefaults(format, enc)
+	rateModeSet, bitrateSet := false, false
+	fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "mp3-quality":
+			opts.MP3Quality = *f.mp3Quality
+		case "aac-bitrate":
+			opts.AACBitrate = *f.aacBitrate
+		case "opus-bitrate":
+			opts.OpusBitrate = *f.opusBitrate
+		case "vorbis-quality":
+			opts.VorbisQuality = *f.vorbisQuality
+		case "rate-mode":
+			opts.RateMode = service.NormalizeRateMode(*f.rateMode)
+			rateModeSet = true
+		case "bitrate":
+			opts.Bitrate = *f.bitrate
+			bitrateSet = true
+		case "sample-rate":
+			opts.SampleRate = *f.sampleRate
+		case "channels":
+			opts.Channels = *f.channels
+		case "bit-depth":
+			opts.BitDepth = *f.bitDepth
+		case "flac-compression":
+			opts.FLACCompression = *f.flacCompression
+		}
+	})
+	if rateModeSet && !bitrateSet && opts.RateMode == service.RateModeVBR {
+		// 显式选择 vbr 时不沿用配置中 cbr/abr 的默认码率
+		opts.Bitrate = 0
+	}
+	return opts
+}
+
+// cliLoudnessFlags 保存响度相关参数，规则与 cliEncodeFlags 相同
+type cliLoudnessFlags struct {
+	mode       *string
+	targetLUFS *float64
+	truePeak   *float64
+	albumGroup *string
+}
+
+func (f cliLoudnessFlags) options(fs *flag.FlagSet, cfg config.LoudnessConfig) service.LoudnessOptions {
+	fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "loudness":
+			cfg.Mode = *f.mode
+		case "target-lufs":
+			cfg.TargetLUFS = *f.targetLUFS
+		case "true-peak":
+			cfg.TruePeak = *f.truePeak
+		case "album-group":
+			cfg.AlbumGroup = *f.albumGroup
+		}
+	})
+
+	return service.LoudnessOptions{
+		Mode:       service.NormalizeLoudnessMode(cfg.Mode),
+		TargetLUFS: cfg.TargetLUFS,
+		TruePeak:   cfg.TruePeak,
+		AlbumGroup: strings.ToLower(strings.TrimSpace(cfg.AlbumGroup)),
+	}
+}
+
+// collectCLIItems 展开输入文件、目录与 ZIP 压缩包，被跳过的路径输出到标准错误并计入汇总
+func collectCLIItems(ctx context.Context, inputs []string, recursive bool, rawFilter string, cfg *config.Config) ([]service.BatchItem, []service.ScanPathError) {
+	items, dropped := service.ExpandInputPaths(ctx, inputs, service.ExpandInputOptions{
+		Recursive: recursive,
+		ExtFilter: service.ParseExtFilter(rawFilter),
+		Zip:       service.DefaultZipLimits(cfg.MaxFileSize, cfg.MaxFiles),
+	})
+	for _, d := range dropped {
+		if d.Detail != "" {
+			fmt.Fprintf(os.Stderr, "跳过 %s: %s (%s)\n", d.Path, d.Reason, d.Detail)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "跳过 %s: %s\n", d.Path, d.Reason)
+	}
+	return items, dropped
+}
+
+// selectCLIBestPerGroup 检测重复输入，每组只保留音质最好的文件并在标准错误输出中说明
+func selectCLIBestPerGroup(ctx context.Context, converter *service.Converter, items []service.BatchItem, mode string, keyMap map[string]string, keySource string) ([]service.BatchItem, []service.DuplicateGroup, []service.BatchItem) {
+	paths := make([]string, 0, len(items))
+	for _, item := range items {
+		// 压缩包条目不参与重复检测
+		if item.Entry != "" {
+			continue
+		}
+		paths = append(paths, item.Path)
+	}
+	fmt.Fprintf(os.Stderr, "检测重复文件 (%s)...\n", mode)
+	groups, err := converter.FindDuplicates(ctx, paths, mode, service.InspectParams{KeyMap: keyMap, KeyMapSource: keySource})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "警告: 重复检测失败，将转换全部文件: %v\n", err)
+		return items, nil, nil
+	}
+	for _, g := range groups {
+		fmt.Fprintf(os.Stderr, "重复 %s: 保留 %s\n", strings.Join(g.Keys, ","), g.Best)
+		for _, f := range g.Files[1:] {
+			fmt.Fprintf(os.Stderr, "          跳过 %s\n", f.Path)
+		}
+	}
+
+	kept, skipped := service.SelectBestPerGroup(items, groups)
+	for i := range kept {
+		kept[i].Current = i + 1
+	}
+	return kept, groups, skipped
+}
+
+func cliHasKGG(items []service.BatchItem) bool {
+	for _, item := range items {
+		if strings.EqualFold(filepath.Ext(item.Name), ".kgg") {
+			return true
+		}
+	}
+	return false
+}
+
+// loadCLIKeyMap 按 --key、--db、自动检测的顺序加载 KGG 密钥，并返回密钥来源描述
+func loadCLIKeyMap(dbPath, keyPath string) (map[string]string, string, error) {
+	if strings.TrimSpace(keyPath) != "" {
+		keys, err := kgg.ReadKeyFile(keyPath)
+		return keys, "key:" + keyPath, err
+	}
+	if strings.TrimSpace(dbPath) != "" {
+		keys, err := service.LoadDBKeyMap(dbPath)
+		return keys, "db:" + dbPath, err
+	}
+
+	for _, base := range cliSearchDirs() {
+		if st := service.DetectKGMusicDB(base); st.Found {
+			keys, err := service.LoadDBKeyMap(st.Path)
+			return keys, "db:" + st.Path, err
+		}
+	}
+	// 未找到时交由解密服务自行探测 tools/kgg.key 与 tools/KGMusicV3.db
+	return nil, "", nil
+}
+
+func cliSearchDirs() []string {
+	dirs := make([]string, 0, 2)
+	if cwd, err := os.Getwd(); err == nil {
+		dirs = append(dirs, cwd)
+	}
+	if exe, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Dir(exe))
+	}
+	return dirs
+}
+
+// resolveCLIFFmpeg 先按服务端规则查找随程序分发的 ffmpeg，找不到再从 PATH 中查找
+func resolveCLIFFmpeg(bin string) string {
+	bundled := handler.ResolveFFmpeg(bin)
+	if st, err := os.Stat(bundled); err == nil && !st.IsDir() {
+		return bundled
+	}
+	if strings.TrimSpace(bin) != "" {
+		if p, err := exec.LookPath(bin); err == nil {
+			return p
+		}
+	}
+	if p, err := exec.LookPath("ffmpeg"); err == nil {
+		return p
+	}
+	return bundled
+}
+
+func writeCLISummary(path string, summary service.BatchSummary) error {
+	var out io.Writer = os.Stdout
+	if path != summaryToStdout {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(summary)
+}
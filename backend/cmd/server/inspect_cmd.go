@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"kugo-music-converter/internal/apperr"
+	"kugo-music-converter/internal/config"
+	"kugo-music-converter/internal/service"
+)
+
+// runInspectCommand 实现 `server inspect`，输出每个文件的诊断信息 (JSON)，不做转换
+func runInspectCommand(args []string) int {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	configPath := fs.String("config", "", "配置文件路径")
+	recursive := fs.Bool("recursive", false, "递归扫描输入目录")
+	filter := fs.String("filter", "", "目录扫描扩展名筛选，如 .kgg,.ncm（默认全部支持格式）")
+	dbPath := fs.String("db", "", "KGMusicV3.db 路径")
+	keyPath := fs.String("key", "", "kgg.key 密钥文件路径")
+	ffmpegBin := fs.String("ffmpeg", "", "ffmpeg 可执行文件路径（配合 --full 读取 MP3/M4A 等格式时长）")
+	full := fs.Bool("full", false, "完整解密每个文件（默认只解密开头部分解析容器头）")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: server inspect [选项] <文件或目录>...")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "错误: 至少需要一个输入文件或目录")
+		fs.Usage()
+		return exitUsage
+	}
+
+	cfg, err := config.LoadConfig(*configPath, "", *ffmpegBin, false, *ffmpegBin != "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "加载配置失败: %v\n", err)
+		return exitUsage
+	}
+	if !initCLITempDir(cfg) {
+		return exitFailed
+	}
+	defer service.RemoveTempDir()
+
+	items, _ := collectCLIItems(context.Background(), fs.Args(), *recursive, *filter, cfg)
+	if len(items) == 0 {
+		fmt.Fprintln(os.Stderr, "错误: 没有可检查的文件")
+		return exitUsage
+	}
+
+	params := service.InspectParams{FullDecrypt: *full}
+	if cliHasKGG(items) {
+		keys, source, err := loadCLIKeyMap(*dbPath, *keyPath)
+		if err != nil {
+			// 检查模式下密钥缺失本身就是诊断结果，不中止
+			fmt.Fprintf(os.Stderr, "警告: 加载 KGG 密钥失败: %v\n", err)
+		} else {
+			params.KeyMap, params.KeyMapSource = keys, source
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ffmpegPath := resolveCLIFFmpeg(cfg.FFmpegBin)
+	converter := service.NewConverter(service.NewDecryptService(cfg), ffmpegPath)
+	converter.SetFFmpegCapabilities(service.ProbeFFmpeg(ctx, ffmpegPath))
+
+	results := make([]service.InspectResult, 0, len(items))
+	failed := 0
+	for _, item := range items {
+		if ctx.Err() != nil {
+			break
+		}
+		if item.Entry != "" {
+			// 检查需要直接读取文件，压缩包条目请先解压
+			fmt.Fprintf(os.Stderr, "跳过 %s: 不支持检查压缩包中的文件\n", item.OriginPath)
+			continue
+		}
+		result, err := converter.Inspect(ctx, item.Path, params)
+		if err != nil {
+			failed++
+			result.Error = apperr.ToBatchFileError(err)
+		}
+		results = append(results, result)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(results); err != nil {
+		fmt.Fprintf(os.Stderr, "输出结果失败: %v\n", err)
+		return exitFailed
+	}
+	if failed > 0 || ctx.Err() != nil {
+		return exitFailed
+	}
+	return exitOK
+}
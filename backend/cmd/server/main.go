@@ -23,12 +23,27 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "convert":
+			os.Exit(runConvertCommand(os.Args[2:]))
+		case "inspect":
+			os.Exit(runInspectCommand(os.Args[2:]))
+		}
+	}
+
 	configPath := flag.String("config", "", "配置文件路径")
 	showHelp := flag.Bool("help", false, "显示帮助")
 	showVersion := flag.Bool("version", false, "显示版本信息")
 	showEnv := flag.Bool("env", false, "显示运行环境")
-	addr := flag.String("addr", ":8080", "服务监听地址")
+	addr := flag.String("addr", "127.0.0.1:8080", "服务监听地址 (局域网访问使用 :8080，此时默认要求访问令牌)")
 	ffmpegBin := flag.String("ffmpeg", "ffmpeg", "ffmpeg 可执行文件路径")
+	socket := flag.String("socket", "", "监听 Unix 域套接字路径 (替代 --addr)")
+	tlsOn := flag.Bool("tls", false, "启用 HTTPS；未指定证书时使用数据目录中的自签名证书")
+	tlsCert := flag.String("tls-cert", "", "TLS 证书文件 (PEM)")
+	tlsKey := flag.String("tls-key", "", "TLS 私钥文件 (PEM)")
+	tempDir := flag.String("temp-dir", "", "临时文件目录 (默认系统临时目录)")
+	auth := flag.String("auth", "", "访问令牌模式 auto/on/off (默认 auto：监听非本机地址时启用)")
 
 	flag.Parse()
 
@@ -60,6 +75,23 @@ func main() {
 	if err != nil {
 		log.Fatalf("加载配置失败: %v", err)
 	}
+	if *auth != "" {
+		cfg.Auth = *auth
+	}
+	if *tempDir != "" {
+		cfg.TempDir = *tempDir
+	}
+	if *socket != "" {
+		cfg.UnixSocket = *socket
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		cfg.TLS.CertFile = *tlsCert
+		cfg.TLS.KeyFile = *tlsKey
+		cfg.TLS.Enabled = true
+	}
+	if *tlsOn {
+		cfg.TLS.Enabled = true
+	}
 
 	logger.Infof("启动服务，监听地址: %s", cfg.Addr)
 	logger.Infof("FFmpeg 路径: %s", cfg.FFmpegBin)
@@ -85,11 +117,20 @@ func main() {
 func printHelp() {
 	fmt.Println("Kugo 音频解密转换服务")
 	fmt.Println("用法: server [选项]")
+	fmt.Println("      server convert [选项] <文件或目录>...")
+	fmt.Println("      server inspect [选项] <文件或目录>...")
 	fmt.Println()
 	flag.PrintDefaults()
 	fmt.Println()
 	fmt.Println("示例:")
-	fmt.Println("  server --addr :8080 --ffmpeg tools/ffmpeg.exe")
+	fmt.Println("  server --addr 127.0.0.1:8080 --ffmpeg tools/ffmpeg.exe")
+	fmt.Println("  server --addr :8080 --auth on   # 局域网访问，使用启动时显示的令牌")
+	fmt.Println("  server --addr :8443 --tls       # HTTPS，自签名证书保存在数据目录")
+	fmt.Println("  server --socket /run/kugo/kugo.sock")
+	fmt.Println("  server convert --output /data/out --format flac --recursive /data/music")
+	fmt.Println("  server inspect --db KGMusicV3.db song.kgg")
+	fmt.Println()
+	fmt.Println("运行 server convert --help / server inspect --help 查看子命令的全部选项")
 }
 
 func printVersion() {
@@ -8,6 +8,8 @@ import (
 	"os"
 
 	_ "modernc.org/sqlite"
+
+	"kugo-music-converter/internal/utils"
 )
 
 // DecryptKGDatabaseToFile 将 KGMusicV3.db 解密为标准 SQLite 文件，返回临时路径
@@ -29,7 +31,7 @@ func DecryptKGDatabaseToFile(dbPath string) (string, func(), error) {
 	}
 	pages := int(info.Size() / pageSize)
 
-	tmpFile, err := os.CreateTemp("", "kgdb_dec_*.sqlite")
+	tmpFile, err := os.CreateTemp(utils.TempDir(), "kgdb_dec_*.sqlite")
 	if err != nil {
 		return "", func() {}, err
 	}
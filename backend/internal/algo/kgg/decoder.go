@@ -1,17 +1,23 @@
 package kgg
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
-	ErrFileAccessRequired = errors.New("kgg decoder requires file access")
+	ErrFileAccessRequired = errors.New("kgg decoder requires random access")
 	ErrUnsupportedMode    = errors.New("unsupported kgg mode")
 	ErrKeyNotFound        = errors.New("kgg key not found")
+	ErrKeyMismatch        = errors.New("kgg key does not decrypt to audio")
 )
 
 // DecoderParams 与 unlock-music 的 common.DecoderParams 对齐的最小子集
@@ -23,37 +29,39 @@ type DecoderParams struct {
 
 // Decoder 提供与 kgm/ncm 相同的 Validate/Read 风格接口
 type Decoder struct {
-	r *os.File
+	r io.ReadSeeker
 	// header length and start offset of encrypted audio
 	headerLen int64
 	// qmc2 decryptor
 	dec QMC2Base
 	// streaming state
 	offset int64
+	// 通过试解密验证的密钥来源
+	keySource string
 }
 
-// NewDecoder 需要文件路径或 *os.File 输入
+// NewDecoder 需要可随机访问的输入 (*os.File、io.SectionReader 等) 或文件路径。
+// Reader 实现 io.Closer 时由 Decoder 负责关闭。
 func NewDecoder(p *DecoderParams, keyProvider KeyProvider) (*Decoder, error) {
-	var f *os.File
+	var r io.ReadSeeker
 	switch t := p.Reader.(type) {
-	case *os.File:
-		f = t
+	case io.ReadSeeker:
+		r = t
 	default:
-		if p.Path != "" {
-			var err error
-			f, err = os.Open(p.Path)
-			if err != nil {
-				return nil, err
-			}
-		} else {
+		if p.Path == "" {
 			// 缺少随机访问能力，拒绝
 			return nil, ErrFileAccessRequired
 		}
+		f, err := os.Open(p.Path)
+		if err != nil {
+			return nil, err
+		}
+		r = f
 	}
 
-	d := &Decoder{r: f}
+	d := &Decoder{r: r}
 	if err := d.prepare(keyProvider); err != nil {
-		_ = f.Close()
+		_ = d.Close()
 		return nil, err
 	}
 	return d, nil
@@ -61,6 +69,9 @@ func NewDecoder(p *DecoderParams, keyProvider KeyProvider) (*Decoder, error) {
 
 func (d *Decoder) Validate() error { return nil }
 
+// KeySource 返回实际解密成功的密钥来源，如 "db:/path/KGMusicV3.db"
+func (d *Decoder) KeySource() string { return d.keySource }
+
 func (d *Decoder) Read(p []byte) (int, error) {
 	if d.r == nil || d.dec == nil {
 		return 0, io.EOF
@@ -83,8 +94,8 @@ func (d *Decoder) Read(p []byte) (int, error) {
 }
 
 func (d *Decoder) Close() error {
-	if d.r != nil {
-		return d.r.Close()
+	if c, ok := d.r.(io.Closer); ok {
+		return c.Close()
 	}
 	return nil
 }
@@ -92,45 +103,89 @@ func (d *Decoder) Close() error {
 // --- internals ---
 
 func (d *Decoder) prepare(keyProvider KeyProvider) error {
-	// header length at offset 16, mode at 20
-	if _, err := d.r.Seek(16, io.SeekStart); err != nil {
-		return err
-	}
-	var hdr [8]byte
-	if _, err := io.ReadFull(d.r, hdr[:]); err != nil {
+	h, err := ReadHeader(d.r)
+	if err != nil {
 		return err
 	}
-	d.headerLen = int64(uint32(hdr[0]) | uint32(hdr[1])<<8 | uint32(hdr[2])<<16 | uint32(hdr[3])<<24)
-	mode := uint32(hdr[4]) | uint32(hdr[5])<<8 | uint32(hdr[6])<<16 | uint32(hdr[7])<<24
-	if mode != 5 {
-		return fmt.Errorf("%w: %d", ErrUnsupportedMode, mode)
+	d.headerLen = h.HeaderLen
+	if h.Mode != 5 {
+		return fmt.Errorf("%w: %d", ErrUnsupportedMode, h.Mode)
 	}
 
-	// audio_hash at offset 68: len(uint32 LE) + bytes
-	if _, err := d.r.Seek(68, io.SeekStart); err != nil {
-		return err
-	}
-	var b4 [4]byte
-	if _, err := io.ReadFull(d.r, b4[:]); err != nil {
-		return err
+	// 依次试解密各 provider 给出的候选密钥，首块能解出已知音频头才采用；
+	// 采用后不再查询后面的 provider
+	var rejected []string
+	for c := range keyCandidates(keyProvider, h.AudioHash) {
+		q, err := CreateQMC2(c.Key)
+		if err != nil {
+			rejected = append(rejected, c.Source)
+			continue
+		}
+		ok, err := trialDecrypt(d.r, d.headerLen, q)
+		if err != nil {
+			return err
+		}
+		if ok {
+			d.dec = q
+			d.keySource = c.Source
+			return nil
+		}
+		rejected = append(rejected, c.Source)
 	}
-	hashLen := int(uint32(b4[0]) | uint32(b4[1])<<8 | uint32(b4[2])<<16 | uint32(b4[3])<<24)
-	audioHash := make([]byte, hashLen)
-	if _, err := io.ReadFull(d.r, audioHash); err != nil {
-		return err
+	if len(rejected) == 0 {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, h.AudioHash)
 	}
+	return fmt.Errorf("%w: %s", ErrKeyMismatch, strings.Join(rejected, ", "))
+}
 
-	// find ekey by audio hash
-	ekey, err := keyProvider.Lookup(string(audioHash))
-	if err != nil {
-		return err
-	}
-	q, err := CreateQMC2(ekey)
-	if err != nil {
-		return err
-	}
-	d.dec = q
-	return nil
+// trialBlockSize 为试解密读取的字节数，足以覆盖各容器的识别标记
+const trialBlockSize = 16
+
+// trialDecrypt 解密音频数据首块并检查是否为已知音频头
+func trialDecrypt(r io.ReadSeeker, headerLen int64, q QMC2Base) (bool, error) {
+	if _, err := r.Seek(headerLen, io.SeekStart); err != nil {
+		return false, err
+	}
+	buf := make([]byte, trialBlockSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, err
+	}
+	buf = buf[:n]
+	q.Decrypt(buf, 0)
+	return looksLikeAudio(buf), nil
+}
+
+// looksLikeAudio 识别 KGG 中常见的 FLAC/MP3/Ogg/WAV/MP4 文件头
+func looksLikeAudio(b []byte) bool {
+	switch {
+	case len(b) < 4:
+		return false
+	case bytes.HasPrefix(b, []byte("fLaC")),
+		bytes.HasPrefix(b, []byte("ID3")),
+		bytes.HasPrefix(b, []byte("OggS")),
+		bytes.HasPrefix(b, []byte("RIFF")):
+		return true
+	case isMPEGFrameHeader(b):
+		return true
+	case len(b) >= 8 && bytes.Equal(b[4:8], []byte("ftyp")):
+		return true
+	}
+	return false
+}
+
+// isMPEGFrameHeader 校验 MPEG 音频帧头：除 11 位同步字外，版本、层、码率与采样率索引
+// 都不能是保留值，避免错误密钥解出的随机字节碰巧通过同步字检查
+func isMPEGFrameHeader(b []byte) bool {
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return false
+	}
+	version := b[1] >> 3 & 0x3
+	layer := b[1] >> 1 & 0x3
+	bitrate := b[2] >> 4
+	sampleRate := b[2] >> 2 & 0x3
+	emphasis := b[3] & 0x3
+	return version != 1 && layer != 0 && bitrate != 0 && bitrate != 0xF && sampleRate != 3 && emphasis != 2
 }
 
 // --- Key Provider ---
@@ -140,8 +195,53 @@ type KeyProvider interface {
 	Lookup(audioHash string) (string, error)
 }
 
-// MemoryKeyProvider 运行时内存中的 key 映射
-type MemoryKeyProvider struct{ Cache map[string]string }
+// KeyCandidate 是某个 provider 给出的候选密钥及其来源
+type KeyCandidate struct {
+	Key    string
+	Source string
+}
+
+// KeySource 由 provider 实现，用于报告密钥来源
+type KeySource interface {
+	Source() string
+}
+
+// CandidateProvider 由组合 provider 实现，按顺序逐个给出候选密钥以便试解密。
+// 调用方停止迭代后，其余 provider 不再被查询。
+type CandidateProvider interface {
+	Candidates(audioHash string) iter.Seq[KeyCandidate]
+}
+
+func providerSource(p KeyProvider) string {
+	if s, ok := p.(KeySource); ok {
+		return s.Source()
+	}
+	return fmt.Sprintf("%T", p)
+}
+
+func keyCandidates(p KeyProvider, audioHash string) iter.Seq[KeyCandidate] {
+	if cp, ok := p.(CandidateProvider); ok {
+		return cp.Candidates(audioHash)
+	}
+	return func(yield func(KeyCandidate) bool) {
+		if v, err := p.Lookup(audioHash); err == nil {
+			yield(KeyCandidate{Key: v, Source: providerSource(p)})
+		}
+	}
+}
+
+// MemoryKeyProvider 运行时内存中的 key 映射，Name 描述映射来源
+type MemoryKeyProvider struct {
+	Cache map[string]string
+	Name  string
+}
+
+func (m MemoryKeyProvider) Source() string {
+	if m.Name != "" {
+		return m.Name
+	}
+	return "memory"
+}
 
 func (m MemoryKeyProvider) Lookup(audioHash string) (string, error) {
 	if m.Cache == nil {
@@ -156,6 +256,32 @@ func (m MemoryKeyProvider) Lookup(audioHash string) (string, error) {
 // CombinedProvider 依次查询多个 provider
 type CombinedProvider struct{ providers []KeyProvider }
 
+func NewCombinedProvider(providers ...KeyProvider) CombinedProvider {
+	return CombinedProvider{providers: providers}
+}
+
+// Candidates 按 provider 顺序给出该 hash 的密钥，相同密钥只保留首个来源。
+// 只有前面的候选全部被拒绝时才查询下一个 provider，已加载的映射命中时不会再解密 KGMusicV3.db。
+func (c CombinedProvider) Candidates(audioHash string) iter.Seq[KeyCandidate] {
+	return func(yield func(KeyCandidate) bool) {
+		seen := map[string]struct{}{}
+		for _, p := range c.providers {
+			if p == nil {
+				continue
+			}
+			for cand := range keyCandidates(p, audioHash) {
+				if _, ok := seen[cand.Key]; ok {
+					continue
+				}
+				seen[cand.Key] = struct{}{}
+				if !yield(cand) {
+					return
+				}
+			}
+		}
+	}
+}
+
 func (c CombinedProvider) Lookup(audioHash string) (string, error) {
 	for _, p := range c.providers {
 		if p == nil {
@@ -168,29 +294,66 @@ func (c CombinedProvider) Lookup(audioHash string) (string, error) {
 	return "", fmt.Errorf("%w: %s", ErrKeyNotFound, audioHash)
 }
 
-// FileKeyMapProvider 解析 kgg.key（格式: <id>$<ekey>\n）
+// loadRetryInterval 为密钥文件加载失败后再次尝试的最短间隔，
+// 避免逐个文件重复解密损坏的数据库，同时文件修复后无需重启即可恢复
+const loadRetryInterval = 30 * time.Second
+
+// lazyKeyMap 在首次查询时加载密钥表，可并发使用；只缓存成功的结果，
+// 失败时在 loadRetryInterval 内直接返回上次的错误
+type lazyKeyMap struct {
+	mu       sync.Mutex
+	cache    map[string]string
+	err      error
+	failedAt time.Time
+}
+
+func (l *lazyKeyMap) ensureLoaded(load func() (map[string]string, error)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cache != nil {
+		return nil
+	}
+	if l.err != nil && time.Since(l.failedAt) < loadRetryInterval {
+		return l.err
+	}
+	m, err := load()
+	if err != nil {
+		l.err, l.failedAt = err, time.Now()
+		return err
+	}
+	if m == nil {
+		m = map[string]string{}
+	}
+	l.cache, l.err = m, nil
+	return nil
+}
+
+// FileKeyMapProvider 解析 kgg.key（格式: <id>$<ekey>\n），首次查询时读取一次，可并发使用
 type FileKeyMapProvider struct {
-	path  string
-	cache map[string]string
+	path string
+	keys lazyKeyMap
 }
 
 func NewFileKeyMapProvider(path string) *FileKeyMapProvider {
-	return &FileKeyMapProvider{path: path, cache: map[string]string{}}
+	return &FileKeyMapProvider{path: path}
 }
 
 func (p *FileKeyMapProvider) ensureLoaded() error {
-	if len(p.cache) > 0 {
-		return nil
-	}
-	f, err := os.Open(p.path)
+	return p.keys.ensureLoaded(func() (map[string]string, error) { return ReadKeyFile(p.path) })
+}
+
+// ReadKeyFile 读取 kgg.key（格式: <id>$<ekey>\n）为映射表
+func ReadKeyFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
 	data, err := io.ReadAll(f)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	m := map[string]string{}
 	var key string
 	var val string
 	stateKey := true
@@ -200,7 +363,7 @@ func (p *FileKeyMapProvider) ensureLoaded() error {
 			stateKey = false
 		case '\n':
 			if key != "" || val != "" {
-				p.cache[key] = val
+				m[key] = val
 			}
 			key, val, stateKey = "", "", true
 		case '\r':
@@ -214,80 +377,150 @@ func (p *FileKeyMapProvider) ensureLoaded() error {
 		}
 	}
 	if key != "" || val != "" {
-		p.cache[key] = val
+		m[key] = val
 	}
-	return nil
+	return m, nil
 }
 
+func (p *FileKeyMapProvider) Source() string { return "key:" + p.path }
+
 func (p *FileKeyMapProvider) Lookup(audioHash string) (string, error) {
 	if err := p.ensureLoaded(); err != nil {
 		return "", err
 	}
-	if v, ok := p.cache[audioHash]; ok {
+	if v, ok := p.keys.cache[audioHash]; ok {
 		return v, nil
 	}
 	return "", fmt.Errorf("%w: %s", ErrKeyNotFound, audioHash)
 }
 
-// DBKeyProvider 通过解密 KGMusicV3.db 生成 KeyMap
+// DBKeyProvider 通过解密 KGMusicV3.db 生成 KeyMap，首次查询时解密一次，可并发使用
 type DBKeyProvider struct {
 	dbPath string
-	cache  map[string]string
+	keys   lazyKeyMap
 }
 
 func NewDBKeyProvider(path string) *DBKeyProvider {
-	return &DBKeyProvider{dbPath: path, cache: map[string]string{}}
+	return &DBKeyProvider{dbPath: path}
 }
 
 func (p *DBKeyProvider) ensureLoaded() error {
-	if len(p.cache) > 0 {
-		return nil
-	}
-	// 解密数据库到临时文件并读取映射
-	tmp, cleanup, err := DecryptKGDatabaseToFile(p.dbPath)
+	return p.keys.ensureLoaded(func() (map[string]string, error) { return LoadDatabaseKeys(p.dbPath) })
+}
+
+// OnDatabaseLoad 在每次成功解密并读取 KGMusicV3.db 后调用，供上层统计加载次数；
+// 须在开始转换前设置
+var OnDatabaseLoad func(dbPath string)
+
+// LoadDatabaseKeys 解密数据库到临时文件并读取映射
+func LoadDatabaseKeys(dbPath string) (map[string]string, error) {
+	tmp, cleanup, err := DecryptKGDatabaseToFile(dbPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer cleanup()
 	m, err := ReadShareFileItems(tmp)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	p.cache = m
-	return nil
+	if OnDatabaseLoad != nil {
+		OnDatabaseLoad(dbPath)
+	}
+	return m, nil
 }
 
+func (p *DBKeyProvider) Source() string { return "db:" + p.dbPath }
+
 func (p *DBKeyProvider) Lookup(audioHash string) (string, error) {
 	if err := p.ensureLoaded(); err != nil {
 		return "", err
 	}
-	if v, ok := p.cache[audioHash]; ok {
+	if v, ok := p.keys.cache[audioHash]; ok {
 		return v, nil
 	}
 	return "", fmt.Errorf("%w: %s", ErrKeyNotFound, audioHash)
 }
 
-// Helper: TryKeyProviders tries a list of providers
+// maxDiskProviders 为按路径缓存的 provider 数量上限，每个 provider 持有整张密钥表
+const maxDiskProviders = 8
+
+// diskProviders 按路径缓存 kgg.key 与 KGMusicV3.db 的 provider，使同一文件在多次转换间只解析一次；
+// 文件大小或修改时间变化后重新创建，超过 maxDiskProviders 个时淘汰最久未使用的一个
+var diskProviders = struct {
+	sync.Mutex
+	m map[string]*diskProvider
+}{m: map[string]*diskProvider{}}
+
+type diskProvider struct {
+	provider KeyProvider
+	size     int64
+	modTime  time.Time
+	lastUsed time.Time
+}
+
+// cachedProvider 返回 path 对应的缓存 provider，文件无法访问时返回不缓存的新实例
+func cachedProvider(path string, create func(string) KeyProvider) KeyProvider {
+	st, err := os.Stat(path)
+	if err != nil {
+		return create(path)
+	}
+	key := path
+	if abs, err := filepath.Abs(path); err == nil {
+		key = abs
+	}
+	diskProviders.Lock()
+	defer diskProviders.Unlock()
+	now := time.Now()
+	if c, ok := diskProviders.m[key]; ok && c.size == st.Size() && c.modTime.Equal(st.ModTime()) {
+		c.lastUsed = now
+		return c.provider
+	}
+	if _, ok := diskProviders.m[key]; !ok && len(diskProviders.m) >= maxDiskProviders {
+		evictOldestProvider()
+	}
+	p := create(path)
+	diskProviders.m[key] = &diskProvider{provider: p, size: st.Size(), modTime: st.ModTime(), lastUsed: now}
+	return p
+}
+
+// evictOldestProvider 删除最久未使用的缓存项，调用方须持有 diskProviders 锁
+func evictOldestProvider() {
+	var oldest string
+	var oldestAt time.Time
+	for k, c := range diskProviders.m {
+		if oldest == "" || c.lastUsed.Before(oldestAt) {
+			oldest, oldestAt = k, c.lastUsed
+		}
+	}
+	delete(diskProviders.m, oldest)
+}
+
+func newFileProvider(path string) KeyProvider { return NewFileKeyMapProvider(path) }
+
+func newDBProvider(path string) KeyProvider { return NewDBKeyProvider(path) }
+
+// TryKeyProviders 组合显式指定的与 tools 目录中自动发现的 kgg.key、KGMusicV3.db。
+// 磁盘上的 provider 按路径缓存，逐个文件调用也不会重复解密同一个数据库
 func TryKeyProviders(dbPath, keyPath string, workDir string) KeyProvider {
 	var ps []KeyProvider
 	if keyPath != "" {
-		ps = append(ps, NewFileKeyMapProvider(keyPath))
+		ps = append(ps, cachedProvider(keyPath, newFileProvider))
 	}
 	if dbPath != "" {
-		ps = append(ps, NewDBKeyProvider(dbPath))
+		ps = append(ps, cachedProvider(dbPath, newDBProvider))
 	}
 	// 自动发现 tools 目录（先 key 后 db）
 	for _, base := range []string{workDir, "."} {
 		cand := filepath.Join(base, "tools", "kgg.key")
 		if _, err := os.Stat(cand); err == nil {
-			ps = append(ps, NewFileKeyMapProvider(cand))
+			ps = append(ps, cachedProvider(cand, newFileProvider))
 			break
 		}
 	}
 	for _, base := range []string{workDir, "."} {
 		cand := filepath.Join(base, "tools", "KGMusicV3.db")
 		if _, err := os.Stat(cand); err == nil {
-			ps = append(ps, NewDBKeyProvider(cand))
+			ps = append(ps, cachedProvider(cand, newDBProvider))
 			break
 		}
 	}
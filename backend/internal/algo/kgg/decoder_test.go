@@ -0,0 +1,108 @@
+package kgg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIsMPEGFrameHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want bool
+	}{
+		{"MPEG-1 layer III 128k 44.1k", []byte{0xFF, 0xFB, 0x90, 0x64}, true},
+		{"MPEG-2 layer III 64k 22.05k", []byte{0xFF, 0xF3, 0x80, 0xC4}, true},
+		{"MPEG-2.5 layer III", []byte{0xFF, 0xE3, 0x50, 0x00}, true},
+		{"reserved version", []byte{0xFF, 0xEB, 0x90, 0x64}, false},
+		{"reserved layer", []byte{0xFF, 0xF9, 0x90, 0x64}, false},
+		{"free bitrate", []byte{0xFF, 0xFB, 0x00, 0x64}, false},
+		{"bad bitrate", []byte{0xFF, 0xFB, 0xF0, 0x64}, false},
+		{"reserved sample rate", []byte{0xFF, 0xFB, 0x9C, 0x64}, false},
+		{"reserved emphasis", []byte{0xFF, 0xFB, 0x90, 0x66}, false},
+		{"no sync", []byte{0xFF, 0x1B, 0x90, 0x64}, false},
+		{"too short", []byte{0xFF, 0xFB, 0x90}, false},
+	}
+	for _, tt := range tests {
+		if got := isMPEGFrameHeader(tt.head); got != tt.want {
+			t.Errorf("%s: isMPEGFrameHeader(% x) = %v, want %v", tt.name, tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestLazyKeyMapRetriesAfterFailure(t *testing.T) {
+	var l lazyKeyMap
+	calls := 0
+	fail := errors.New("db locked")
+	load := func() (map[string]string, error) {
+		calls++
+		if calls == 1 {
+			return nil, fail
+		}
+		return map[string]string{"hash": "key"}, nil
+	}
+
+	if err := l.ensureLoaded(load); !errors.Is(err, fail) {
+		t.Fatalf("first load = %v", err)
+	}
+	// 间隔内不重试，直接返回上次的错误
+	if err := l.ensureLoaded(load); !errors.Is(err, fail) || calls != 1 {
+		t.Fatalf("load within back-off = %v, calls = %d", err, calls)
+	}
+	l.failedAt = time.Now().Add(-loadRetryInterval)
+	if err := l.ensureLoaded(load); err != nil || calls != 2 {
+		t.Fatalf("load after back-off = %v, calls = %d", err, calls)
+	}
+	// 成功后缓存结果，不再加载
+	if err := l.ensureLoaded(load); err != nil || calls != 2 || l.cache["hash"] != "key" {
+		t.Fatalf("cached load = %v, calls = %d, cache = %v", err, calls, l.cache)
+	}
+}
+
+func TestCachedProviderEvictsLeastRecentlyUsed(t *testing.T) {
+	diskProviders.Lock()
+	saved := diskProviders.m
+	diskProviders.m = map[string]*diskProvider{}
+	diskProviders.Unlock()
+	defer func() {
+		diskProviders.Lock()
+		diskProviders.m = saved
+		diskProviders.Unlock()
+	}()
+
+	dir := t.TempDir()
+	paths := make([]string, maxDiskProviders+1)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("%d.key", i))
+		if err := os.WriteFile(paths[i], []byte("a$b\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := cachedProvider(paths[0], newFileProvider)
+	for _, p := range paths[1:maxDiskProviders] {
+		cachedProvider(p, newFileProvider)
+	}
+	// 再次使用第一个，使第二个成为最久未使用的
+	time.Sleep(time.Millisecond)
+	if got := cachedProvider(paths[0], newFileProvider); got != first {
+		t.Fatal("cached provider was not reused")
+	}
+	cachedProvider(paths[maxDiskProviders], newFileProvider)
+
+	diskProviders.Lock()
+	defer diskProviders.Unlock()
+	if n := len(diskProviders.m); n != maxDiskProviders {
+		t.Fatalf("cache size = %d, want %d", n, maxDiskProviders)
+	}
+	if _, ok := diskProviders.m[paths[1]]; ok {
+		t.Error("least recently used provider was not evicted")
+	}
+	if _, ok := diskProviders.m[paths[0]]; !ok {
+		t.Error("recently used provider was evicted")
+	}
+}
@@ -0,0 +1,93 @@
+package kgg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// maxAudioHashLen 限制文件头中 audio_hash 的长度，防止损坏文件导致超大分配
+const maxAudioHashLen = 1024
+
+// Header 是 KGG 文件头中与解密相关的字段
+type Header struct {
+	HeaderLen int64  `json:"headerLen"`
+	Mode      uint32 `json:"mode"`
+	AudioHash string `json:"audioHash"`
+}
+
+// ReadHeader 解析 KGG 文件头：偏移 16 处为头长度与模式，偏移 68 处为 audio_hash
+func ReadHeader(r io.ReadSeeker) (Header, error) {
+	var h Header
+	if _, err := r.Seek(16, io.SeekStart); err != nil {
+		return h, err
+	}
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return h, err
+	}
+	h.HeaderLen = int64(binary.LittleEndian.Uint32(hdr[0:4]))
+	h.Mode = binary.LittleEndian.Uint32(hdr[4:8])
+
+	// audio_hash at offset 68: len(uint32 LE) + bytes
+	if _, err := r.Seek(68, io.SeekStart); err != nil {
+		return h, err
+	}
+	var b4 [4]byte
+	if _, err := io.ReadFull(r, b4[:]); err != nil {
+		return h, err
+	}
+	hashLen := binary.LittleEndian.Uint32(b4[:])
+	if hashLen > maxAudioHashLen {
+		return h, fmt.Errorf("invalid audio hash length: %d", hashLen)
+	}
+	audioHash := make([]byte, hashLen)
+	if _, err := io.ReadFull(r, audioHash); err != nil {
+		return h, err
+	}
+	h.AudioHash = string(audioHash)
+	return h, nil
+}
+
+// 密钥类型：ekey 解出的密钥短于 300 字节时使用 QMC2 map，否则使用 RC4
+const (
+	KeyTypeMap     = "map"
+	KeyTypeRC4     = "rc4"
+	KeyTypeInvalid = "invalid"
+)
+
+// KeyCheck 是单个候选密钥的试解密结果
+type KeyCheck struct {
+	Source string `json:"source"`
+	Type   string `json:"type"`
+	Valid  bool   `json:"valid"`
+}
+
+// CheckKeys 对 provider 给出的全部候选密钥逐个试解密，不会在首个成功处停止
+func CheckKeys(r io.ReadSeeker, h Header, provider KeyProvider) ([]KeyCheck, error) {
+	if provider == nil {
+		return nil, nil
+	}
+	checks := []KeyCheck{}
+	for c := range keyCandidates(provider, h.AudioHash) {
+		check := KeyCheck{Source: c.Source, Type: KeyTypeInvalid}
+		q, err := CreateQMC2(c.Key)
+		if err == nil {
+			check.Type = qmc2Type(q)
+			ok, err := trialDecrypt(r, h.HeaderLen, q)
+			if err != nil {
+				return checks, err
+			}
+			check.Valid = ok
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+func qmc2Type(q QMC2Base) string {
+	if _, ok := q.(*qmc2RC4); ok {
+		return KeyTypeRC4
+	}
+	return KeyTypeMap
+}
@@ -0,0 +1,190 @@
+// Package apperr 定义面向用户的错误码目录，HTTP 接口与命令行子命令共用
+package apperr
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"kugo-music-converter/internal/service"
+)
+
+const (
+	ErrDBNotFound        = "ERR_DB_NOT_FOUND"
+	ErrDecryptFailed     = "ERR_DECRYPT_FAILED"
+	ErrDecryptKeyExpired = "ERR_DECRYPT_KEY_EXPIRED"
+	ErrTranscodeFailed   = "ERR_TRANSCODE_FAILED"
+	ErrUnsupportedFormat = "ERR_UNSUPPORTED_FORMAT"
+	ErrUnsupportedOutput = "ERR_UNSUPPORTED_OUTPUT"
+	ErrInvalidEncode     = "ERR_INVALID_ENCODE_OPTIONS"
+	ErrInvalidParam      = "ERR_INVALID_PARAMETER"
+	ErrRuntimeMissing    = "ERR_RUNTIME_MISSING"
+	ErrEncoderMissing    = "ERR_FFMPEG_ENCODER_MISSING"
+	ErrNoFiles           = "ERR_NO_FILES"
+	ErrTooManyFiles      = "ERR_TOO_MANY_FILES"
+	ErrFileTooLarge      = "ERR_FILE_TOO_LARGE"
+	ErrOutputRequired    = "ERR_OUTPUT_REQUIRED"
+	ErrFolderPicker      = "ERR_FOLDER_PICKER"
+	ErrDBPicker          = "ERR_DB_PICKER"
+	ErrDBPathInvalid     = "ERR_DB_PATH_INVALID"
+	ErrCancelled         = "ERR_CANCELLED"
+	ErrVerifyFailed      = "ERR_VERIFY_FAILED"
+	ErrScanInvalidPath   = "ERR_SCAN_INVALID_PATH"
+	ErrJobNotFound       = "ERR_JOB_NOT_FOUND"
+	ErrJobRunning        = "ERR_JOB_RUNNING"
+	ErrUnauthorized      = "ERR_UNAUTHORIZED"
+	ErrForbiddenOrigin   = "ERR_FORBIDDEN_ORIGIN"
+	ErrPathNotAllowed    = "ERR_PATH_NOT_ALLOWED"
+	ErrQueueFull         = "ERR_QUEUE_FULL"
+	ErrDiskFull          = "ERR_DISK_FULL"
+	ErrPermissionDenied  = "ERR_PERMISSION_DENIED"
+)
+
+type AppError struct {
+	Code        string `json:"code"`
+	UserMessage string `json:"userMessage"`
+	Suggestion  string `json:"suggestion,omitempty"`
+	Severity    string `json:"severity"`
+	Detail      string `json:"detail,omitempty"`
+}
+
+func (e *AppError) Error() string {
+	if e == nil {
+		return ""
+	}
+	if strings.TrimSpace(e.Detail) != "" {
+		return e.Detail
+	}
+	return e.UserMessage
+}
+
+type errorMeta struct {
+	userMessage string
+	suggestion  string
+	severity    string
+}
+
+var errorCatalog = map[string]errorMeta{
+	ErrDBNotFound:        {"未找到 KGMusicV3.db 数据库文件。", "KGG 格式转换需要数据库，请先配置 KGMusicV3.db。", "fatal"},
+	ErrDecryptFailed:     {"解密失败，未生成可用音频文件。", "请确认输入文件完整可用后重试。", "error"},
+	ErrDecryptKeyExpired: {"解密失败，密钥可能已失效。", "请先在酷狗客户端播放一次该歌曲后重试。", "error"},
+	ErrTranscodeFailed:   {"音频转码失败。", "请确认 ffmpeg 可用，或尝试更换输入文件后重试。", "error"},
+	ErrUnsupportedFormat: {"不支持的输入文件格式。", "仅支持 .kgg/.kgm/.kgma/.vpr/.ncm。", "warning"},
+	ErrUnsupportedOutput: {"不支持的输出格式。", "可选 mp3/flac/wav/m4a/alac/opus/ogg/copy。", "warning"},
+	ErrInvalidEncode:     {"编码参数无效。", "请检查码率、采样率、声道数与位深是否适用于所选输出格式。", "warning"},
+	ErrInvalidParam:      {"请求参数无效。", "请检查请求中各字段的取值是否在允许范围内。", "warning"},
+	ErrRuntimeMissing:    {"运行时依赖缺失。", "请补齐缺失文件后重试。", "fatal"},
+	ErrEncoderMissing:    {"本机 ffmpeg 缺少所需编码器。", "请更换完整版 ffmpeg，或选择其他输出格式。", "error"},
+	ErrNoFiles:           {"未上传任何支持的文件。", "请先选择至少一个加密音频文件。", "warning"},
+	ErrTooManyFiles:      {"上传文件数量超过限制。", "请分批上传。", "warning"},
+	ErrFileTooLarge:      {"单文件超过大小限制。", "请减小文件大小后重试。", "warning"},
+	ErrOutputRequired:    {"输出目录不能为空。", "请先选择输出目录。", "warning"},
+	ErrFolderPicker:      {"无法打开目录选择器。", "请手动输入目录路径。", "error"},
+	ErrDBPicker:          {"无法打开数据库选择器。", "请手动输入 KGMusicV3.db 路径。", "error"},
+	ErrDBPathInvalid:     {"数据库路径无效。", "请确认文件存在且文件名为 KGMusicV3.db。", "warning"},
+	ErrCancelled:         {"转换已取消。", "可重新发起转换任务。", "warning"},
+	ErrVerifyFailed:      {"输出文件校验失败。", "可能是密钥不匹配或源文件不完整，请更新 KGMusicV3.db 或重新下载源文件后重试。", "error"},
+	ErrScanInvalidPath:   {"扫描路径无效。", "请确认路径存在且为文件夹。", "warning"},
+	ErrJobNotFound:       {"转换任务不存在或已过期。", "任务结果保留 1 小时，请重新转换。", "warning"},
+	ErrJobRunning:        {"转换任务尚未结束。", "请等待任务完成后再下载。", "warning"},
+	ErrUnauthorized:      {"缺少或错误的访问令牌。", "请使用启动日志中带 token 的地址打开页面，或在请求头中携带 Authorization: Bearer <令牌>。", "fatal"},
+	ErrPathNotAllowed:    {"路径不在允许访问的目录中。", "请选择配置 allowed_roots 中列出的目录 (符号链接按其实际指向判断)。", "error"},
+	ErrDiskFull:          {"磁盘空间不足。", "请清理输出目录或临时目录所在磁盘，或选择空间充足的输出目录 (临时目录可通过配置 temp_dir 更换) 后重试。", "fatal"},
+	ErrPermissionDenied:  {"没有读写权限。", "请确认当前用户可以读取源文件并写入输出目录与临时目录。", "error"},
+	ErrQueueFull:         {"转换队列已满。", "当前排队的转换任务过多，请等待其他任务完成后重试。", "warning"},
+	ErrForbiddenOrigin:   {"请求来源不被允许。", "请直接在本服务的页面中操作；通过域名或反向代理访问时请在配置 allowed_hosts 中添加该主机名。", "fatal"},
+}
+
+func New(code string, detail string, inner error) *AppError {
+	meta, ok := errorCatalog[code]
+	if !ok {
+		meta = errorMeta{userMessage: "发生未知错误。", suggestion: "请查看日志后重试。", severity: "error"}
+		code = "ERR_UNKNOWN"
+	}
+
+	if detail == "" && inner != nil {
+		detail = inner.Error()
+	}
+	if detail == "" {
+		detail = meta.userMessage
+	}
+
+	return &AppError{
+		Code:        code,
+		UserMessage: meta.userMessage,
+		Suggestion:  meta.suggestion,
+		Severity:    meta.severity,
+		Detail:      detail,
+	}
+}
+
+// From 将任意错误转换为 AppError，未分类的错误使用 ERR_UNKNOWN
+func From(err error) *AppError {
+	if err == nil {
+		return nil
+	}
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	return New("ERR_UNKNOWN", err.Error(), err)
+}
+
+// DetectCode 根据转换过程中的错误推断错误码
+func DetectCode(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ErrCancelled
+	case service.IsDiskFull(err):
+		return ErrDiskFull
+	case service.IsPermissionDenied(err):
+		return ErrPermissionDenied
+	case errors.Is(err, service.ErrUnsupportedInput):
+		return ErrUnsupportedFormat
+	case errors.Is(err, service.ErrUnsupportedOutput):
+		return ErrUnsupportedOutput
+	case errors.Is(err, service.ErrInvalidEncode):
+		return ErrInvalidEncode
+	case errors.Is(err, service.ErrVerifyFailed):
+		return ErrVerifyFailed
+	case errors.Is(err, service.ErrPathNotAllowed):
+		return ErrPathNotAllowed
+	case errors.Is(err, service.ErrFFmpegUnavailable):
+		return ErrRuntimeMissing
+	case errors.Is(err, service.ErrTranscodeProcess):
+		return ErrTranscodeFailed
+	case errors.Is(err, service.ErrMissingKGGKey):
+		return ErrDecryptKeyExpired
+	case errors.Is(err, service.ErrUnknownAudio), errors.Is(err, service.ErrDecryptProcess):
+		return ErrDecryptFailed
+	default:
+		return ErrDecryptFailed
+	}
+}
+
+// ToBatchFileError 将转换错误映射为批量结果中的结构化错误，HTTP 接口与命令行共用
+func ToBatchFileError(err error) *service.BatchFileError {
+	if err == nil {
+		return nil
+	}
+
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return &service.BatchFileError{
+			Code:        appErr.Code,
+			UserMessage: appErr.UserMessage,
+			Suggestion:  appErr.Suggestion,
+			Severity:    appErr.Severity,
+			Detail:      appErr.Detail,
+		}
+	}
+
+	mapped := New(DetectCode(err), err.Error(), nil)
+	return &service.BatchFileError{
+		Code:        mapped.Code,
+		UserMessage: mapped.UserMessage,
+		Suggestion:  mapped.Suggestion,
+		Severity:    mapped.Severity,
+		Detail:      mapped.Detail,
+	}
+}
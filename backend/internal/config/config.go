@@ -2,32 +2,106 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"strconv"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Addr            string `yaml:"addr" json:"addr"`
-	FFmpegBin       string `yaml:"ffmpeg_bin" json:"ffmpeg_bin"`
-	PublicDir       string `yaml:"public_dir" json:"public_dir"`
-	MaxFileSize     int64  `yaml:"max_file_size" json:"max_file_size"`
-	MaxFiles        int    `yaml:"max_files" json:"max_files"`
-	DefaultOutput   string `yaml:"default_output" json:"default_output"`
-	Concurrency     int    `yaml:"concurrency" json:"concurrency"`
-	ParseFormMemory int64  `yaml:"parse_form_memory" json:"parse_form_memory"`
+	Addr              string `yaml:"addr" json:"addr"`
+	FFmpegBin         string `yaml:"ffmpeg_bin" json:"ffmpeg_bin"`
+	PublicDir         string `yaml:"public_dir" json:"public_dir"`
+	MaxFileSize       int64  `yaml:"max_file_size" json:"max_file_size"`
+	MaxFiles          int    `yaml:"max_files" json:"max_files"`
+	DefaultOutput     string `yaml:"default_output" json:"default_output"`
+	Concurrency       int    `yaml:"concurrency" json:"concurrency"`
+	ParseFormMemory   int64  `yaml:"parse_form_memory" json:"parse_form_memory"`
+	VerifyOutput      bool   `yaml:"verify_output" json:"verify_output"`
+	WriteManifest     bool   `yaml:"write_manifest" json:"write_manifest"`
+	PreserveStructure bool   `yaml:"preserve_structure" json:"preserve_structure"`
+	DataDir           string `yaml:"data_dir" json:"data_dir"`
+	// TempDir 为临时文件的上级目录，为空时使用系统临时目录；每个进程在其中创建专属子目录
+	TempDir string `yaml:"temp_dir" json:"temp_dir"`
+	// MaxWorkers 为所有请求共享的转换槽位数；MaxActiveBatches 个批次同时运行，
+	// 其余最多 MaxQueuedBatches 个排队，超出时拒绝新的转换请求
+	MaxWorkers       int `yaml:"max_workers" json:"max_workers"`
+	MaxActiveBatches int `yaml:"max_active_batches" json:"max_active_batches"`
+	MaxQueuedBatches int `yaml:"max_queued_batches" json:"max_queued_batches"`
+	// UnixSocket 非空时监听该 Unix 域套接字而不是 Addr，供本机反向代理连接
+	UnixSocket string    `yaml:"unix_socket" json:"unix_socket"`
+	TLS        TLSConfig `yaml:"tls" json:"tls"`
+
+	// Auth 为 auto/on/off；auto 在监听非本机地址或 Unix 套接字时要求 Bearer 令牌。
+	// AuthToken 为空时自动生成并保存在数据目录，AllowedHosts 为额外允许的 Host/Origin 主机名
+	Auth         string   `yaml:"auth" json:"auth"`
+	AuthToken    string   `yaml:"auth_token" json:"-"`
+	AllowedHosts []string `yaml:"allowed_hosts" json:"allowed_hosts"`
+	// AllowedRoots 非空时 HTTP 接口只能读写这些目录 (解析符号链接后判断)
+	AllowedRoots []string `yaml:"allowed_roots" json:"allowed_roots"`
+
+	Encode   EncodeConfig   `yaml:"encode" json:"encode"`
+	Loudness LoudnessConfig `yaml:"loudness" json:"loudness"`
+}
+
+// TLSConfig 启用 HTTPS；未配置证书与私钥时在数据目录生成自签名证书
+type TLSConfig struct {
+	Enabled  bool   `yaml:"enabled" json:"enabled"`
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+}
+
+// EncodeConfig 是转换请求未显式指定时使用的默认编码参数
+type EncodeConfig struct {
+	MP3Quality      int    `yaml:"mp3_quality" json:"mp3_quality"`
+	AACBitrate      int    `yaml:"aac_bitrate" json:"aac_bitrate"`
+	OpusBitrate     int    `yaml:"opus_bitrate" json:"opus_bitrate"`
+	VorbisQuality   int    `yaml:"vorbis_quality" json:"vorbis_quality"`
+	RateMode        string `yaml:"rate_mode" json:"rate_mode"`
+	Bitrate         int    `yaml:"bitrate" json:"bitrate"`
+	SampleRate      int    `yaml:"sample_rate" json:"sample_rate"`
+	Channels        int    `yaml:"channels" json:"channels"`
+	BitDepth        int    `yaml:"bit_depth" json:"bit_depth"`
+	FLACCompression int    `yaml:"flac_compression" json:"flac_compression"`
+}
+
+// LoudnessConfig 是响度标准化 / ReplayGain 的默认参数
+type LoudnessConfig struct {
+	Mode       string  `yaml:"mode" json:"mode"`
+	TargetLUFS float64 `yaml:"target_lufs" json:"target_lufs"`
+	TruePeak   float64 `yaml:"true_peak" json:"true_peak"`
+	AlbumGroup string  `yaml:"album_group" json:"album_group"`
 }
 
 func DefaultConfig() *Config {
 	return &Config{
-		Addr:            ":8080",
-		FFmpegBin:       "tools/ffmpeg.exe",
-		PublicDir:       "public",
-		MaxFileSize:     80 << 20,
-		MaxFiles:        500,
-		DefaultOutput:   "",
-		Concurrency:     3,
-		ParseFormMemory: 32 << 20,
+		Addr:             "127.0.0.1:8080",
+		FFmpegBin:        "tools/ffmpeg.exe",
+		PublicDir:        "public",
+		MaxFileSize:      80 << 20,
+		MaxFiles:         500,
+		DefaultOutput:    "",
+		Concurrency:      3,
+		ParseFormMemory:  32 << 20,
+		MaxWorkers:       6,
+		MaxActiveBatches: 2,
+		MaxQueuedBatches: 10,
+		DataDir:          "data",
+		Auth:             "auto",
+		Encode: EncodeConfig{
+			MP3Quality:      2,
+			AACBitrate:      256,
+			OpusBitrate:     160,
+			VorbisQuality:   6,
+			RateMode:        "vbr",
+			FLACCompression: 5,
+		},
+		Loudness: LoudnessConfig{
+			Mode:       "off",
+			TargetLUFS: -16,
+			TruePeak:   -1.5,
+			AlbumGroup: "folder",
+		},
 	}
 }
 
@@ -56,6 +130,35 @@ func LoadConfig(configPath, addr, ffmpegBin string, addrSet, ffmpegSet bool) (*C
 	if env := os.Getenv("KGG_DEFAULT_OUTPUT"); env != "" {
 		cfg.DefaultOutput = env
 	}
+	if env := os.Getenv("KGG_DATA_DIR"); env != "" {
+		cfg.DataDir = env
+	}
+	if env := os.Getenv("KGG_TEMP_DIR"); env != "" {
+		cfg.TempDir = env
+	}
+	if env := os.Getenv("KGG_AUTH"); env != "" {
+		cfg.Auth = env
+	}
+	if env := os.Getenv("KGG_AUTH_TOKEN"); env != "" {
+		cfg.AuthToken = env
+	}
+	if env := os.Getenv("KGG_UNIX_SOCKET"); env != "" {
+		cfg.UnixSocket = env
+	}
+	if env := os.Getenv("KGG_TLS"); env != "" {
+		if v, err := strconv.ParseBool(env); err == nil {
+			cfg.TLS.Enabled = v
+		}
+	}
+	if env := os.Getenv("KGG_TLS_CERT"); env != "" {
+		cfg.TLS.CertFile = env
+	}
+	if env := os.Getenv("KGG_TLS_KEY"); env != "" {
+		cfg.TLS.KeyFile = env
+	}
+	if env := os.Getenv("KGG_ALLOWED_ROOTS"); env != "" {
+		cfg.AllowedRoots = filepath.SplitList(env)
+	}
 	if env := os.Getenv("KGG_MAX_FILE_SIZE"); env != "" {
 		if n, err := strconv.ParseInt(env, 10, 64); err == nil && n > 0 {
 			cfg.MaxFileSize = n
@@ -71,6 +174,21 @@ func LoadConfig(configPath, addr, ffmpegBin string, addrSet, ffmpegSet bool) (*C
 			cfg.Concurrency = n
 		}
 	}
+	if env := os.Getenv("KGG_MAX_WORKERS"); env != "" {
+		if n, err := strconv.Atoi(env); err == nil && n > 0 {
+			cfg.MaxWorkers = n
+		}
+	}
+	if env := os.Getenv("KGG_MAX_ACTIVE_BATCHES"); env != "" {
+		if n, err := strconv.Atoi(env); err == nil && n > 0 {
+			cfg.MaxActiveBatches = n
+		}
+	}
+	if env := os.Getenv("KGG_MAX_QUEUED_BATCHES"); env != "" {
+		if n, err := strconv.Atoi(env); err == nil && n >= 0 {
+			cfg.MaxQueuedBatches = n
+		}
+	}
 	if env := os.Getenv("KGG_PARSE_FORM_MEMORY"); env != "" {
 		if n, err := strconv.ParseInt(env, 10, 64); err == nil && n > 0 {
 			cfg.ParseFormMemory = n
@@ -90,6 +208,15 @@ func LoadConfig(configPath, addr, ffmpegBin string, addrSet, ffmpegSet bool) (*C
 	if cfg.MaxFiles <= 0 {
 		cfg.MaxFiles = 500
 	}
+	if cfg.MaxWorkers <= 0 {
+		cfg.MaxWorkers = 6
+	}
+	if cfg.MaxActiveBatches <= 0 {
+		cfg.MaxActiveBatches = 2
+	}
+	if cfg.MaxQueuedBatches < 0 {
+		cfg.MaxQueuedBatches = 0
+	}
 	if cfg.MaxFileSize <= 0 {
 		cfg.MaxFileSize = 80 << 20
 	}
@@ -99,6 +226,9 @@ func LoadConfig(configPath, addr, ffmpegBin string, addrSet, ffmpegSet bool) (*C
 	if cfg.PublicDir == "" {
 		cfg.PublicDir = "public"
 	}
+	if cfg.DataDir == "" {
+		cfg.DataDir = "data"
+	}
 
 	return cfg, nil
 }
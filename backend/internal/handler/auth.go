@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kugo-music-converter/internal/apperr"
+	"kugo-music-converter/internal/config"
+	"kugo-music-converter/internal/logger"
+)
+
+// 访问令牌模式：auto 在监听非本机地址时启用令牌，on/off 强制启用或关闭
+const (
+	authAuto = "auto"
+	authOn   = "on"
+	authOff  = "off"
+)
+
+// authTokenFile 是自动生成的令牌在数据目录中的文件名
+const authTokenFile = "auth-token"
+
+// accessGuard 保护 /api/ 接口：校验 Bearer 令牌，拒绝跨站请求，未启用令牌时拒绝非本机 Host 以防 DNS 重绑定
+type accessGuard struct {
+	token        string
+	allowedHosts map[string]struct{}
+}
+
+// normalizeAuthMode 返回规范化的令牌模式，无法识别时报错
+func normalizeAuthMode(raw string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(raw)); mode {
+	case "", authAuto:
+		return authAuto, nil
+	case authOn, "true", "1":
+		return authOn, nil
+	case authOff, "false", "0":
+		return authOff, nil
+	default:
+		return "", fmt.Errorf("不支持的 auth 模式: %s (可选 auto/on/off)", raw)
+	}
+}
+
+// listensLocally 判断服务是否只能从本机访问。Unix 套接字通常由反向代理连接并对外转发，
+// 不视为本机访问，需要关闭令牌时应显式配置 auth: off
+func listensLocally(cfg *config.Config) bool {
+	return strings.TrimSpace(cfg.UnixSocket) == "" && isLoopbackAddr(cfg.Addr)
+}
+
+// isLoopbackAddr 判断监听地址是否只绑定本机；省略主机或 0.0.0.0 视为对外监听
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return isLoopbackHost(host)
+}
+
+func isLoopbackHost(host string) bool {
+	host = strings.Trim(host, "[]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// newAccessGuard 按配置决定是否启用令牌；需要令牌但未配置时读取或生成数据目录中的令牌文件
+func newAccessGuard(cfg *config.Config, dataDir string) (*accessGuard, error) {
+	mode, err := normalizeAuthMode(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+	g := &accessGuard{allowedHosts: map[string]struct{}{}}
+	for _, host := range cfg.AllowedHosts {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			g.allowedHosts[host] = struct{}{}
+		}
+	}
+	if mode == authOff || (mode == authAuto && listensLocally(cfg)) {
+		return g, nil
+	}
+
+	g.token = strings.TrimSpace(cfg.AuthToken)
+	if g.token == "" {
+		if g.token, err = loadOrCreateToken(filepath.Join(dataDir, authTokenFile)); err != nil {
+			return nil, fmt.Errorf("生成访问令牌失败: %w", err)
+		}
+	}
+	return g, nil
+}
+
+// loadOrCreateToken 读取令牌文件，不存在时生成 32 字节随机令牌并以 0600 权限保存
+func loadOrCreateToken(path string) (string, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+		return "", err
+	}
+	logger.Infof("已生成访问令牌: %s", path)
+	return token, nil
+}
+
+// wrap 只检查 /api/ 接口与 /metrics；静态页面不含敏感数据，页面加载后由前端携带令牌访问接口。
+// /api/health 供外部探活，不要求令牌，但同样拒绝跨站请求。
+func (g *accessGuard) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") && r.URL.Path != "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := g.checkOrigin(r); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		if g.token != "" && r.URL.Path != "/api/health" && !g.checkToken(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kugo"`)
+			writeError(w, http.StatusUnauthorized, apperr.New(apperr.ErrUnauthorized, "", nil))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkToken 接受 Authorization: Bearer 头；下载链接等无法设置请求头的 GET 请求可用 token 查询参数
+func (g *accessGuard) checkToken(r *http.Request) bool {
+	got := ""
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		got = strings.TrimSpace(auth[7:])
+	} else if r.Method == http.MethodGet {
+		got = r.URL.Query().Get("token")
+	}
+	return got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(g.token)) == 1
+}
+
+// checkOrigin 拒绝来自其他网站的请求 (CSRF)；未启用令牌时还要求 Host 为本机、IP 或允许的主机名，
+// 防止 DNS 重绑定把外部域名解析到本机后读取接口
+func (g *accessGuard) checkOrigin(r *http.Request) error {
+	if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return apperr.New(apperr.ErrForbiddenOrigin, "拒绝跨站请求", nil)
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || (!strings.EqualFold(u.Host, r.Host) && !g.originAllowed(u.Hostname())) {
+			return apperr.New(apperr.ErrForbiddenOrigin, "拒绝来源 "+origin, nil)
+		}
+	}
+	if g.token == "" && !g.hostAllowed(r.Host) {
+		return apperr.New(apperr.ErrForbiddenOrigin, "拒绝 Host "+r.Host, nil)
+	}
+	return nil
+}
+
+// hostAllowed 接受本机名、IP 地址 (DNS 重绑定只能使用域名) 与 allowed_hosts 中的主机名
+func (g *accessGuard) hostAllowed(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if isLoopbackHost(host) || net.ParseIP(host) != nil {
+		return true
+	}
+	_, ok := g.allowedHosts[host]
+	return ok
+}
+
+// originAllowed 接受 allowed_hosts 中的来源，用于经反向代理访问时 Host 被改写的情况
+func (g *accessGuard) originAllowed(host string) bool {
+	_, ok := g.allowedHosts[strings.ToLower(host)]
+	return ok
+}
+
+// logAccess 在启动时给出访问方式；启用令牌时打印令牌与带令牌的访问地址
+func (g *accessGuard) logAccess(cfg *config.Config, tlsEnabled bool) {
+	if g.token == "" {
+		switch {
+		case strings.TrimSpace(cfg.UnixSocket) != "":
+			logger.Warnf("访问令牌已关闭，反向代理转发的任何请求都可以读取本机文件并发起转换")
+		case !listensLocally(cfg):
+			logger.Warnf("访问令牌已关闭，局域网内任何人都可以读取本机文件并发起转换")
+		}
+		return
+	}
+	logger.Infof("访问令牌: %s", g.token)
+	host, port, err := net.SplitHostPort(cfg.Addr)
+	if strings.TrimSpace(cfg.UnixSocket) != "" || err != nil {
+		return
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	scheme := "http"
+	if tlsEnabled {
+		scheme = "https"
+	}
+	logger.Infof("浏览器访问: %s://%s/?token=%s", scheme, net.JoinHostPort(host, port), g.token)
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kugo-music-converter/internal/apperr"
+	"kugo-music-converter/internal/config"
+)
+
+const testToken = "secret-token"
+
+func TestAccessGuardWrap(t *testing.T) {
+	remote := &config.Config{Addr: "0.0.0.0:8080", Auth: authAuto, AuthToken: testToken}
+	local := &config.Config{Addr: "127.0.0.1:8080", Auth: authAuto}
+	proxied := &config.Config{Addr: "127.0.0.1:8080", Auth: authAuto, AllowedHosts: []string{"music.example.com"}}
+
+	tests := []struct {
+		name    string
+		cfg     *config.Config
+		method  string
+		target  string
+		host    string
+		headers map[string]string
+		status  int
+		code    string
+	}{
+		{name: "missing token", cfg: remote, method: http.MethodGet, target: "/api/jobs", host: "192.168.1.2:8080",
+			status: http.StatusUnauthorized, code: apperr.ErrUnauthorized},
+		{name: "wrong token", cfg: remote, method: http.MethodGet, target: "/api/jobs", host: "192.168.1.2:8080",
+			headers: map[string]string{"Authorization": "Bearer wrong"},
+			status:  http.StatusUnauthorized, code: apperr.ErrUnauthorized},
+		{name: "bearer token", cfg: remote, method: http.MethodPost, target: "/api/convert", host: "192.168.1.2:8080",
+			headers: map[string]string{"Authorization": "bearer " + testToken},
+			status:  http.StatusOK},
+		{name: "query token on GET", cfg: remote, method: http.MethodGet, target: "/api/jobs?token=" + testToken, host: "192.168.1.2:8080",
+			status: http.StatusOK},
+		{name: "query token on POST", cfg: remote, method: http.MethodPost, target: "/api/convert?token=" + testToken, host: "192.168.1.2:8080",
+			status: http.StatusUnauthorized, code: apperr.ErrUnauthorized},
+		{name: "metrics requires token", cfg: remote, method: http.MethodGet, target: "/metrics", host: "192.168.1.2:8080",
+			status: http.StatusUnauthorized, code: apperr.ErrUnauthorized},
+		{name: "health without token", cfg: remote, method: http.MethodGet, target: "/api/health", host: "192.168.1.2:8080",
+			status: http.StatusOK},
+		{name: "static page without token", cfg: remote, method: http.MethodGet, target: "/index.html", host: "evil.example",
+			status: http.StatusOK},
+		{name: "cross-site fetch", cfg: remote, method: http.MethodPost, target: "/api/convert", host: "192.168.1.2:8080",
+			headers: map[string]string{"Authorization": "Bearer " + testToken, "Sec-Fetch-Site": "cross-site"},
+			status:  http.StatusForbidden, code: apperr.ErrForbiddenOrigin},
+		{name: "cross-site origin", cfg: local, method: http.MethodPost, target: "/api/convert", host: "127.0.0.1:8080",
+			headers: map[string]string{"Origin": "https://evil.example"},
+			status:  http.StatusForbidden, code: apperr.ErrForbiddenOrigin},
+		{name: "cross-site origin on health", cfg: remote, method: http.MethodGet, target: "/api/health", host: "192.168.1.2:8080",
+			headers: map[string]string{"Origin": "https://evil.example"},
+			status:  http.StatusForbidden, code: apperr.ErrForbiddenOrigin},
+		{name: "same origin", cfg: local, method: http.MethodPost, target: "/api/convert", host: "127.0.0.1:8080",
+			headers: map[string]string{"Origin": "http://127.0.0.1:8080"},
+			status:  http.StatusOK},
+		{name: "allowed origin behind proxy", cfg: proxied, method: http.MethodPost, target: "/api/convert", host: "127.0.0.1:8080",
+			headers: map[string]string{"Origin": "https://music.example.com"},
+			status:  http.StatusOK},
+		{name: "host mismatch without token", cfg: local, method: http.MethodGet, target: "/api/jobs", host: "rebind.example:8080",
+			status: http.StatusForbidden, code: apperr.ErrForbiddenOrigin},
+		{name: "allowed host without token", cfg: proxied, method: http.MethodGet, target: "/api/jobs", host: "music.example.com",
+			status: http.StatusOK},
+		{name: "ip host without token", cfg: local, method: http.MethodGet, target: "/api/jobs", host: "192.168.1.2:8080",
+			status: http.StatusOK},
+		{name: "any host with token", cfg: remote, method: http.MethodGet, target: "/api/jobs", host: "rebind.example:8080",
+			headers: map[string]string{"Authorization": "Bearer " + testToken},
+			status:  http.StatusOK},
+		{name: "unix socket auto requires token", cfg: &config.Config{UnixSocket: "/run/kugo.sock", Auth: authAuto, AuthToken: testToken},
+			method: http.MethodGet, target: "/api/jobs", host: "localhost",
+			status: http.StatusUnauthorized, code: apperr.ErrUnauthorized},
+		{name: "unix socket auto with token", cfg: &config.Config{UnixSocket: "/run/kugo.sock", Auth: authAuto, AuthToken: testToken},
+			method: http.MethodGet, target: "/api/jobs", host: "localhost",
+			headers: map[string]string{"Authorization": "Bearer " + testToken},
+			status:  http.StatusOK},
+		{name: "unix socket auth off", cfg: &config.Config{UnixSocket: "/run/kugo.sock", Auth: authOff, AuthToken: testToken},
+			method: http.MethodGet, target: "/api/jobs", host: "localhost",
+			status: http.StatusOK},
+		{name: "unix socket auth off checks host", cfg: &config.Config{UnixSocket: "/run/kugo.sock", Auth: authOff},
+			method: http.MethodGet, target: "/api/jobs", host: "rebind.example",
+			status: http.StatusForbidden, code: apperr.ErrForbiddenOrigin},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := newAccessGuard(tt.cfg, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			req.Host = tt.host
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			g.wrap(next).ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.code == "" {
+				return
+			}
+			var resp ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Code != tt.code {
+				t.Errorf("code = %s, want %s", resp.Code, tt.code)
+			}
+			if tt.status == http.StatusUnauthorized && !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Bearer") {
+				t.Errorf("missing WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestNewAccessGuardGeneratesToken(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{UnixSocket: "/run/kugo.sock", Auth: authAuto}
+	g, err := newAccessGuard(cfg, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.token == "" {
+		t.Fatal("unix socket in auto mode should require a token")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, authTokenFile))
+	if err != nil || strings.TrimSpace(string(data)) != g.token {
+		t.Fatalf("token file = %q, %v", data, err)
+	}
+	// 再次启动时沿用已保存的令牌
+	again, err := newAccessGuard(cfg, dir)
+	if err != nil || again.token != g.token {
+		t.Fatalf("reloaded token = %q, %v", again.token, err)
+	}
+
+	local, err := newAccessGuard(&config.Config{Addr: "127.0.0.1:8080", Auth: authAuto}, t.TempDir())
+	if err != nil || local.token != "" {
+		t.Fatalf("loopback auto mode token = %q, %v", local.token, err)
+	}
+}
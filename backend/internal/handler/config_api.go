@@ -2,6 +2,8 @@ package handler
 
 import (
 	"net/http"
+
+	"kugo-music-converter/internal/service"
 )
 
 type limitsResp struct {
@@ -10,13 +12,18 @@ type limitsResp struct {
 }
 
 type configResp struct {
-	DefaultOutputDir string     `json:"defaultOutputDir"`
-	MissingTools     []string   `json:"missingTools"`
-	DB               any        `json:"db"`
-	Limits           limitsResp `json:"limits"`
-	RuntimeReady     bool       `json:"runtimeReady"`
-	SupportedFormats []string   `json:"supportedFormats"`
-	SupportedExts    []string   `json:"supportedExts"`
+	DefaultOutputDir string                       `json:"defaultOutputDir"`
+	MissingTools     []string                     `json:"missingTools"`
+	DB               any                          `json:"db"`
+	Limits           limitsResp                   `json:"limits"`
+	RuntimeReady     bool                         `json:"runtimeReady"`
+	SupportedFormats []string                     `json:"supportedFormats"`
+	SupportedExts    []string                     `json:"supportedExts"`
+	ArchiveFormats   []string                     `json:"archiveFormats"`
+	OutputFormats    []string                     `json:"outputFormats"`
+	FFmpeg           service.FFmpegCapabilities   `json:"ffmpeg"`
+	Degraded         bool                         `json:"degraded"`
+	AvailableOutputs []service.OutputAvailability `json:"availableOutputs"`
 }
 
 func (h *ConvertHandler) HandleConfig(w http.ResponseWriter, r *http.Request) {
@@ -25,7 +32,8 @@ func (h *ConvertHandler) HandleConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	missingTools := h.runtimeMissingTools()
+	caps := h.ffmpegCapabilities()
+	missingTools := h.runtimeMissingTools(caps)
 	db := h.getDBStatus()
 	writeJSON(w, http.StatusOK, configResp{
 		DefaultOutputDir: h.defaultOutputDir,
@@ -35,8 +43,13 @@ func (h *ConvertHandler) HandleConfig(w http.ResponseWriter, r *http.Request) {
 			MaxFileCount:  h.cfg.MaxFiles,
 			MaxFileSizeMB: int(h.cfg.MaxFileSize / (1024 * 1024)),
 		},
-		RuntimeReady:     len(missingTools) == 0,
+		RuntimeReady:     true,
 		SupportedFormats: supportedInputExts,
 		SupportedExts:    supportedInputExts,
+		ArchiveFormats:   []string{".zip"},
+		OutputFormats:    service.OutputFormats(),
+		FFmpeg:           caps,
+		Degraded:         !caps.Available,
+		AvailableOutputs: caps.OutputAvailability(),
 	})
 }
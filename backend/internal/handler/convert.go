@@ -11,13 +11,14 @@ import (
 	"sync"
 	"time"
 
+	"kugo-music-converter/internal/apperr"
 	"kugo-music-converter/internal/config"
 	"kugo-music-converter/internal/logger"
 	"kugo-music-converter/internal/service"
 )
 
 var (
-	supportedInputExts = []string{".kgg", ".kgm", ".kgma", ".vpr", ".ncm"}
+	supportedInputExts = service.SupportedInputExts
 )
 
 const (
@@ -28,19 +29,33 @@ const (
 type ConvertHandler struct {
 	cfg            *config.Config
 	decryptService *service.DecryptService
+	converter      *service.Converter
 	startedAt      time.Time
 
 	baseDir          string
 	publicDir        string
 	ffmpegPath       string
 	defaultOutputDir string
+	dataDir          string
+
+	// allow 为 allowed_roots 限制，nil 表示不限制
+	allow *service.PathAllowlist
 
 	dbMu     sync.RWMutex
 	dbPath   string
 	dbSource string
 	dbKeyMap map[string]string
 
+	ffmpegMu   sync.RWMutex
+	ffmpegCaps service.FFmpegCapabilities
+	// ffmpegProbedAt 为最近一次探测的时间，ffmpeg 不可用时据此限制自动重新探测的频率
+	ffmpegProbedAt time.Time
+
 	shutdownCtx context.Context
+
+	jobs *jobStore
+	// sched 在所有转换请求之间分配转换槽位
+	sched *service.Scheduler
 }
 
 func NewConvertHandler(cfg *config.Config) *ConvertHandler {
@@ -49,17 +64,23 @@ func NewConvertHandler(cfg *config.Config) *ConvertHandler {
 	ffmpegPath := resolveFile(baseDir, cfg.FFmpegBin)
 	defaultOutputDir := resolveOutputDir(baseDir, cfg.DefaultOutput)
 
+	decryptService := service.NewDecryptService(cfg)
+
 	h := &ConvertHandler{
 		cfg:              cfg,
-		decryptService:   service.NewDecryptService(cfg),
+		decryptService:   decryptService,
+		converter:        service.NewConverter(decryptService, ffmpegPath),
 		startedAt:        time.Now(),
 		baseDir:          baseDir,
 		publicDir:        publicDir,
 		ffmpegPath:       ffmpegPath,
 		defaultOutputDir: defaultOutputDir,
+		dataDir:          resolveDataDir(baseDir, cfg.DataDir),
 		dbSource:         "missing",
 		dbKeyMap:         map[string]string{},
 		shutdownCtx:      context.Background(),
+		jobs:             newJobStore(),
+		sched:            service.NewScheduler(cfg.MaxWorkers, cfg.MaxActiveBatches, cfg.MaxQueuedBatches),
 	}
 
 	if st := service.DetectKGMusicDB(baseDir); st.Found {
@@ -68,6 +89,8 @@ func NewConvertHandler(cfg *config.Config) *ConvertHandler {
 		}
 	}
 
+	h.probeFFmpeg()
+
 	_ = os.MkdirAll(defaultOutputDir, 0o755)
 	return h
 }
@@ -77,8 +100,28 @@ func StartServer(ctx context.Context, cfg *config.Config) error {
 		ctx = context.Background()
 	}
 
+	// 临时目录需要在加载数据库之前设置，解密后的数据库也写在其中
+	tempDir, err := service.InitTempDir(resolveTempDir(mustResolveBaseDir(), cfg.TempDir))
+	if err != nil {
+		return fmt.Errorf("创建临时目录失败: %w", err)
+	}
+	defer service.RemoveTempDir()
+
 	h := NewConvertHandler(cfg)
 	h.setShutdownContext(ctx)
+	guard, err := newAccessGuard(cfg, h.dataDir)
+	if err != nil {
+		return err
+	}
+	if h.allow, err = service.NewPathAllowlist(cfg.AllowedRoots); err != nil {
+		return err
+	}
+	var certFile, keyFile string
+	if cfg.TLS.Enabled {
+		if certFile, keyFile, err = resolveTLSFiles(cfg, h.dataDir); err != nil {
+			return err
+		}
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/config", h.HandleConfig)
@@ -91,19 +134,36 @@ func StartServer(ctx context.Context, cfg *config.Config) error {
 	mux.HandleFunc("/api/validate-db-path", h.HandleValidateDBPath)
 	mux.HandleFunc("/api/redetect-db", h.HandleRedetectDB)
 	mux.HandleFunc("/api/scan-folders", h.HandleScanFolders)
+	mux.HandleFunc("/api/scan-folders-stream", h.HandleScanFoldersStream)
 	mux.HandleFunc("/api/open-folder", h.HandleOpenFolder)
+	mux.HandleFunc("/api/probe-ffmpeg", h.HandleProbeFFmpeg)
+	mux.HandleFunc("/api/inspect", h.HandleInspect)
+	mux.HandleFunc("/api/jobs/{id}/download", h.HandleJobDownload)
+	mux.HandleFunc("/metrics", h.HandleMetrics)
 
 	fileServer := http.FileServer(http.Dir(h.publicDir))
 	mux.Handle("/", fileServer)
 
-	logger.Infof("启动服务: addr=%s", cfg.Addr)
+	if cfg.UnixSocket != "" {
+		logger.Infof("启动服务: unix=%s", cfg.UnixSocket)
+	} else {
+		logger.Infof("启动服务: addr=%s", cfg.Addr)
+	}
+	if certFile != "" {
+		logger.Infof("TLS 证书: %s (SHA-256 %s)", certFile, certFingerprint(certFile, keyFile))
+	}
 	logger.Infof("静态目录: %s", h.publicDir)
 	logger.Infof("FFmpeg 路径: %s", h.ffmpegPath)
 	logger.Infof("默认输出目录: %s", h.defaultOutputDir)
+	logger.Infof("临时目录: %s", tempDir)
+	if roots := h.allow.Roots(); len(roots) > 0 {
+		logger.Infof("允许访问的目录: %s", strings.Join(roots, ", "))
+	}
+	guard.logAccess(cfg, certFile != "")
 
 	srv := &http.Server{
 		Addr:              cfg.Addr,
-		Handler:           logRequest(mux),
+		Handler:           logRequest(guard.wrap(mux)),
 		ReadHeaderTimeout: 10 * time.Second,
 		IdleTimeout:       120 * time.Second,
 	}
@@ -121,7 +181,16 @@ func StartServer(ctx context.Context, cfg *config.Config) error {
 		}
 	}()
 
-	err := srv.ListenAndServe()
+	ln, err := openListener(cfg)
+	if err != nil {
+		close(stopShutdown)
+		return err
+	}
+	if certFile != "" {
+		err = srv.ServeTLS(ln, certFile, keyFile)
+	} else {
+		err = srv.Serve(ln)
+	}
 	close(stopShutdown)
 	if errors.Is(err, http.ErrServerClosed) {
 		return nil
@@ -183,6 +252,12 @@ func resolveDirectory(baseDir, raw string) string {
 	return filepath.Join(baseDir, "public")
 }
 
+// ResolveFFmpeg 按服务端相同的规则查找 ffmpeg (程序目录及其上级的 tools/、当前目录)，
+// 供命令行子命令使用；未找到时返回第一个候选路径
+func ResolveFFmpeg(raw string) string {
+	return resolveFile(mustResolveBaseDir(), raw)
+}
+
 func resolveFile(baseDir, raw string) string {
 	trimmed := strings.TrimSpace(raw)
 	if trimmed == "" {
@@ -255,14 +330,31 @@ func resolveOutputDir(baseDir, raw string) string {
 	return abs
 }
 
-func containsInputExt(name string) bool {
-	ext := strings.ToLower(filepath.Ext(name))
-	for _, item := range supportedInputExts {
-		if ext == item {
-			return true
-		}
+// resolveDataDir 返回存放访问令牌等运行数据的目录，相对路径基于可执行文件所在目录
+func resolveDataDir(baseDir, raw string) string {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		trimmed = "data"
+	}
+	if filepath.IsAbs(trimmed) {
+		return trimmed
 	}
-	return false
+	abs, _ := filepath.Abs(filepath.Join(baseDir, trimmed))
+	return abs
+}
+
+// resolveTempDir 返回临时文件的上级目录；为空时使用系统临时目录，相对路径基于程序所在目录
+func resolveTempDir(baseDir, raw string) string {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" || filepath.IsAbs(trimmed) {
+		return trimmed
+	}
+	abs, _ := filepath.Abs(filepath.Join(baseDir, trimmed))
+	return abs
+}
+
+func containsInputExt(name string) bool {
+	return service.IsSupportedInput(name)
 }
 
 func normalizeConcurrency(raw int, fallback int) int {
@@ -278,10 +370,11 @@ func normalizeConcurrency(raw int, fallback int) int {
 	return raw
 }
 
-func (h *ConvertHandler) runtimeMissingTools() []string {
+// runtimeMissingTools 列出缺失的外部工具；ffmpeg 缺失时服务以降级模式运行，不阻止转换
+func (h *ConvertHandler) runtimeMissingTools(caps service.FFmpegCapabilities) []string {
 	missing := make([]string, 0, 1)
-	if st, err := os.Stat(h.ffmpegPath); err != nil || st.IsDir() {
-		missing = append(missing, "tools/ffmpeg.exe")
+	if !caps.Available {
+		missing = append(missing, h.ffmpegPath)
 	}
 	return missing
 }
@@ -359,11 +452,26 @@ func (h *ConvertHandler) loadDBByPath(dbPath, source string) error {
 	return nil
 }
 
+// checkPath 校验请求中的路径是否位于允许目录之内，返回绝对路径；field 用于错误提示
+func (h *ConvertHandler) checkPath(field, p string) (string, error) {
+	abs, err := h.allow.Check(p)
+	if errors.Is(err, service.ErrPathNotAllowed) {
+		return "", apperr.New(apperr.ErrPathNotAllowed, fmt.Sprintf("%s 不在允许访问的目录中: %s", field, strings.TrimSpace(p)), err)
+	}
+	if err != nil {
+		return "", apperr.New(apperr.ErrScanInvalidPath, fmt.Sprintf("%s 路径无效", field), err)
+	}
+	return abs, nil
+}
+
 func (h *ConvertHandler) getDBForRequest(requestPath string) (string, string, map[string]string, error) {
 	if strings.TrimSpace(requestPath) != "" {
+		if _, err := h.checkPath("dbPath", requestPath); err != nil {
+			return "", "", nil, err
+		}
 		validation := service.ValidateDBPath(requestPath)
 		if !validation.Valid {
-			return "", "", nil, NewAppError(ErrDBNotFound, "数据库路径无效", nil)
+			return "", "", nil, apperr.New(apperr.ErrDBNotFound, "数据库路径无效", nil)
 		}
 
 		h.dbMu.RLock()
@@ -372,7 +480,7 @@ func (h *ConvertHandler) getDBForRequest(requestPath string) (string, string, ma
 
 		if !alreadyLoaded {
 			if err := h.loadDBByPath(validation.Path, "manual"); err != nil {
-				return "", "", nil, NewAppError(ErrDBNotFound, err.Error(), nil)
+				return "", "", nil, apperr.New(apperr.ErrDBNotFound, err.Error(), nil)
 			}
 		}
 	}
@@ -389,56 +497,13 @@ func (h *ConvertHandler) getDBForRequest(requestPath string) (string, string, ma
 
 	status := service.DetectKGMusicDB(h.baseDir)
 	if !status.Found {
-		return "", "", nil, NewAppError(ErrDBNotFound, "未检测到 KGMusicV3.db", nil)
+		return "", "", nil, apperr.New(apperr.ErrDBNotFound, "未检测到 KGMusicV3.db", nil)
 	}
 	if err := h.loadDBByPath(status.Path, status.Source); err != nil {
-		return "", "", nil, NewAppError(ErrDBNotFound, err.Error(), nil)
+		return "", "", nil, apperr.New(apperr.ErrDBNotFound, err.Error(), nil)
 	}
 
 	h.dbMu.RLock()
 	defer h.dbMu.RUnlock()
 	return h.dbPath, h.dbSource, cloneKeyMap(h.dbKeyMap), nil
 }
-
-func detectErrorCode(err error) string {
-	switch {
-	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
-		return ErrCancelled
-	case errors.Is(err, service.ErrUnsupportedInput):
-		return ErrUnsupportedFormat
-	case errors.Is(err, service.ErrTranscodeProcess):
-		return ErrTranscodeFailed
-	case errors.Is(err, service.ErrMissingKGGKey):
-		return ErrDecryptKeyExpired
-	case errors.Is(err, service.ErrUnknownAudio), errors.Is(err, service.ErrDecryptProcess):
-		return ErrDecryptFailed
-	default:
-		return ErrDecryptFailed
-	}
-}
-
-func toBatchFileError(err error) *service.BatchFileError {
-	if err == nil {
-		return nil
-	}
-
-	var appErr *AppError
-	if errors.As(err, &appErr) {
-		return &service.BatchFileError{
-			Code:        appErr.Code,
-			UserMessage: appErr.UserMessage,
-			Suggestion:  appErr.Suggestion,
-			Severity:    appErr.Severity,
-			Detail:      appErr.Detail,
-		}
-	}
-
-	mapped := NewAppError(detectErrorCode(err), err.Error(), nil)
-	return &service.BatchFileError{
-		Code:        mapped.Code,
-		UserMessage: mapped.UserMessage,
-		Suggestion:  mapped.Suggestion,
-		Severity:    mapped.Severity,
-		Detail:      mapped.Detail,
-	}
-}
@@ -3,7 +3,6 @@ package handler
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -14,23 +13,87 @@ import (
 	"strings"
 	"sync"
 
+	"kugo-music-converter/internal/apperr"
+	"kugo-music-converter/internal/logger"
 	"kugo-music-converter/internal/service"
+	"kugo-music-converter/internal/utils"
 )
 
 type convertRequest struct {
-	Items        []service.BatchItem
-	OutputDir    string
-	DBPath       string
-	OutputFormat string
-	MP3Quality   int
-	Concurrency  int
-	Cleanup      func()
+	Items     []service.BatchItem
+	OutputDir string
+	DBPath    string
+	Transcode service.TranscodeOptions
+	Loudness  service.LoudnessOptions
+	Verify    bool
+	Manifest  bool
+	// OutputMode 为 dir 或 zip；zip 时 OutputDir 是任务专属的临时目录，结果以 ZIP 返回
+	OutputMode string
+	// PreserveStructure 按 BatchItem.Root 在输出目录下重建子目录
+	PreserveStructure bool
+	// BestPerGroup 为重复检测模式 (header/content)，非空时每组重复文件只转换音质最好的一个
+	BestPerGroup string
+	// Dropped 是 inputPaths 中被跳过的路径及原因
+	Dropped     []service.ScanPathError
+	Concurrency int
+	Cleanup     func()
+	// SkipSpaceCheck 为 true 时剩余空间不足只给出警告，不拒绝请求
+	SkipSpaceCheck bool
+	// Warnings 为预检给出的提示，随汇总返回
+	Warnings []string
+
+	// ticket 为批次在全局调度器中的登记，由 admitBatch 设置，Cleanup 时释放
+	ticket *service.BatchTicket
+	// temp 统计本批次的临时空间占用
+	temp *service.TempTracker
+	// stagingDir 为 ZIP 模式的临时输出目录，startJob 之前被拒绝时由 Cleanup 删除
+	stagingDir string
+}
+
+// queueRetryAfter 为队列已满时建议客户端重试的间隔 (秒)
+const queueRetryAfter = "30"
+
+// admitBatch 在全局调度器中登记请求；队列已满时写入 503 响应并返回 false
+func (h *ConvertHandler) admitBatch(w http.ResponseWriter, req *convertRequest) bool {
+	ticket, err := h.sched.Admit(req.Concurrency)
+	if err != nil {
+		w.Header().Set("Retry-After", queueRetryAfter)
+		writeError(w, http.StatusServiceUnavailable, apperr.New(apperr.ErrQueueFull, "", err))
+		return false
+	}
+	req.ticket = ticket
+	cleanup := req.Cleanup
+	req.Cleanup = func() {
+		ticket.Done()
+		cleanup()
+	}
+	return true
+}
+
+// checkDiskSpace 按输入大小与输出格式估算临时目录与输出目录所需空间。剩余空间不足时写入 507 响应并返回 false
+// (skipSpaceCheck 时只警告)，余量偏少时记录警告；无法查询剩余空间的平台不检查。
+func (h *ConvertHandler) checkDiskSpace(w http.ResponseWriter, req *convertRequest) bool {
+	concurrency := min(req.Concurrency, h.cfg.MaxWorkers)
+	est := service.EstimateSpace(req.Items, req.Transcode.Format, concurrency)
+	for _, check := range service.CheckSpace(utils.TempDir(), req.OutputDir, est) {
+		detail := fmt.Sprintf("%s 所在磁盘剩余 %s，预计需要 %s", strings.Join(check.Dirs, "、"),
+			utils.FormatBytes(check.Free), utils.FormatBytes(check.Required))
+		if check.Insufficient() && !req.SkipSpaceCheck {
+			writeError(w, http.StatusInsufficientStorage, apperr.New(apperr.ErrDiskFull, detail, nil))
+			return false
+		}
+		if check.Low() {
+			logger.Warnf("磁盘剩余空间偏少: %s", detail)
+			req.Warnings = append(req.Warnings, "磁盘剩余空间偏少："+detail)
+		}
+	}
+	return true
 }
 
 const maxConvertRequestBody int64 = 2 << 30 // 2 GiB hard cap
 
 func createTempFile(prefix, suffix string) (string, error) {
-	f, err := os.CreateTemp("", prefix+"*"+suffix)
+	f, err := os.CreateTemp(utils.TempDir(), prefix+"*"+suffix)
 	if err != nil {
 		return "", err
 	}
@@ -66,81 +129,67 @@ func parseIntOrDefault(raw string, fallback int) int {
 	return n
 }
 
-func uniqueOutputPath(path string) (string, error) {
-	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
-		return path, nil
+func parseFloatOrDefault(raw string, fallback float64) float64 {
+	n, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil {
+		return fallback
 	}
+	return n
+}
 
-	ext := filepath.Ext(path)
-	base := strings.TrimSuffix(path, ext)
-	for i := 1; i < 10000; i++ {
-		candidate := fmt.Sprintf("%s_%d%s", base, i, ext)
-		if _, err := os.Stat(candidate); errors.Is(err, os.ErrNotExist) {
-			return candidate, nil
-		}
+func parseBoolOrDefault(raw string, fallback bool) bool {
+	v, err := strconv.ParseBool(strings.TrimSpace(raw))
+	if err != nil {
+		return fallback
 	}
-	return "", NewAppError(ErrTranscodeFailed, "输出文件重名过多，无法生成唯一文件名", nil)
+	return v
 }
 
-func parseInputPathItems(raw string) ([]service.BatchItem, error) {
+// parseInputPathItems 解析 inputPaths，目录按 inputRecursive/inputFilter 在服务端展开，
+// 返回被跳过的路径及原因。直接列出的路径不在允许目录中时整个请求被拒绝，
+// 目录中指向外部的符号链接只计入被跳过的路径。
+func (h *ConvertHandler) parseInputPathItems(ctx context.Context, raw string, opts service.ExpandInputOptions) ([]service.BatchItem, []service.ScanPathError, error) {
 	if strings.TrimSpace(raw) == "" {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	var paths []string
 	if err := json.Unmarshal([]byte(raw), &paths); err != nil {
-		return nil, NewAppError(ErrNoFiles, "inputPaths 不是合法 JSON 数组", err)
+		return nil, nil, apperr.New(apperr.ErrNoFiles, "inputPaths 不是合法 JSON 数组", err)
 	}
-
-	items := make([]service.BatchItem, 0, len(paths))
 	for _, p := range paths {
-		trimmed := strings.TrimSpace(p)
-		if trimmed == "" {
-			continue
-		}
-		abs, err := filepath.Abs(trimmed)
-		if err != nil {
+		if strings.TrimSpace(p) == "" {
 			continue
 		}
-		st, err := os.Stat(abs)
-		if err != nil || !st.Mode().IsRegular() {
-			continue
-		}
-		name := filepath.Base(abs)
-		if !containsInputExt(name) {
-			continue
+		if _, err := h.checkPath("inputPaths", p); err != nil {
+			return nil, nil, err
 		}
-		items = append(items, service.BatchItem{
-			Path:       abs,
-			OriginPath: abs,
-			Name:       name,
-			Size:       st.Size(),
-			Temporary:  false,
-		})
 	}
-	return items, nil
+	opts.Allow = h.allow
+	items, dropped := service.ExpandInputPaths(ctx, paths, opts)
+	return items, dropped, nil
 }
 
 func copyUploadToTemp(file multipart.File, hdr *multipart.FileHeader) (service.BatchItem, error) {
 	name := hdr.Filename
-	if !containsInputExt(name) {
-		return service.BatchItem{}, NewAppError(ErrUnsupportedFormat, fmt.Sprintf("不支持的格式: %s", filepath.Ext(name)), nil)
+	if !containsInputExt(name) && !service.IsZipInput(name) {
+		return service.BatchItem{}, apperr.New(apperr.ErrUnsupportedFormat, fmt.Sprintf("不支持的格式: %s", filepath.Ext(name)), nil)
 	}
 
 	tmp, err := createTempFile("kgg-upload-", filepath.Ext(name))
 	if err != nil {
-		return service.BatchItem{}, NewAppError("ERR_UNKNOWN", "创建临时文件失败", err)
+		return service.BatchItem{}, apperr.New("ERR_UNKNOWN", "创建临时文件失败", err)
 	}
 
 	if _, err := copyStreamToFile(file, tmp); err != nil {
 		removeQuiet(tmp)
-		return service.BatchItem{}, NewAppError("ERR_UNKNOWN", "写入临时文件失败", err)
+		return service.BatchItem{}, apperr.New("ERR_UNKNOWN", "写入临时文件失败", err)
 	}
 
 	st, err := os.Stat(tmp)
 	if err != nil {
 		removeQuiet(tmp)
-		return service.BatchItem{}, NewAppError("ERR_UNKNOWN", "读取临时文件失败", err)
+		return service.BatchItem{}, apperr.New("ERR_UNKNOWN", "读取临时文件失败", err)
 	}
 
 	return service.BatchItem{
@@ -160,7 +209,7 @@ func (h *ConvertHandler) parseConvertRequest(w http.ResponseWriter, r *http.Requ
 	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
 
 	if err := r.ParseMultipartForm(h.cfg.ParseFormMemory); err != nil {
-		return nil, NewAppError(ErrFileTooLarge, "表单解析失败或文件超过限制", err)
+		return nil, apperr.New(apperr.ErrFileTooLarge, "表单解析失败或文件超过限制", err)
 	}
 
 	items := make([]service.BatchItem, 0, h.cfg.MaxFiles)
@@ -176,16 +225,19 @@ func (h *ConvertHandler) parseConvertRequest(w http.ResponseWriter, r *http.Requ
 		r.MultipartForm.File["files"],
 	}
 
+	zipLimits := service.DefaultZipLimits(h.cfg.MaxFileSize, h.cfg.MaxFiles)
+	var dropped []service.ScanPathError
 	for _, group := range fileGroups {
 		for _, hdr := range group {
-			if hdr.Size > h.cfg.MaxFileSize {
+			// 压缩包只受请求体大小限制，包内条目按单文件上限检查
+			if hdr.Size > h.cfg.MaxFileSize && !service.IsZipInput(hdr.Filename) {
 				cleanup()
-				return nil, NewAppError(ErrFileTooLarge, fmt.Sprintf("文件 %s 超过大小限制", hdr.Filename), nil)
+				return nil, apperr.New(apperr.ErrFileTooLarge, fmt.Sprintf("文件 %s 超过大小限制", hdr.Filename), nil)
 			}
 			f, err := hdr.Open()
 			if err != nil {
 				cleanup()
-				return nil, NewAppError("ERR_UNKNOWN", "打开上传文件失败", err)
+				return nil, apperr.New("ERR_UNKNOWN", "打开上传文件失败", err)
 			}
 			item, err := copyUploadToTemp(f, hdr)
 			_ = f.Close()
@@ -193,172 +245,294 @@ func (h *ConvertHandler) parseConvertRequest(w http.ResponseWriter, r *http.Requ
 				cleanup()
 				return nil, err
 			}
-			items = append(items, item)
 			cleanupPaths = append(cleanupPaths, item.Path)
+			if service.IsZipInput(item.Name) {
+				// 条目直接从临时压缩包解密，压缩包在请求结束时统一删除
+				entries, skipped := service.ExpandZip(item.Path, hdr.Filename, zipLimits)
+				items = append(items, entries...)
+				dropped = append(dropped, skipped...)
+				continue
+			}
+			items = append(items, item)
 		}
 	}
 
-	pathItems, err := parseInputPathItems(r.FormValue("inputPaths"))
+	var roots []string
+	if raw := strings.TrimSpace(r.FormValue("inputRoots")); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &roots); err != nil {
+			cleanup()
+			return nil, apperr.New(apperr.ErrNoFiles, "inputRoots 不是合法 JSON 数组", err)
+		}
+	}
+	pathItems, pathDropped, err := h.parseInputPathItems(r.Context(), r.FormValue("inputPaths"), service.ExpandInputOptions{
+		Recursive: parseBoolOrDefault(r.FormValue("inputRecursive"), false),
+		ExtFilter: service.ParseExtFilter(r.FormValue("inputFilter")),
+		// 多展开一个文件即可判定超限，由下方统一返回 apperr.ErrTooManyFiles
+		MaxFiles: h.cfg.MaxFiles + 1,
+		Roots:    roots,
+		Zip:      zipLimits,
+	})
 	if err != nil {
 		cleanup()
 		return nil, err
 	}
+	dropped = append(dropped, pathDropped...)
 	items = append(items, pathItems...)
+	if len(dropped) > 0 {
+		logger.Infof("输入中跳过 %d 个路径", len(dropped))
+	}
 
 	if len(items) == 0 {
 		cleanup()
-		return nil, NewAppError(ErrNoFiles, "未上传可转换文件", nil)
+		if len(dropped) > 0 {
+			return nil, apperr.New(apperr.ErrNoFiles, fmt.Sprintf("没有可转换文件（%d 个路径被跳过，首个: %s %s）", len(dropped), dropped[0].Path, dropped[0].Reason), nil)
+		}
+		return nil, apperr.New(apperr.ErrNoFiles, "未上传可转换文件", nil)
 	}
 	if len(items) > h.cfg.MaxFiles {
 		cleanup()
-		return nil, NewAppError(ErrTooManyFiles, fmt.Sprintf("文件数量超过限制（最多 %d）", h.cfg.MaxFiles), nil)
+		return nil, apperr.New(apperr.ErrTooManyFiles, fmt.Sprintf("文件数量超过限制（最多 %d）", h.cfg.MaxFiles), nil)
 	}
 	for _, item := range items {
 		if item.Size > h.cfg.MaxFileSize {
 			cleanup()
-			return nil, NewAppError(ErrFileTooLarge, fmt.Sprintf("文件 %s 超过大小限制", item.Name), nil)
+			return nil, apperr.New(apperr.ErrFileTooLarge, fmt.Sprintf("文件 %s 超过大小限制", item.Name), nil)
 		}
 	}
 
-	outputDir := strings.TrimSpace(r.FormValue("outputDir"))
-	if outputDir == "" {
+	outputMode := strings.ToLower(strings.TrimSpace(r.FormValue("outputMode")))
+	if outputMode == "" {
+		outputMode = outputModeDir
+	}
+	if outputMode != outputModeDir && outputMode != outputModeZip {
 		cleanup()
-		return nil, NewAppError(ErrOutputRequired, "输出目录不能为空", nil)
+		return nil, apperr.New(apperr.ErrOutputRequired, "outputMode 仅支持 dir/zip", nil)
 	}
-	absOutputDir, err := filepath.Abs(outputDir)
+	var absOutputDir string
+	if outputMode == outputModeDir {
+		outputDir := strings.TrimSpace(r.FormValue("outputDir"))
+		if outputDir == "" {
+			cleanup()
+			return nil, apperr.New(apperr.ErrOutputRequired, "输出目录不能为空", nil)
+		}
+		if absOutputDir, err = h.checkPath("outputDir", outputDir); err != nil {
+			cleanup()
+			return nil, err
+		}
+		if err := os.MkdirAll(absOutputDir, 0o755); err != nil {
+			cleanup()
+			return nil, apperr.New(apperr.ErrOutputRequired, "无法创建输出目录", err)
+		}
+	}
+
+	transcode, err := h.parseTranscodeOptions(r)
 	if err != nil {
 		cleanup()
-		return nil, NewAppError(ErrOutputRequired, "输出目录无效", err)
+		return nil, err
 	}
-	if err := os.MkdirAll(absOutputDir, 0o755); err != nil {
+	loudness, err := h.parseLoudnessOptions(r, transcode.Format)
+	if err != nil {
 		cleanup()
-		return nil, NewAppError(ErrOutputRequired, "无法创建输出目录", err)
+		return nil, err
+	}
+	if err := h.checkOutputEncoder(transcode.Format, loudness); err != nil {
+		cleanup()
+		return nil, err
 	}
-
-	outputFormat := service.NormalizeOutputFormat(r.FormValue("outputFormat"))
-	mp3Quality := service.NormalizeMP3Quality(parseIntOrDefault(r.FormValue("mp3Quality"), 2))
 	concurrency := normalizeConcurrency(parseIntOrDefault(r.FormValue("concurrency"), h.cfg.Concurrency), h.cfg.Concurrency)
 	dbPath := strings.TrimSpace(r.FormValue("dbPath"))
+	if dbPath != "" {
+		if _, err := h.checkPath("dbPath", dbPath); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+	bestPerGroup := r.FormValue("bestPerGroup")
+	if on, err := strconv.ParseBool(strings.TrimSpace(bestPerGroup)); err == nil {
+		bestPerGroup = ""
+		if on {
+			bestPerGroup = service.DuplicateByHeader
+		}
+	}
+	if bestPerGroup, err = service.NormalizeDuplicateMode(bestPerGroup); err != nil {
+		cleanup()
+		return nil, apperr.New(apperr.ErrInvalidParam, "bestPerGroup: "+err.Error(), err)
+	}
 
 	for i := range items {
 		items[i].Current = i + 1
 	}
 
-	return &convertRequest{
-		Items:        items,
-		OutputDir:    absOutputDir,
-		DBPath:       dbPath,
-		OutputFormat: outputFormat,
-		MP3Quality:   mp3Quality,
-		Concurrency:  concurrency,
-		Cleanup:      cleanup,
-	}, nil
-}
-
-func hasKGG(items []service.BatchItem) bool {
-	for _, item := range items {
-		if strings.EqualFold(filepath.Ext(item.Name), ".kgg") {
-			return true
+	// 临时输出目录最后创建，之后不再有出错返回；startJob 之后目录归任务所有，任务过期时删除
+	if outputMode == outputModeZip {
+		if absOutputDir, err = os.MkdirTemp(utils.TempDir(), "kugo-job-*"); err != nil {
+			cleanup()
+			return nil, apperr.New(apperr.ErrOutputRequired, "无法创建临时输出目录", err)
 		}
 	}
-	return false
-}
 
-func (h *ConvertHandler) convertSingleItem(ctx context.Context, item service.BatchItem, req *convertRequest, dbKeys map[string]string, progress func(string, int)) (string, error) {
-	if progress != nil {
-		progress("prepare", 5)
-	}
-	if ctx.Err() != nil {
-		return "", NewAppError(ErrCancelled, "任务已取消", ctx.Err())
+	req := &convertRequest{
+		Items:             items,
+		OutputDir:         absOutputDir,
+		OutputMode:        outputMode,
+		DBPath:            dbPath,
+		Transcode:         transcode,
+		Loudness:          loudness,
+		Verify:            parseBoolOrDefault(r.FormValue("verify"), h.cfg.VerifyOutput),
+		Manifest:          parseBoolOrDefault(r.FormValue("writeManifest"), h.cfg.WriteManifest),
+		BestPerGroup:      bestPerGroup,
+		PreserveStructure: parseBoolOrDefault(r.FormValue("preserveStructure"), h.cfg.PreserveStructure),
+		Dropped:           dropped,
+		Concurrency:       concurrency,
+		SkipSpaceCheck:    parseBoolOrDefault(r.FormValue("skipSpaceCheck"), false),
+	}
+	if outputMode == outputModeZip {
+		req.stagingDir = absOutputDir
+	}
+	req.Cleanup = func() {
+		cleanup()
+		if req.stagingDir != "" {
+			_ = os.RemoveAll(req.stagingDir)
+		}
 	}
+	return req, nil
+}
 
-	ext := strings.ToLower(filepath.Ext(item.Name))
-	var (
-		rawPath     string
-		rawCleanup  func()
-		decryptErr  error
-		rawAudioExt string
-	)
+// startJob 登记转换任务；ZIP 模式的临时输出目录从此归任务所有，不再由 Cleanup 删除
+func (h *ConvertHandler) startJob(req *convertRequest) *convertJob {
+	req.stagingDir = ""
+	return h.jobs.start(req.OutputDir, req.OutputMode == outputModeZip)
+}
 
-	if ext == ".kgg" {
-		if len(dbKeys) == 0 {
-			return "", NewAppError(ErrDBNotFound, "KGG 转换需要 KGMusicV3.db", nil)
+// parseTranscodeOptions 读取表单中的编码参数，未提供的字段回落到配置默认值
+func (h *ConvertHandler) parseTranscodeOptions(r *http.Request) (service.TranscodeOptions, error) {
+	outputFormat, err := service.NormalizeOutputFormat(r.FormValue("outputFormat"))
+	if err != nil {
+		return service.TranscodeOptions{}, apperr.New(apperr.ErrUnsupportedOutput, err.Error(), err)
+	}
+
+	defaults := service.EncodeDefaults(outputFormat, h.cfg.Encode)
+	opts := service.TranscodeOptions{
+		Format:          outputFormat,
+		MP3Quality:      parseIntOrDefault(r.FormValue("mp3Quality"), defaults.MP3Quality),
+		AACBitrate:      parseIntOrDefault(r.FormValue("aacBitrate"), defaults.AACBitrate),
+		OpusBitrate:     parseIntOrDefault(r.FormValue("opusBitrate"), defaults.OpusBitrate),
+		VorbisQuality:   parseIntOrDefault(r.FormValue("vorbisQuality"), defaults.VorbisQuality),
+		RateMode:        defaults.RateMode,
+		Bitrate:         parseIntOrDefault(r.FormValue("bitrate"), defaults.Bitrate),
+		SampleRate:      parseIntOrDefault(r.FormValue("sampleRate"), defaults.SampleRate),
+		Channels:        parseIntOrDefault(r.FormValue("channels"), defaults.Channels),
+		BitDepth:        parseIntOrDefault(r.FormValue("bitDepth"), defaults.BitDepth),
+		FLACCompression: parseIntOrDefault(r.FormValue("flacCompression"), defaults.FLACCompression),
+	}
+	if rateMode := service.NormalizeRateMode(r.FormValue("rateMode")); rateMode != "" {
+		opts.RateMode = rateMode
+		if strings.TrimSpace(r.FormValue("bitrate")) == "" && rateMode == service.RateModeVBR {
+			// 显式选择 vbr 时不沿用配置中 cbr/abr 的默认码率
+			opts.Bitrate = 0
 		}
-		rawPath, rawCleanup, decryptErr = h.decryptService.DecryptFileByExtWithMemKey(item.Path, dbKeys)
-	} else {
-		rawPath, rawCleanup, decryptErr = h.decryptService.DecryptFileByExt(item.Path)
-	}
-	if decryptErr != nil {
-		return "", NewAppError(detectErrorCode(decryptErr), decryptErr.Error(), decryptErr)
 	}
-	if rawCleanup != nil {
-		defer rawCleanup()
+	if err := opts.Validate(); err != nil {
+		return service.TranscodeOptions{}, apperr.New(apperr.ErrInvalidEncode, err.Error(), err)
 	}
+	return opts, nil
+}
 
-	if progress != nil {
-		progress("decrypt", 60)
+// parseLoudnessOptions 读取响度处理参数，未提供的字段回落到配置默认值
+func (h *ConvertHandler) parseLoudnessOptions(r *http.Request, format string) (service.LoudnessOptions, error) {
+	defaults := h.cfg.Loudness
+	mode := r.FormValue("loudness")
+	if strings.TrimSpace(mode) == "" {
+		mode = defaults.Mode
 	}
-
-	rawAudioExt, decryptErr = service.DetectAudioExt(rawPath)
-	if decryptErr != nil {
-		return "", NewAppError(ErrDecryptFailed, "无法识别解密后的音频格式", decryptErr)
+	albumGroup := strings.ToLower(strings.TrimSpace(r.FormValue("albumGroup")))
+	if albumGroup == "" {
+		albumGroup = defaults.AlbumGroup
 	}
+	opts := service.LoudnessOptions{
+		Mode:       service.NormalizeLoudnessMode(mode),
+		TargetLUFS: parseFloatOrDefault(r.FormValue("targetLufs"), defaults.TargetLUFS),
+		TruePeak:   parseFloatOrDefault(r.FormValue("truePeak"), defaults.TruePeak),
+		AlbumGroup: albumGroup,
+	}
+	if err := opts.Validate(format); err != nil {
+		return service.LoudnessOptions{}, apperr.New(apperr.ErrInvalidEncode, err.Error(), err)
+	}
+	return opts, nil
+}
 
-	baseName := strings.TrimSuffix(item.Name, filepath.Ext(item.Name))
-
-	if req.OutputFormat == "copy" {
-		outputPath, err := uniqueOutputPath(filepath.Join(req.OutputDir, baseName+rawAudioExt))
-		if err != nil {
-			return "", err
-		}
-		if progress != nil {
-			progress("transcode", 80)
-		}
-		if err := service.CopyFile(rawPath, outputPath); err != nil {
-			return "", NewAppError(ErrTranscodeFailed, "写入输出文件失败", err)
-		}
-		if progress != nil {
-			progress("transcode", 100)
+func hasKGG(items []service.BatchItem) bool {
+	for _, item := range items {
+		if strings.EqualFold(filepath.Ext(item.Name), ".kgg") {
+			return true
 		}
-		return outputPath, nil
 	}
+	return false
+}
 
-	outputPath, err := uniqueOutputPath(service.BuildOutputPath(req.OutputDir, baseName, req.OutputFormat))
+func (h *ConvertHandler) convertSingleItem(ctx context.Context, item service.BatchItem, req *convertRequest, dbKeys map[string]string, dbPath string, albumGain *service.AlbumGainTracker, progress func(string, int)) (service.ConvertResult, error) {
+	if strings.EqualFold(filepath.Ext(item.Name), ".kgg") && len(dbKeys) == 0 {
+		return service.ConvertResult{}, apperr.New(apperr.ErrDBNotFound, "KGG 转换需要 KGMusicV3.db", nil)
+	}
+
+	result, err := h.converter.ConvertItem(ctx, item, service.ConvertParams{
+		OutputDir:         req.OutputDir,
+		Transcode:         req.Transcode,
+		KeyMap:            dbKeys,
+		KeyMapSource:      "db:" + dbPath,
+		Loudness:          req.Loudness,
+		AlbumGain:         albumGain,
+		Verify:            req.Verify,
+		WriteManifest:     req.Manifest,
+		PreserveStructure: req.PreserveStructure,
+		Temp:              req.temp,
+	}, progress)
 	if err != nil {
-		return "", err
+		if ctx.Err() != nil {
+			return service.ConvertResult{}, apperr.New(apperr.ErrCancelled, "任务已取消", ctx.Err())
+		}
+		return service.ConvertResult{}, apperr.New(apperr.DetectCode(err), err.Error(), err)
 	}
+	return result, nil
+}
 
-	if progress != nil {
-		progress("transcode", 80)
-	}
+func (h *ConvertHandler) executeBatch(ctx context.Context, req *convertRequest, stopFn func() bool, onEvent func(string, any)) service.BatchSummary {
+	runCtx, cancel := h.contextWithShutdown(ctx)
+	defer cancel()
 
-	targetExt := "." + req.OutputFormat
-	if strings.EqualFold(rawAudioExt, targetExt) {
-		if err := service.CopyFile(rawPath, outputPath); err != nil {
-			return "", NewAppError(ErrTranscodeFailed, "写入输出文件失败", err)
-		}
-	} else {
-		if err := service.TranscodeToFormat(ctx, h.ffmpegPath, rawPath, outputPath, req.OutputFormat, req.MP3Quality); err != nil {
-			if ctx.Err() != nil {
-				return "", NewAppError(ErrCancelled, "任务已取消", ctx.Err())
-			}
-			return "", NewAppError(ErrTranscodeFailed, err.Error(), err)
+	var eventMu sync.Mutex
+	send := func(name string, payload any) {
+		if onEvent == nil {
+			return
 		}
+		eventMu.Lock()
+		onEvent(name, payload)
+		eventMu.Unlock()
 	}
 
-	if progress != nil {
-		progress("transcode", 100)
+	for _, warning := range req.Warnings {
+		send("warning", map[string]string{"message": warning})
 	}
-	return outputPath, nil
-}
 
-func (h *ConvertHandler) executeBatch(ctx context.Context, req *convertRequest, stopFn func() bool, onEvent func(string, any)) service.BatchSummary {
-	runCtx, cancel := h.contextWithShutdown(ctx)
-	defer cancel()
+	// 等待调度器开始运行本批次，排队期间以 queued 进度事件报告位置；取消时所有文件记为已取消
+	if req.ticket != nil {
+		err := req.ticket.Wait(runCtx, func(position int) {
+			send("progress", service.BatchProgressEvent{Phase: service.PhaseQueued, Total: len(req.Items), QueuePosition: position})
+		})
+		if err != nil {
+			return service.RunBatch(runCtx, service.BatchOptions{
+				Items:        req.Items,
+				OutputDir:    req.OutputDir,
+				OutputFormat: req.Transcode.Format,
+				MP3Quality:   req.Transcode.MP3Quality,
+			})
+		}
+	}
 
 	var dbKeys map[string]string
+	var dbPath string
 	if hasKGG(req.Items) {
-		_, _, keys, err := h.getDBForRequest(req.DBPath)
+		path, _, keys, err := h.getDBForRequest(req.DBPath)
 		if err != nil {
 			results := make([]service.BatchFileDoneEvent, 0, len(req.Items))
 			for _, item := range req.Items {
@@ -366,7 +540,7 @@ func (h *ConvertHandler) executeBatch(ctx context.Context, req *convertRequest,
 					File:    item.Name,
 					Input:   item.OriginPath,
 					Status:  "error",
-					Error:   toBatchFileError(err),
+					Error:   apperr.ToBatchFileError(err),
 					Current: item.Current,
 					Total:   len(req.Items),
 					Percent: 0,
@@ -377,23 +551,25 @@ func (h *ConvertHandler) executeBatch(ctx context.Context, req *convertRequest,
 				Failed:       len(req.Items),
 				Total:        len(req.Items),
 				OutputDir:    req.OutputDir,
-				OutputFormat: req.OutputFormat,
-				MP3Quality:   req.MP3Quality,
+				OutputFormat: req.Transcode.Format,
+				MP3Quality:   req.Transcode.MP3Quality,
 				Cancelled:    false,
 				Results:      results,
 			}
 		}
 		dbKeys = keys
+		dbPath = path
 	}
 
-	var eventMu sync.Mutex
-	send := func(name string, payload any) {
-		if onEvent == nil {
-			return
-		}
-		eventMu.Lock()
-		onEvent(name, payload)
-		eventMu.Unlock()
+	items := req.Items
+	var duplicates []service.DuplicateGroup
+	var skipped []service.BatchItem
+	if req.BestPerGroup != "" {
+		// 重复检测会解密音频 (content 模式下解密整个文件)，与转换一样占用调度器槽位；
+		// 取消时保留全部文件，由 RunBatch 记为已取消
+		_ = req.ticket.Run(runCtx, func() {
+			items, duplicates, skipped = h.selectBestPerGroup(runCtx, req, dbKeys, dbPath)
+		})
 	}
 
 	shouldStop := func() bool {
@@ -406,50 +582,105 @@ func (h *ConvertHandler) executeBatch(ctx context.Context, req *convertRequest,
 		return false
 	}
 
+	req.temp = service.TempUsage.Child()
+	var albumGain *service.AlbumGainTracker
+	if req.Loudness.Mode == service.LoudnessReplayGain {
+		albumGain = service.NewAlbumGainTracker(req.Loudness.AlbumGroup)
+	}
+
 	summary := service.RunBatch(runCtx, service.BatchOptions{
-		Items:        req.Items,
+		Items:        items,
 		Concurrency:  req.Concurrency,
 		OutputDir:    req.OutputDir,
-		OutputFormat: req.OutputFormat,
-		MP3Quality:   req.MP3Quality,
+		OutputFormat: req.Transcode.Format,
+		MP3Quality:   req.Transcode.MP3Quality,
 		ShouldStop:   shouldStop,
-		ErrorMapper:  toBatchFileError,
-		Convert: func(ctx context.Context, item service.BatchItem, progress func(phase string, filePercent int)) (string, error) {
+		ErrorMapper:  apperr.ToBatchFileError,
+		Convert: func(ctx context.Context, item service.BatchItem, progress func(phase string, filePercent int)) (service.ConvertResult, error) {
 			defer func() {
 				if item.Temporary {
 					removeQuiet(item.Path)
 				}
 			}()
-			return h.convertSingleItem(ctx, item, req, dbKeys, progress)
+			return h.convertSingleItem(ctx, item, req, dbKeys, dbPath, albumGain, progress)
 		},
 		OnProgress: func(event service.BatchProgressEvent) {
 			send("progress", event)
 		},
 		OnFileDone: func(event service.BatchFileDoneEvent) {
+			recordConversion(event, req.Transcode.Format)
 			send("file-done", event)
 		},
+		Slots: req.ticket,
 	})
 
+	// 专辑增益需要整组测量值，只能在全部文件完成后统一写入；写入标签调用 ffmpeg，同样占用槽位
+	if !summary.Cancelled && albumGain != nil {
+		_ = req.ticket.Run(runCtx, func() { albumGain.Apply(runCtx, h.ffmpegPath) })
+	}
+	summary.Dropped = req.Dropped
+	summary.Warnings = req.Warnings
+	summary.TempPeakBytes = req.temp.Peak()
+	summary.Duplicates = duplicates
+	for _, item := range skipped {
+		summary.SkippedDuplicates = append(summary.SkippedDuplicates, item.OriginPath)
+	}
 	return summary
 }
 
+// selectBestPerGroup 检测重复输入并只保留每组音质最好的文件。
+// 上传文件在分组结果中以原始文件名显示；检测失败时按原列表转换。
+func (h *ConvertHandler) selectBestPerGroup(ctx context.Context, req *convertRequest, dbKeys map[string]string, dbPath string) ([]service.BatchItem, []service.DuplicateGroup, []service.BatchItem) {
+	paths := make([]string, 0, len(req.Items))
+	origin := make(map[string]string, len(req.Items))
+	for _, item := range req.Items {
+		// 压缩包条目不参与重复检测
+		if item.Entry != "" {
+			continue
+		}
+		paths = append(paths, item.Path)
+		origin[item.Path] = item.OriginPath
+	}
+	groups, err := h.converter.FindDuplicates(ctx, paths, req.BestPerGroup, service.InspectParams{KeyMap: dbKeys, KeyMapSource: "db:" + dbPath})
+	if err != nil || len(groups) == 0 {
+		return req.Items, nil, nil
+	}
+
+	kept, skipped := service.SelectBestPerGroup(req.Items, groups)
+	for i := range kept {
+		kept[i].Current = i + 1
+	}
+	for gi := range groups {
+		groups[gi].Best = origin[groups[gi].Best]
+		for fi := range groups[gi].Files {
+			groups[gi].Files[fi].Path = origin[groups[gi].Files[fi].Path]
+		}
+	}
+	return kept, groups, skipped
+}
+
 func (h *ConvertHandler) HandleConvert(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeMethodNotAllowed(w, http.MethodPost)
 		return
 	}
-	if missing := h.runtimeMissingTools(); len(missing) > 0 {
-		writeError(w, http.StatusServiceUnavailable, NewAppError(ErrRuntimeMissing, strings.Join(missing, ","), nil))
-		return
-	}
-
 	req, err := h.parseConvertRequest(w, r)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, err)
+		writeError(w, errorStatus(err, http.StatusBadRequest), err)
 		return
 	}
 	defer req.Cleanup()
+	if !h.checkDiskSpace(w, req) || !h.admitBatch(w, req) {
+		return
+	}
 
+	job := h.startJob(req)
+	if req.OutputMode == outputModeZip {
+		h.jobs.finish(job, h.streamConvertZip(w, r, req, job))
+		return
+	}
 	summary := h.executeBatch(r.Context(), req, func() bool { return false }, nil)
+	summary.JobID = job.id
+	h.jobs.finish(job, summary)
 	writeJSON(w, http.StatusOK, summary)
 }
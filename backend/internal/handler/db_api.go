@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net/http"
 
+	"kugo-music-converter/internal/apperr"
 	"kugo-music-converter/internal/service"
 )
 
@@ -28,7 +29,12 @@ func (h *ConvertHandler) HandleValidateDBPath(w http.ResponseWriter, r *http.Req
 
 	var req validateDBRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeError(w, http.StatusBadRequest, NewAppError(ErrDBPathInvalid, "请求体格式错误", err))
+		writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrDBPathInvalid, "请求体格式错误", err))
+		return
+	}
+
+	if _, err := h.checkPath("dbPath", req.DBPath); err != nil {
+		writeError(w, errorStatus(err, http.StatusBadRequest), err)
 		return
 	}
 
@@ -74,45 +80,45 @@ func (h *ConvertHandler) HandleUploadDB(w http.ResponseWriter, r *http.Request)
 	if err := r.ParseMultipartForm(10 << 20); err != nil {
 		var maxErr *http.MaxBytesError
 		if errors.As(err, &maxErr) {
-			writeError(w, http.StatusBadRequest, NewAppError(ErrDBPathInvalid, "上传体积超限（最大 100MB）", err))
+			writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrDBPathInvalid, "上传体积超限（最大 100MB）", err))
 			return
 		}
-		writeError(w, http.StatusBadRequest, NewAppError(ErrDBPathInvalid, "上传表单解析失败", err))
+		writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrDBPathInvalid, "上传表单解析失败", err))
 		return
 	}
 
 	files := r.MultipartForm.File["db"]
 	if len(files) == 0 {
-		writeError(w, http.StatusBadRequest, NewAppError(ErrDBPathInvalid, "字段 db 缺失", nil))
+		writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrDBPathInvalid, "字段 db 缺失", nil))
 		return
 	}
 	if files[0].Size > maxUploadDBSize {
-		writeError(w, http.StatusBadRequest, NewAppError(ErrDBPathInvalid, "上传体积超限（最大 100MB）", nil))
+		writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrDBPathInvalid, "上传体积超限（最大 100MB）", nil))
 		return
 	}
 
 	f, err := files[0].Open()
 	if err != nil {
-		writeError(w, http.StatusBadRequest, NewAppError(ErrDBPathInvalid, "打开数据库文件失败", err))
+		writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrDBPathInvalid, "打开数据库文件失败", err))
 		return
 	}
 	defer f.Close()
 
 	tmp, err := createTempFile("kgg-db-", ".db")
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, NewAppError(ErrDBPathInvalid, "创建临时文件失败", err))
+		writeError(w, http.StatusInternalServerError, apperr.New(apperr.ErrDBPathInvalid, "创建临时文件失败", err))
 		return
 	}
 	defer removeQuiet(tmp)
 
 	if _, err := copyStreamToFile(f, tmp); err != nil {
-		writeError(w, http.StatusInternalServerError, NewAppError(ErrDBPathInvalid, "保存数据库文件失败", err))
+		writeError(w, http.StatusInternalServerError, apperr.New(apperr.ErrDBPathInvalid, "保存数据库文件失败", err))
 		return
 	}
 
 	keys, err := service.LoadDBKeyMap(tmp)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, NewAppError(ErrDBPathInvalid, "数据库加载失败", err))
+		writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrDBPathInvalid, "数据库加载失败", err))
 		return
 	}
 
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"kugo-music-converter/internal/apperr"
+	"kugo-music-converter/internal/logger"
+	"kugo-music-converter/internal/service"
+)
+
+// ffmpegReprobeInterval 为 ffmpeg 不可用时自动重新探测的最短间隔；
+// 安装 ffmpeg 后也可通过 POST /api/probe-ffmpeg 立即重新探测
+const ffmpegReprobeInterval = time.Minute
+
+// probeFFmpeg 重新探测 ffmpeg 并缓存结果
+func (h *ConvertHandler) probeFFmpeg() service.FFmpegCapabilities {
+	h.ffmpegMu.Lock()
+	h.ffmpegProbedAt = time.Now()
+	h.ffmpegMu.Unlock()
+
+	caps := service.ProbeFFmpeg(context.Background(), h.ffmpegPath)
+	h.ffmpegMu.Lock()
+	h.ffmpegCaps = caps
+	h.ffmpegMu.Unlock()
+	h.converter.SetFFmpegCapabilities(caps)
+
+	if caps.Available {
+		logger.Infof("FFmpeg 版本: %s，可用输出格式: %s", caps.Version, strings.Join(caps.SupportedOutputs, ","))
+	} else {
+		logger.Warnf("FFmpeg 不可用，进入降级模式 (仅 copy、同格式直出与 FLAC/WAV 互转): %s (%s)", h.ffmpegPath, caps.Error)
+	}
+	return caps
+}
+
+// ffmpegCapabilities 返回缓存的探测结果，不可用的结果同样缓存；
+// 距上次探测超过 ffmpegReprobeInterval 时才重新探测，便于安装 ffmpeg 后无需重启
+func (h *ConvertHandler) ffmpegCapabilities() service.FFmpegCapabilities {
+	h.ffmpegMu.Lock()
+	caps := h.ffmpegCaps
+	stale := !caps.Available && time.Since(h.ffmpegProbedAt) >= ffmpegReprobeInterval
+	if stale {
+		// 先占用本次探测，并发请求在探测期间继续使用缓存结果
+		h.ffmpegProbedAt = time.Now()
+	}
+	h.ffmpegMu.Unlock()
+	if !stale {
+		return caps
+	}
+	return h.probeFFmpeg()
+}
+
+// checkOutputEncoder 确认本机 ffmpeg 具备输出格式所需的编码器与封装器。
+// 完全没有 ffmpeg 时不在此拒绝，由转换流水线按文件走直通或纯 Go 路径，无法处理的文件单独报错。
+func (h *ConvertHandler) checkOutputEncoder(format string, loudness service.LoudnessOptions) error {
+	caps := h.ffmpegCapabilities()
+	if !caps.Available {
+		if loudness.Enabled() {
+			return apperr.New(apperr.ErrRuntimeMissing, "响度处理需要 ffmpeg: "+h.ffmpegPath, nil)
+		}
+		return nil
+	}
+	missing := caps.MissingFor(format)
+	if len(missing) == 0 {
+		return nil
+	}
+	return apperr.New(apperr.ErrEncoderMissing, fmt.Sprintf("输出格式 %s 需要 ffmpeg 支持: %s", format, strings.Join(missing, ",")), nil)
+}
+
+func (h *ConvertHandler) HandleProbeFFmpeg(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ffmpeg": h.probeFFmpeg()})
+}
@@ -4,15 +4,30 @@ import (
 	"net/http"
 	"runtime"
 	"time"
+
+	"kugo-music-converter/internal/service"
 )
 
 const serverVersion = "v0.2.3"
 
 type healthResponse struct {
-	Status    string `json:"status"`
-	Version   string `json:"version"`
-	Uptime    string `json:"uptime"`
-	GoVersion string `json:"goVersion"`
+	Status    string       `json:"status"`
+	Version   string       `json:"version"`
+	Uptime    string       `json:"uptime"`
+	GoVersion string       `json:"goVersion"`
+	FFmpeg    healthFFmpeg `json:"ffmpeg"`
+	// Scheduler 为全局转换调度器的槽位占用与排队情况
+	Scheduler service.SchedulerStats `json:"scheduler"`
+	// Temp 为本进程临时目录的占用情况
+	Temp service.TempDirStats `json:"temp"`
+}
+
+type healthFFmpeg struct {
+	Available        bool     `json:"available"`
+	Path             string   `json:"path"`
+	Version          string   `json:"version,omitempty"`
+	SupportedOutputs []string `json:"supportedOutputs"`
+	Error            string   `json:"error,omitempty"`
 }
 
 func (h *ConvertHandler) HandleHealth(w http.ResponseWriter, r *http.Request) {
@@ -26,10 +41,20 @@ func (h *ConvertHandler) HandleHealth(w http.ResponseWriter, r *http.Request) {
 		uptime = time.Since(h.startedAt).Truncate(time.Second).String()
 	}
 
+	caps := h.ffmpegCapabilities()
 	writeJSON(w, http.StatusOK, healthResponse{
 		Status:    "ok",
 		Version:   serverVersion,
 		Uptime:    uptime,
 		GoVersion: runtime.Version(),
+		FFmpeg: healthFFmpeg{
+			Available:        caps.Available,
+			Path:             caps.Path,
+			Version:          caps.Version,
+			SupportedOutputs: caps.SupportedOutputs,
+			Error:            caps.Error,
+		},
+		Scheduler: h.sched.Stats(),
+		Temp:      service.CurrentTempStats(),
 	})
 }
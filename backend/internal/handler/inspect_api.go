@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"kugo-music-converter/internal/apperr"
+	"kugo-music-converter/internal/service"
+)
+
+type inspectRequest struct {
+	Paths  []string `json:"paths"`
+	DBPath string   `json:"dbPath"`
+	// Full 为 true 时完整解密每个文件，以便用 ffmpeg 读取 MP3/M4A 等格式的时长
+	Full bool `json:"full"`
+}
+
+type inspectResponse struct {
+	Results []service.InspectResult `json:"results"`
+}
+
+// HandleInspect 返回每个文件的格式、KGG 密钥可用性、NCM 元数据与解密后容器信息，不做转换
+func (h *ConvertHandler) HandleInspect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req inspectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrScanInvalidPath, "请求体格式错误", err))
+		return
+	}
+
+	paths := make([]string, 0, len(req.Paths))
+	for _, raw := range req.Paths {
+		if p := strings.TrimSpace(raw); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrNoFiles, "未提供要检查的文件路径", nil))
+		return
+	}
+	if len(paths) > h.cfg.MaxFiles {
+		writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrTooManyFiles, fmt.Sprintf("文件数量超过限制（最多 %d）", h.cfg.MaxFiles), nil))
+		return
+	}
+
+	if db := strings.TrimSpace(req.DBPath); db != "" {
+		if _, err := h.checkPath("dbPath", db); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+	}
+
+	params := service.InspectParams{FullDecrypt: req.Full}
+	for _, p := range paths {
+		if strings.EqualFold(filepath.Ext(p), ".kgg") {
+			// 数据库不可用时仍继续检查，由各文件的 keys 字段体现密钥缺失
+			if dbPath, _, keys, err := h.getDBForRequest(req.DBPath); err == nil {
+				params.KeyMap, params.KeyMapSource = keys, "db:"+dbPath
+			}
+			break
+		}
+	}
+
+	results := make([]service.InspectResult, 0, len(paths))
+	for _, p := range paths {
+		if r.Context().Err() != nil {
+			return
+		}
+		abs, err := h.checkPath("paths", p)
+		if err != nil {
+			results = append(results, service.InspectResult{Path: p, Error: apperr.ToBatchFileError(err)})
+			continue
+		}
+		result, err := h.converter.Inspect(r.Context(), abs, params)
+		if err != nil {
+			result.Error = apperr.ToBatchFileError(err)
+		}
+		results = append(results, result)
+	}
+
+	writeJSON(w, http.StatusOK, inspectResponse{Results: results})
+}
@@ -0,0 +1,296 @@
+package handler
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kugo-music-converter/internal/apperr"
+	"kugo-music-converter/internal/logger"
+	"kugo-music-converter/internal/service"
+)
+
+// 输出方式：dir 写入服务器上的输出目录，zip 写入临时目录并以 ZIP 返回给客户端
+const (
+	outputModeDir = "dir"
+	outputModeZip = "zip"
+)
+
+const (
+	// jobRetention 为任务结束后仍可下载的时长，maxJobs 为保留的任务数上限
+	jobRetention = time.Hour
+	maxJobs      = 50
+	// jobSummaryName 是 ZIP 中记录转换汇总的文件名
+	jobSummaryName = "kugo-summary.json"
+)
+
+// convertJob 是一次转换请求的记录。staged 为 true 时 outputDir 是任务专属的临时目录，任务过期时删除。
+// readers 为正在下载该任务的请求数，由 jobStore.mu 保护
+type convertJob struct {
+	id        string
+	outputDir string
+	staged    bool
+	finished  time.Time
+	summary   *service.BatchSummary
+	readers   int
+}
+
+type jobStore struct {
+	mu    sync.Mutex
+	jobs  map[string]*convertJob
+	order []string
+}
+
+func newJobStore() *jobStore {
+	return &jobStore{jobs: map[string]*convertJob{}}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// start 登记一个正在运行的任务，并清理过期任务
+func (s *jobStore) start(outputDir string, staged bool) *convertJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(time.Now())
+	job := &convertJob{id: newJobID(), outputDir: outputDir, staged: staged}
+	s.jobs[job.id] = job
+	s.order = append(s.order, job.id)
+	return job
+}
+
+func (s *jobStore) finish(job *convertJob, summary service.BatchSummary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.summary = &summary
+	job.finished = time.Now()
+}
+
+// acquire 返回任务及其是否已结束；已结束的任务在 release 之前不会被清理，
+// 下载过程中输出目录不会被删除
+func (s *jobStore) acquire(id string) (*convertJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := s.jobs[id]
+	if job == nil {
+		return nil, false
+	}
+	if job.summary == nil {
+		return job, false
+	}
+	job.readers++
+	return job, true
+}
+
+// release 结束一次下载，并清理下载期间到期的任务
+func (s *jobStore) release(job *convertJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.readers--
+	s.pruneLocked(time.Now())
+}
+
+// pruneLocked 删除超过保留时长的任务；任务数超过上限时从最早结束的开始删除，运行中与下载中的任务不删除
+func (s *jobStore) pruneLocked(now time.Time) {
+	excess := len(s.order) - maxJobs + 1
+	kept := s.order[:0]
+	for _, id := range s.order {
+		job := s.jobs[id]
+		if job.summary != nil && job.readers == 0 && (now.Sub(job.finished) > jobRetention || excess > 0) {
+			excess--
+			delete(s.jobs, id)
+			if job.staged {
+				if err := os.RemoveAll(job.outputDir); err != nil {
+					logger.Warnf("删除任务临时目录失败: %v", err)
+				}
+			}
+			continue
+		}
+		kept = append(kept, id)
+	}
+	s.order = kept
+}
+
+func jobDownloadURL(id string) string {
+	return "/api/jobs/" + id + "/download"
+}
+
+// zipStream 把输出文件逐个写入 ZIP 响应，不在磁盘上暂存整个压缩包。
+// 文件在 ZIP 中的路径相对于输出目录，音频已经压缩，使用 Store 方式写入。
+type zipStream struct {
+	w     io.Writer
+	zw    *zip.Writer
+	root  string
+	added map[string]struct{}
+}
+
+func newZipStream(w io.Writer, root string) *zipStream {
+	return &zipStream{w: w, zw: zip.NewWriter(w), root: root, added: map[string]struct{}{}}
+}
+
+func (z *zipStream) entryName(path string) string {
+	rel, err := filepath.Rel(z.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		rel = filepath.Base(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// addFile 写入一个输出文件；同一文件只写入一次
+func (z *zipStream) addFile(path string) error {
+	if _, ok := z.added[path]; ok {
+		return nil
+	}
+	z.added[path] = struct{}{}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &zip.FileHeader{Name: z.entryName(path), Method: zip.Store, Modified: st.ModTime()}
+	dst, err := z.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, f); err != nil {
+		return err
+	}
+	return z.flush()
+}
+
+func (z *zipStream) addJSON(name string, v any) error {
+	dst, err := z.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(dst)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (z *zipStream) flush() error {
+	if err := z.zw.Flush(); err != nil {
+		return err
+	}
+	if f, ok := z.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (z *zipStream) Close() error {
+	return z.zw.Close()
+}
+
+// addResults 写入汇总中所有成功的输出文件以及汇总本身；文件已被删除时跳过
+func (z *zipStream) addResults(summary service.BatchSummary) error {
+	for _, result := range summary.Results {
+		if result.Status != "ok" || result.Output == "" {
+			continue
+		}
+		if err := z.addFile(result.Output); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+	}
+	return z.addJSON(jobSummaryName, summary)
+}
+
+func writeZipHeaders(w http.ResponseWriter, jobID string) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="kugo-%s.zip"`, jobID))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set("X-Job-Id", jobID)
+}
+
+// HandleJobDownload 以 ZIP 返回已结束任务的全部输出文件，GET /api/jobs/{id}/download
+func (h *ConvertHandler) HandleJobDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	job, done := h.jobs.acquire(r.PathValue("id"))
+	if job == nil {
+		writeError(w, http.StatusNotFound, apperr.New(apperr.ErrJobNotFound, "", nil))
+		return
+	}
+	if !done {
+		writeError(w, http.StatusConflict, apperr.New(apperr.ErrJobRunning, "", nil))
+		return
+	}
+	defer h.jobs.release(job)
+
+	writeZipHeaders(w, job.id)
+	w.WriteHeader(http.StatusOK)
+	zs := newZipStream(w, job.outputDir)
+	if err := zs.addResults(*job.summary); err != nil {
+		logger.Warnf("下载任务 %s 中断: %v", job.id, err)
+		return
+	}
+	_ = zs.Close()
+}
+
+// streamConvertZip 执行转换并把完成的文件逐个写入 ZIP 响应。ReplayGain 需要在全部文件完成后
+// 写入专辑增益，此时所有文件在批次结束后统一写入。客户端断开即取消剩余转换。
+func (h *ConvertHandler) streamConvertZip(w http.ResponseWriter, r *http.Request, req *convertRequest, job *convertJob) service.BatchSummary {
+	writeZipHeaders(w, job.id)
+	w.WriteHeader(http.StatusOK)
+
+	zs := newZipStream(w, req.OutputDir)
+	deferWrites := req.Loudness.Mode == service.LoudnessReplayGain
+	// failed 在 onEvent 中写入，由转换 worker 通过 stopFn 并发读取
+	var failed atomic.Bool
+	done := r.Context().Done()
+	stopFn := func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+			return failed.Load()
+		}
+	}
+	onEvent := func(name string, payload any) {
+		evt, ok := payload.(service.BatchFileDoneEvent)
+		if !ok || name != "file-done" || deferWrites || failed.Load() || evt.Status != "ok" {
+			return
+		}
+		if err := zs.addFile(evt.Output); err != nil {
+			logger.Warnf("写入 ZIP 响应失败: %v", err)
+			failed.Store(true)
+		}
+	}
+
+	summary := h.executeBatch(r.Context(), req, stopFn, onEvent)
+	summary.JobID = job.id
+	if !failed.Load() {
+		if err := zs.addResults(summary); err != nil {
+			logger.Warnf("写入 ZIP 响应失败: %v", err)
+		} else {
+			_ = zs.Close()
+		}
+	}
+	return summary
+}
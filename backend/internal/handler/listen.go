@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kugo-music-converter/internal/config"
+	"kugo-music-converter/internal/logger"
+)
+
+// 自签名证书在数据目录中的文件名与有效期；剩余有效期不足 renew 时重新生成
+const (
+	selfSignedCertFile  = "tls-cert.pem"
+	selfSignedKeyFile   = "tls-key.pem"
+	selfSignedValidity  = 825 * 24 * time.Hour
+	selfSignedRenewLead = 30 * 24 * time.Hour
+)
+
+// openListener 按配置监听 Unix 域套接字或 TCP 地址；配置了 unix_socket 时不再监听 TCP
+func openListener(cfg *config.Config) (net.Listener, error) {
+	socket := strings.TrimSpace(cfg.UnixSocket)
+	if socket == "" {
+		return net.Listen("tcp", cfg.Addr)
+	}
+
+	// 上次异常退出可能留下套接字文件；只删除套接字，避免误删同名普通文件
+	if st, err := os.Lstat(socket); err == nil {
+		if st.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s 已存在且不是套接字文件", socket)
+		}
+		if err := os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(socket), 0o755); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	// 只允许属主与同组用户 (如反向代理所在组) 连接
+	if err := os.Chmod(socket, 0o660); err != nil {
+		logger.Warnf("设置套接字权限失败: %v", err)
+	}
+	return ln, nil
+}
+
+// resolveTLSFiles 返回证书与私钥路径；启用 TLS 但未配置证书时使用数据目录中的自签名证书
+func resolveTLSFiles(cfg *config.Config, dataDir string) (certFile, keyFile string, err error) {
+	certFile = strings.TrimSpace(cfg.TLS.CertFile)
+	keyFile = strings.TrimSpace(cfg.TLS.KeyFile)
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return "", "", errors.New("tls.cert_file 与 tls.key_file 需要同时配置")
+		}
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return "", "", fmt.Errorf("加载 TLS 证书失败: %w", err)
+		}
+		return certFile, keyFile, nil
+	}
+
+	certFile = filepath.Join(dataDir, selfSignedCertFile)
+	keyFile = filepath.Join(dataDir, selfSignedKeyFile)
+	if selfSignedCertValid(certFile, keyFile) {
+		return certFile, keyFile, nil
+	}
+	if err := writeSelfSignedCert(certFile, keyFile); err != nil {
+		return "", "", fmt.Errorf("生成自签名证书失败: %w", err)
+	}
+	logger.Infof("已生成自签名证书: %s", certFile)
+	return certFile, keyFile, nil
+}
+
+func selfSignedCertValid(certFile, keyFile string) bool {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return false
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return false
+	}
+	return time.Until(leaf.NotAfter) > selfSignedRenewLead
+}
+
+// writeSelfSignedCert 生成 ECDSA P-256 自签名证书，包含 localhost、主机名与本机各网卡地址
+func writeSelfSignedCert(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Kugo Music Converter", Organization: []string{"Kugo Music Converter"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, err := os.Hostname(); err == nil && host != "" && !strings.EqualFold(host, "localhost") {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+// certFingerprint 返回证书的 SHA-256 指纹，供用户在浏览器中核对自签名证书
+func certFingerprint(certFile, keyFile string) string {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(pair.Certificate[0])
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"kugo-music-converter/internal/service"
+)
+
+// HandleMetrics 以 Prometheus 文本格式输出运行指标。
+// 计数器与直方图在转换和请求过程中累计，调度器、ffmpeg 进程与密钥表等瞬时值在采集时读取。
+func (h *ConvertHandler) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	stats := h.sched.Stats()
+	h.dbMu.RLock()
+	keyMapSize := len(h.dbKeyMap)
+	h.dbMu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	service.WriteGauge(w, "kugo_active_batches", "正在转换的批次数", float64(stats.ActiveBatches))
+	service.WriteGauge(w, "kugo_queued_batches", "等待调度的批次数", float64(stats.QueuedBatches))
+	service.WriteGauge(w, "kugo_workers", "全局转换槽位数", float64(stats.Workers))
+	service.WriteGauge(w, "kugo_workers_busy", "正在使用的转换槽位数", float64(stats.Busy))
+	service.WriteGauge(w, "kugo_ffmpeg_processes", "运行中的 ffmpeg 进程数", float64(service.FFmpegProcesses()))
+	service.WriteGauge(w, "kugo_key_map_size", "已加载的 KGMusicV3.db 密钥条目数", float64(keyMapSize))
+	service.WriteGauge(w, "kugo_temp_active_bytes", "解密中间文件与解压条目当前占用的临时空间", float64(service.TempUsage.InUse()))
+	service.WriteGauge(w, "kugo_uptime_seconds", "服务运行时长", time.Since(h.startedAt).Seconds())
+	service.WriteMetrics(w)
+}
+
+// recordConversion 按输入扩展名、输出格式与结果代码累计单个文件的转换结果
+func recordConversion(event service.BatchFileDoneEvent, outputFormat string) {
+	input := strings.TrimPrefix(strings.ToLower(filepath.Ext(event.File)), ".")
+	if input == "" {
+		input = "unknown"
+	}
+	code := "ok"
+	if event.Status != "ok" {
+		code = "ERR_UNKNOWN"
+		if event.Error != nil && event.Error.Code != "" {
+			code = event.Error.Code
+		}
+	}
+	service.ConversionsTotal.Inc(input, outputFormat, code)
+}
+
+// recordHTTPRequest 以路由模式而非实际路径作为标签，避免下载链接中的任务 ID 等产生大量序列
+func recordHTTPRequest(r *http.Request, status int, took time.Duration) {
+	route := r.Pattern
+	if route == "" {
+		route = "none"
+	}
+	service.HTTPRequests.Inc(route, strconv.Itoa(status))
+	service.HTTPDuration.Observe(took.Seconds(), route)
+}
@@ -47,6 +47,7 @@ func logRequest(next http.Handler) http.Handler {
 		if rw.status == 0 {
 			rw.status = http.StatusOK
 		}
+		recordHTTPRequest(r, rw.status, time.Since(start))
 
 		clientIP := getClientIP(r)
 		logger.Debugf(
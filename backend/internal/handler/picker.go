@@ -11,6 +11,7 @@ import (
 	"runtime"
 	"strings"
 
+	"kugo-music-converter/internal/apperr"
 	"kugo-music-converter/internal/service"
 )
 
@@ -57,7 +58,7 @@ func runPowershell(command string) (string, error) {
 		if msg == "" {
 			msg = err.Error()
 		}
-		return "", NewAppError(ErrFolderPicker, msg, err)
+		return "", apperr.New(apperr.ErrFolderPicker, msg, err)
 	}
 	return strings.TrimSpace(stdout.String()), nil
 }
@@ -68,7 +69,7 @@ func (h *ConvertHandler) HandlePickDirectory(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	if runtime.GOOS != "windows" {
-		writeError(w, http.StatusBadRequest, NewAppError(ErrFolderPicker, "仅支持 Windows 目录选择器", nil))
+		writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrFolderPicker, "仅支持 Windows 目录选择器", nil))
 		return
 	}
 
@@ -92,7 +93,7 @@ func (h *ConvertHandler) HandlePickDBFile(w http.ResponseWriter, r *http.Request
 		return
 	}
 	if runtime.GOOS != "windows" {
-		writeError(w, http.StatusBadRequest, NewAppError(ErrDBPicker, "仅支持 Windows 文件选择器", nil))
+		writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrDBPicker, "仅支持 Windows 文件选择器", nil))
 		return
 	}
 
@@ -106,7 +107,7 @@ func (h *ConvertHandler) HandlePickDBFile(w http.ResponseWriter, r *http.Request
 			`if ($d.ShowDialog() -eq [System.Windows.Forms.DialogResult]::OK) { Write-Output $d.FileName }`,
 	)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, NewAppError(ErrDBPicker, err.Error(), err))
+		writeError(w, http.StatusInternalServerError, apperr.New(apperr.ErrDBPicker, err.Error(), err))
 		return
 	}
 
@@ -115,14 +116,19 @@ func (h *ConvertHandler) HandlePickDBFile(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if _, err := h.checkPath("dbPath", path); err != nil {
+		writeError(w, errorStatus(err, http.StatusBadRequest), err)
+		return
+	}
+
 	validation := service.ValidateDBPath(path)
 	if !validation.Valid {
-		writeError(w, http.StatusBadRequest, NewAppError(ErrDBPathInvalid, validation.Reason, nil))
+		writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrDBPathInvalid, validation.Reason, nil))
 		return
 	}
 
 	if err := h.loadDBByPath(validation.Path, "manual"); err != nil {
-		writeError(w, http.StatusBadRequest, NewAppError(ErrDBPathInvalid, err.Error(), err))
+		writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrDBPathInvalid, err.Error(), err))
 		return
 	}
 
@@ -140,7 +146,7 @@ func (h *ConvertHandler) HandleOpenFolder(w http.ResponseWriter, r *http.Request
 		return
 	}
 	if runtime.GOOS != "windows" {
-		writeError(w, http.StatusBadRequest, NewAppError(ErrFolderPicker, "仅支持 Windows", nil))
+		writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrFolderPicker, "仅支持 Windows", nil))
 		return
 	}
 
@@ -148,7 +154,7 @@ func (h *ConvertHandler) HandleOpenFolder(w http.ResponseWriter, r *http.Request
 		Path string `json:"path"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		writeError(w, http.StatusBadRequest, NewAppError("ERR_UNKNOWN", "请求格式错误", err))
+		writeError(w, http.StatusBadRequest, apperr.New("ERR_UNKNOWN", "请求格式错误", err))
 		return
 	}
 
@@ -159,12 +165,16 @@ func (h *ConvertHandler) HandleOpenFolder(w http.ResponseWriter, r *http.Request
 
 	absPath, err := validateLocalFolderPath(dirPath)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, NewAppError(ErrFolderPicker, "路径无效", err))
+		writeError(w, http.StatusBadRequest, apperr.New(apperr.ErrFolderPicker, "路径无效", err))
+		return
+	}
+	if _, err := h.checkPath("path", absPath); err != nil {
+		writeError(w, errorStatus(err, http.StatusBadRequest), err)
 		return
 	}
 
 	if err := os.MkdirAll(absPath, 0o755); err != nil {
-		writeError(w, http.StatusInternalServerError, NewAppError(ErrFolderPicker, "无法创建目录", err))
+		writeError(w, http.StatusInternalServerError, apperr.New(apperr.ErrFolderPicker, "无法创建目录", err))
 		return
 	}
 
@@ -1,65 +1,317 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
+	"time"
 
+	"kugo-music-converter/internal/apperr"
+	"kugo-music-converter/internal/logger"
 	"kugo-music-converter/internal/service"
 )
 
+// scanProgressInterval 限制流式扫描 progress 事件的发送频率
+const scanProgressInterval = 500 * time.Millisecond
+
 type scanRequest struct {
 	Paths     []string `json:"paths"`
 	Recursive bool     `json:"recursive"`
 	Filter    string   `json:"filter"`
+	// Details 为每个文件附加格式校验、KGG 密钥可用性与 NCM 标题歌手
+	Details bool `json:"details"`
+	// ConvertibleOnly 只返回可直接转换的文件，隐含 Details
+	ConvertibleOnly bool   `json:"convertibleOnly"`
+	DBPath          string `json:"dbPath"`
+	// MaxDepth/MaxFiles/TimeoutSec 为 0 时不限制；Exclude 为 glob 列表
+	MaxDepth   int      `json:"maxDepth"`
+	MaxFiles   int      `json:"maxFiles"`
+	TimeoutSec int      `json:"timeoutSec"`
+	Exclude    []string `json:"exclude"`
+	Include    []string `json:"include"`
+	// MinSize/MaxSize 为字节数；ModifiedAfter/ModifiedBefore 支持 RFC3339、2006-01-02 或 7d/36h
+	MinSize        int64  `json:"minSize"`
+	MaxSize        int64  `json:"maxSize"`
+	ModifiedAfter  string `json:"modifiedAfter"`
+	ModifiedBefore string `json:"modifiedBefore"`
+	// SkipExistingIn 为输出目录，SkipExistingBy 为 basename (默认) 或 manifest
+	SkipExistingIn string `json:"skipExistingIn"`
+	SkipExistingBy string `json:"skipExistingBy"`
+	// Duplicates 为 header 或 content 时在结果中报告重复文件分组
+	Duplicates string `json:"duplicates"`
+
+	modifiedAfter  time.Time
+	modifiedBefore time.Time
+	existing       *service.OutputIndex
 }
 
-func (h *ConvertHandler) HandleScanFolders(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		writeMethodNotAllowed(w, http.MethodPost)
-		return
-	}
+// scanStreamComplete 是流式扫描结束时的 complete 事件
+type scanStreamComplete struct {
+	service.ScanStats
+	FilteredOut int                      `json:"filteredOut"`
+	Duplicates  []service.DuplicateGroup `json:"duplicates,omitempty"`
+}
 
+func (h *ConvertHandler) decodeScanRequest(r *http.Request) (*scanRequest, error) {
 	var req scanRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeError(w, http.StatusBadRequest, NewAppError(ErrScanInvalidPath, "请求体格式错误", err))
-		return
+		return nil, apperr.New(apperr.ErrScanInvalidPath, "请求体格式错误", err)
 	}
-
 	if req.Paths == nil {
 		req.Paths = []string{}
 	}
+	if req.MaxDepth < 0 || req.MaxFiles < 0 || req.TimeoutSec < 0 || req.MinSize < 0 || req.MaxSize < 0 {
+		return nil, apperr.New(apperr.ErrScanInvalidPath, "maxDepth、maxFiles、timeoutSec、minSize、maxSize 不能为负数", nil)
+	}
+	if req.MaxSize > 0 && req.MinSize > req.MaxSize {
+		return nil, apperr.New(apperr.ErrScanInvalidPath, "minSize 不能大于 maxSize", nil)
+	}
+	if err := service.ValidateScanGlobs("exclude", req.Exclude); err != nil {
+		return nil, apperr.New(apperr.ErrScanInvalidPath, err.Error(), err)
+	}
+	if err := service.ValidateScanGlobs("include", req.Include); err != nil {
+		return nil, apperr.New(apperr.ErrScanInvalidPath, err.Error(), err)
+	}
 
-	filter := service.ParseExtFilter(req.Filter)
-	folders := make([]service.ScanFolderInfo, 0, len(req.Paths))
-	totalFiles := 0
-	var totalSize int64
+	now := time.Now()
+	var err error
+	if req.modifiedAfter, err = service.ParseScanTime(req.ModifiedAfter, now); err != nil {
+		return nil, apperr.New(apperr.ErrScanInvalidPath, "modifiedAfter: "+err.Error(), err)
+	}
+	if req.modifiedBefore, err = service.ParseScanTime(req.ModifiedBefore, now); err != nil {
+		return nil, apperr.New(apperr.ErrScanInvalidPath, "modifiedBefore: "+err.Error(), err)
+	}
+	if req.Duplicates, err = service.NormalizeDuplicateMode(req.Duplicates); err != nil {
+		return nil, apperr.New(apperr.ErrScanInvalidPath, err.Error(), err)
+	}
+	// 读取 skipExistingIn 之前先校验全部路径
+	if err := h.checkScanPaths(&req); err != nil {
+		return nil, err
+	}
+	if dir := strings.TrimSpace(req.SkipExistingIn); dir != "" {
+		if req.existing, err = service.LoadOutputIndex(dir, strings.ToLower(strings.TrimSpace(req.SkipExistingBy))); err != nil {
+			return nil, apperr.New(apperr.ErrScanInvalidPath, "skipExistingIn: "+err.Error(), err)
+		}
+	}
+	return &req, nil
+}
 
-	for _, rawPath := range req.Paths {
-		path := strings.TrimSpace(rawPath)
-		if path == "" {
+// checkScanPaths 拒绝允许目录之外的扫描根目录、skipExistingIn 与 dbPath
+func (h *ConvertHandler) checkScanPaths(req *scanRequest) error {
+	for _, p := range req.Paths {
+		if strings.TrimSpace(p) == "" {
 			continue
 		}
-		abs, err := filepath.Abs(path)
-		if err != nil {
-			continue
+		if _, err := h.checkPath("paths", p); err != nil {
+			return err
 		}
-		st, err := os.Stat(abs)
-		if err != nil || !st.IsDir() {
-			continue
+	}
+	if dir := strings.TrimSpace(req.SkipExistingIn); dir != "" {
+		if _, err := h.checkPath("skipExistingIn", dir); err != nil {
+			return err
+		}
+	}
+	if db := strings.TrimSpace(req.DBPath); db != "" {
+		if _, err := h.checkPath("dbPath", db); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		files, size, err := service.ScanSingleFolder(abs, req.Recursive, filter)
-		if err != nil {
-			continue
+// scanOptions 把请求转换为遍历参数；filteredOut 统计被 convertibleOnly 过滤的文件
+func (h *ConvertHandler) scanOptions(req *scanRequest, filteredOut *int) service.ScanOptions {
+	opts := service.ScanOptions{
+		Recursive:      req.Recursive,
+		MaxDepth:       req.MaxDepth,
+		MaxFiles:       req.MaxFiles,
+		Exclude:        req.Exclude,
+		ExtFilter:      service.ParseExtFilter(req.Filter),
+		Include:        req.Include,
+		MinSize:        req.MinSize,
+		MaxSize:        req.MaxSize,
+		ModifiedAfter:  req.modifiedAfter,
+		ModifiedBefore: req.modifiedBefore,
+		Existing:       req.existing,
+		Allow:          h.allow,
+	}
+	if !req.Details && !req.ConvertibleOnly {
+		return opts
+	}
+
+	var keyParams service.InspectParams
+	keysLoaded := false
+	opts.Accept = func(f *service.ScanFileInfo) bool {
+		if !keysLoaded && strings.EqualFold(f.Ext, ".kgg") {
+			keysLoaded = true
+			keyParams = h.scanKeyParams(req)
+		}
+		f.Details = service.DescribeScanFile(f.FullPath, keyParams)
+		if req.ConvertibleOnly && !f.Details.Convertible {
+			*filteredOut++
+			return false
+		}
+		return true
+	}
+	return opts
+}
+
+// scanKeyParams 读取 KGG 密钥；数据库不可用时仍继续扫描，KGG 文件标记为缺少密钥
+func (h *ConvertHandler) scanKeyParams(req *scanRequest) service.InspectParams {
+	dbPath, _, keys, err := h.getDBForRequest(req.DBPath)
+	if err != nil {
+		return service.InspectParams{}
+	}
+	return service.InspectParams{KeyMap: keys, KeyMapSource: "db:" + dbPath}
+}
+
+// scanDuplicates 在扫描结束后对全部文件做重复检测，取消、超时或转换队列已满时返回 nil。
+// 检测会解密音频，与转换批次一样经调度器排队并占用一个槽位
+func (h *ConvertHandler) scanDuplicates(ctx context.Context, req *scanRequest, paths []string) []service.DuplicateGroup {
+	if req.Duplicates == "" || len(paths) < 2 {
+		return nil
+	}
+	ticket, err := h.sched.Admit(1)
+	if err != nil {
+		logger.Warnf("转换队列已满，跳过重复检测")
+		return nil
+	}
+	defer ticket.Done()
+	if err := ticket.Wait(ctx, nil); err != nil {
+		return nil
+	}
+
+	var groups []service.DuplicateGroup
+	_ = ticket.Run(ctx, func() {
+		groups, err = h.converter.FindDuplicates(ctx, paths, req.Duplicates, h.scanKeyParams(req))
+	})
+	if err != nil {
+		return nil
+	}
+	return groups
+}
+
+func scanContext(ctx context.Context, req *scanRequest) (context.Context, context.CancelFunc) {
+	if req.TimeoutSec > 0 {
+		return context.WithTimeout(ctx, time.Duration(req.TimeoutSec)*time.Second)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (h *ConvertHandler) HandleScanFolders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	req, err := h.decodeScanRequest(r)
+	if err != nil {
+		writeError(w, errorStatus(err, http.StatusBadRequest), err)
+		return
+	}
+
+	ctx, cancel := scanContext(r.Context(), req)
+	defer cancel()
+
+	filteredOut := 0
+	byRoot := make(map[string][]service.ScanFileInfo)
+	pathErrors := make([]service.ScanPathError, 0)
+	var allPaths []string
+	stats := service.WalkScanRoots(ctx, req.Paths, h.scanOptions(req, &filteredOut), service.ScanHooks{
+		OnFolder: func(folder service.ScanFolderInfo) {
+			byRoot[folder.Root] = append(byRoot[folder.Root], folder.Files...)
+			for _, f := range folder.Files {
+				allPaths = append(allPaths, f.FullPath)
+			}
+		},
+		OnError: func(e service.ScanPathError) {
+			pathErrors = append(pathErrors, e)
+		},
+	})
+
+	folders := make([]service.ScanFolderInfo, 0, len(stats.Roots))
+	for _, root := range stats.Roots {
+		files := byRoot[root]
+		if files == nil {
+			files = []service.ScanFileInfo{}
 		}
+		service.SortScanFiles(files)
+		folders = append(folders, service.ScanFolderInfo{Path: root, Files: files})
+	}
+
+	writeJSON(w, http.StatusOK, service.ScanResult{
+		TotalFiles:      stats.TotalFiles,
+		TotalSize:       stats.TotalSize,
+		Folders:         folders,
+		FilteredOut:     filteredOut,
+		Errors:          pathErrors,
+		Truncated:       stats.Truncated,
+		SkippedExisting: stats.SkippedExisting,
+		Duplicates:      h.scanDuplicates(ctx, req, allPaths),
+	})
+}
 
-		folders = append(folders, service.ScanFolderInfo{Path: abs, Files: files})
-		totalFiles += len(files)
-		totalSize += size
+// HandleScanFoldersStream 以 SSE 逐目录推送扫描结果：folder / error / progress / complete，
+// 客户端断开连接即取消扫描
+func (h *ConvertHandler) HandleScanFoldersStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
 	}
 
-	writeJSON(w, http.StatusOK, service.ScanResult{TotalFiles: totalFiles, TotalSize: totalSize, Folders: folders})
+	req, err := h.decodeScanRequest(r)
+	if err != nil {
+		writeError(w, errorStatus(err, http.StatusBadRequest), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-transform")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	ctx, cancel := scanContext(r.Context(), req)
+	defer cancel()
+
+	onEvent := func(name string, payload any) {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := writeSSEEvent(w, name, payload); err != nil {
+			cancel()
+		}
+	}
+
+	filteredOut := 0
+	var lastProgress time.Time
+	var allPaths []string
+	stats := service.WalkScanRoots(ctx, req.Paths, h.scanOptions(req, &filteredOut), service.ScanHooks{
+		OnFolder: func(folder service.ScanFolderInfo) {
+			for _, f := range folder.Files {
+				allPaths = append(allPaths, f.FullPath)
+			}
+			onEvent("folder", folder)
+		},
+		OnError: func(e service.ScanPathError) {
+			onEvent("error", e)
+		},
+		OnProgress: func(s service.ScanStats) {
+			if time.Since(lastProgress) < scanProgressInterval {
+				return
+			}
+			lastProgress = time.Now()
+			onEvent("progress", s)
+		},
+	})
+
+	// 超时也要告知客户端；客户端主动断开时写入会失败，直接忽略
+	if r.Context().Err() == nil {
+		_ = writeSSEEvent(w, "complete", scanStreamComplete{
+			ScanStats:   stats,
+			FilteredOut: filteredOut,
+			Duplicates:  h.scanDuplicates(ctx, req, allPaths),
+		})
+	}
 }
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"kugo-music-converter/internal/logger"
@@ -44,17 +43,15 @@ func (h *ConvertHandler) HandleConvertStream(w http.ResponseWriter, r *http.Requ
 		writeMethodNotAllowed(w, http.MethodPost)
 		return
 	}
-	if missing := h.runtimeMissingTools(); len(missing) > 0 {
-		writeError(w, http.StatusServiceUnavailable, NewAppError(ErrRuntimeMissing, strings.Join(missing, ","), nil))
-		return
-	}
-
 	req, err := h.parseConvertRequest(w, r)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, err)
+		writeError(w, errorStatus(err, http.StatusBadRequest), err)
 		return
 	}
 	defer req.Cleanup()
+	if !h.checkDiskSpace(w, req) || !h.admitBatch(w, req) {
+		return
+	}
 
 	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
 	w.Header().Set("Cache-Control", "no-cache, no-transform")
@@ -83,16 +80,27 @@ func (h *ConvertHandler) HandleConvertStream(w http.ResponseWriter, r *http.Requ
 		}
 	}
 
+	job := h.startJob(req)
 	summary := h.executeBatch(r.Context(), req, stopFn, onEvent)
+	summary.JobID = job.id
+	h.jobs.finish(job, summary)
 	onEvent("complete", map[string]any{
-		"success":      summary.Success,
-		"failed":       summary.Failed,
-		"total":        summary.Total,
-		"outputDir":    summary.OutputDir,
-		"durationMs":   summary.DurationMs,
-		"cancelled":    summary.Cancelled,
-		"outputFormat": summary.OutputFormat,
-		"mp3Quality":   summary.MP3Quality,
-		"results":      summary.Results,
+		"success":           summary.Success,
+		"failed":            summary.Failed,
+		"total":             summary.Total,
+		"outputDir":         summary.OutputDir,
+		"durationMs":        summary.DurationMs,
+		"cancelled":         summary.Cancelled,
+		"outputFormat":      summary.OutputFormat,
+		"mp3Quality":        summary.MP3Quality,
+		"results":           summary.Results,
+		"dropped":           summary.Dropped,
+		"duplicates":        summary.Duplicates,
+		"skippedDuplicates": summary.SkippedDuplicates,
+		"warnings":          summary.Warnings,
+		"tempPeakBytes":     summary.TempPeakBytes,
+		"outputMode":        req.OutputMode,
+		"jobId":             job.id,
+		"downloadUrl":       jobDownloadURL(job.id),
 	})
 }
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ScanErrNotAllowed 表示路径 (或符号链接指向的目标) 不在允许的根目录之内
+const ScanErrNotAllowed = "not_allowed"
+
+// PathAllowlist 限制 HTTP 接口可以访问的目录。路径先解析符号链接再与根目录比较，
+// 因此允许目录中指向外部的链接同样会被拒绝。nil 表示不限制。
+type PathAllowlist struct {
+	roots []string
+}
+
+// NewPathAllowlist 解析各根目录的真实路径；roots 为空时返回 nil (不限制)。
+// 不存在的根目录按绝对路径保留，只是暂时匹配不到任何路径。
+func NewPathAllowlist(roots []string) (*PathAllowlist, error) {
+	a := &PathAllowlist{}
+	for _, raw := range roots {
+		root := strings.TrimSpace(raw)
+		if root == "" {
+			continue
+		}
+		real, err := resolveRealPath(root)
+		if err != nil {
+			return nil, fmt.Errorf("允许目录无效 %s: %w", root, err)
+		}
+		a.roots = append(a.roots, real)
+	}
+	if len(a.roots) == 0 {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// Roots 返回解析后的根目录
+func (a *PathAllowlist) Roots() []string {
+	if a == nil {
+		return nil
+	}
+	return append([]string(nil), a.roots...)
+}
+
+// Check 返回 p 的绝对路径；解析符号链接后不在任何根目录之内时返回 ErrPathNotAllowed
+func (a *PathAllowlist) Check(p string) (string, error) {
+	abs, err := filepath.Abs(strings.TrimSpace(p))
+	if err != nil {
+		return "", err
+	}
+	if a == nil {
+		return abs, nil
+	}
+	real, err := resolveRealPath(abs)
+	if err != nil {
+		return "", err
+	}
+	for _, root := range a.roots {
+		if pathWithin(root, real) {
+			return abs, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrPathNotAllowed, abs)
+}
+
+// Allows 是 Check 的布尔形式，供遍历时判断
+func (a *PathAllowlist) Allows(p string) bool {
+	_, err := a.Check(p)
+	return err == nil
+}
+
+// maxDanglingLinks 限制解析悬空符号链接的跳数，防止链接互相指向时无限循环
+const maxDanglingLinks = 40
+
+// resolveRealPath 解析路径中已存在部分的符号链接，尚不存在的尾部 (如待创建的输出目录) 原样拼接。
+// 悬空的符号链接按其目标继续解析，写入时会落在链接目标处而不是链接所在目录。
+func resolveRealPath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	existing := abs
+	var rest []string
+	hops := 0
+	for {
+		real, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return filepath.Join(append([]string{real}, rest...)...), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		if target, err := os.Readlink(existing); err == nil {
+			if hops++; hops > maxDanglingLinks {
+				return "", fmt.Errorf("too many levels of symbolic links: %s", abs)
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(existing), target)
+			}
+			existing = filepath.Clean(target)
+			continue
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return filepath.Join(append([]string{existing}, rest...)...), nil
+		}
+		rest = append([]string{filepath.Base(existing)}, rest...)
+		existing = parent
+	}
+}
+
+func pathWithin(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel))
+}
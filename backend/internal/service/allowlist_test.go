@@ -0,0 +1,170 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// allowlistFixture 建立如下目录结构并返回其真实路径：
+//
+//	data/music/a.kgg
+//	data/inside      -> data/music
+//	data/outside     -> secret
+//	data/dangling    -> secret/missing
+//	data/dangling-in -> data/new
+//	data2/b.kgg
+//	secret/c.kgg
+func allowlistFixture(t *testing.T) string {
+	t.Helper()
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"data/music", "data2", "secret"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"data/music/a.kgg", "data2/b.kgg", "secret/c.kgg"} {
+		if err := os.WriteFile(filepath.Join(base, file), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"data/inside":      filepath.Join(base, "data/music"),
+		"data/outside":     filepath.Join(base, "secret"),
+		"data/dangling":    filepath.Join(base, "secret/missing"),
+		"data/dangling-in": "new",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, link)); err != nil {
+			t.Skipf("symlinks unavailable: %v", err)
+		}
+	}
+	return base
+}
+
+func TestPathAllowlistCheck(t *testing.T) {
+	base := allowlistFixture(t)
+	allow, err := NewPathAllowlist([]string{filepath.Join(base, "data")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		allowed bool
+	}{
+		{"root itself", "data", true},
+		{"file inside root", "data/music/a.kgg", true},
+		{"symlink to inside", "data/inside/a.kgg", true},
+		{"symlink to outside", "data/outside", false},
+		{"file through outside symlink", "data/outside/c.kgg", false},
+		{"dangling symlink to outside", "data/dangling", false},
+		{"new dir under dangling symlink", "data/dangling/out/sub", false},
+		{"dangling symlink to inside", "data/dangling-in/out", true},
+		{"nested output dir not yet created", "data/out/2026/10", true},
+		{"sibling prefix root", "data2/b.kgg", false},
+		{"sibling prefix new dir", "data2/out", false},
+		{"dot-dot escape", "data/../secret/c.kgg", false},
+		{"outside root", "secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(base, filepath.FromSlash(tt.path))
+			abs, err := allow.Check(p)
+			if tt.allowed {
+				if err != nil {
+					t.Fatalf("Check(%s) = %v, want allowed", tt.path, err)
+				}
+				if abs != p {
+					t.Errorf("Check(%s) = %s, want %s", tt.path, abs, p)
+				}
+				return
+			}
+			if !errors.Is(err, ErrPathNotAllowed) {
+				t.Fatalf("Check(%s) = %q, %v; want ErrPathNotAllowed", tt.path, abs, err)
+			}
+			if allow.Allows(p) {
+				t.Errorf("Allows(%s) = true", tt.path)
+			}
+		})
+	}
+}
+
+func TestPathAllowlistSymlinkedRoot(t *testing.T) {
+	base := allowlistFixture(t)
+	// 根目录本身是符号链接时，按真实路径比较
+	allow, err := NewPathAllowlist([]string{filepath.Join(base, "data/inside")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := allow.Roots(); len(got) != 1 || got[0] != filepath.Join(base, "data/music") {
+		t.Fatalf("Roots() = %v", got)
+	}
+	for path, want := range map[string]bool{
+		"data/inside/a.kgg": true,
+		"data/music/a.kgg":  true,
+		"data/music/new":    true,
+		"data/outside":      false,
+		"data":              false,
+	} {
+		if got := allow.Allows(filepath.Join(base, path)); got != want {
+			t.Errorf("Allows(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestPathAllowlistEmpty(t *testing.T) {
+	allow, err := NewPathAllowlist([]string{"", "  "})
+	if err != nil || allow != nil {
+		t.Fatalf("NewPathAllowlist(empty) = %v, %v; want nil", allow, err)
+	}
+	abs, err := allow.Check("relative/path")
+	if err != nil || !filepath.IsAbs(abs) {
+		t.Fatalf("nil allowlist Check = %q, %v", abs, err)
+	}
+}
+
+func TestResolveRealPath(t *testing.T) {
+	base := allowlistFixture(t)
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"data/music/a.kgg", "data/music/a.kgg"},
+		{"data/inside/a.kgg", "data/music/a.kgg"},
+		{"data/out/2026/10", "data/out/2026/10"},
+		{"data/inside/new/dir", "data/music/new/dir"},
+		{"data/dangling", "secret/missing"},
+		{"data/dangling/out", "secret/missing/out"},
+		{"data/dangling-in/out", "data/new/out"},
+	}
+	for _, tt := range tests {
+		got, err := resolveRealPath(filepath.Join(base, tt.path))
+		if err != nil {
+			t.Errorf("resolveRealPath(%s): %v", tt.path, err)
+			continue
+		}
+		if want := filepath.Join(base, tt.want); got != want {
+			t.Errorf("resolveRealPath(%s) = %s, want %s", tt.path, got, want)
+		}
+	}
+}
+
+func TestResolveRealPathLinkLoop(t *testing.T) {
+	base := t.TempDir()
+	a, b := filepath.Join(base, "a"), filepath.Join(base, "b")
+	if err := os.Symlink(b, a); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	if err := os.Symlink(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveRealPath(filepath.Join(a, "out")); err == nil {
+		t.Fatal("expected error for symlink loop")
+	}
+}
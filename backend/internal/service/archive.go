@@ -0,0 +1,262 @@
+package service
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"kugo-music-converter/internal/utils"
+)
+
+// 压缩包条目被跳过的原因
+const (
+	InputSkipInvalidArchive = "invalid_archive"
+	InputSkipUnsafePath     = "unsafe_path"
+	InputSkipTooLarge       = "too_large"
+	InputSkipZipBomb        = "zip_bomb"
+	InputSkipArchiveLimit   = "archive_limit"
+)
+
+// ZipLimits 限制压缩包的展开，防止 zip 炸弹；字段为 0 时使用 DefaultZipLimits 中的值
+type ZipLimits struct {
+	// MaxEntries 为单个压缩包内参与转换的条目数上限
+	MaxEntries int
+	// MaxEntrySize/MaxTotalSize 为单个条目与全部条目解压后的字节数上限
+	MaxEntrySize int64
+	MaxTotalSize int64
+	// MaxRatio 为单个条目解压后与压缩后大小之比的上限
+	MaxRatio int64
+}
+
+// DefaultZipLimits 根据单文件大小与文件数上限给出压缩包限制
+func DefaultZipLimits(maxFileSize int64, maxFiles int) ZipLimits {
+	return ZipLimits{
+		MaxEntries:   maxFiles,
+		MaxEntrySize: maxFileSize,
+		MaxTotalSize: maxFileSize * int64(maxFiles),
+		MaxRatio:     100,
+	}
+}
+
+func (l ZipLimits) withDefaults() ZipLimits {
+	d := DefaultZipLimits(1<<30, 10000)
+	if l.MaxEntries <= 0 {
+		l.MaxEntries = d.MaxEntries
+	}
+	if l.MaxEntrySize <= 0 {
+		l.MaxEntrySize = d.MaxEntrySize
+	}
+	if l.MaxTotalSize <= 0 {
+		l.MaxTotalSize = d.MaxTotalSize
+	}
+	if l.MaxRatio <= 0 {
+		l.MaxRatio = d.MaxRatio
+	}
+	return l
+}
+
+// IsZipInput 判断文件名是否为 ZIP 压缩包
+func IsZipInput(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".zip")
+}
+
+// ArchiveOriginPath 返回压缩包条目在结果中显示的路径，如 "/music/a.zip/专辑/01.kgg"
+func ArchiveOriginPath(archive, entry string) string {
+	return archive + "/" + entry
+}
+
+// ExpandZip 列出压缩包中可转换的条目，不解压。originPath 为压缩包在结果中显示的路径
+// (上传时为原始文件名)。不安全的条目名 (绝对路径、..、反斜杠、盘符) 与超出限制的条目
+// 连同原因一起返回。
+func ExpandZip(archivePath, originPath string, limits ZipLimits) ([]BatchItem, []ScanPathError) {
+	limits = limits.withDefaults()
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+		return nil, []ScanPathError{{Path: originPath, Reason: InputSkipInvalidArchive, Detail: err.Error()}}
+	}
+	defer zr.Close()
+
+	var items []BatchItem
+	var dropped []ScanPathError
+	var total int64
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		display := ArchiveOriginPath(originPath, f.Name)
+		skip := func(reason, detail string) {
+			dropped = append(dropped, ScanPathError{Path: display, Root: originPath, Reason: reason, Detail: detail})
+		}
+
+		name, ok := safeZipEntryName(f.Name)
+		switch {
+		case !ok:
+			skip(InputSkipUnsafePath, "")
+			continue
+		case !IsSupportedInput(name):
+			skip(InputSkipUnsupported, path.Ext(name))
+			continue
+		case f.Flags&0x1 != 0:
+			skip(InputSkipUnsupported, "加密的 ZIP 条目")
+			continue
+		case f.Method != zip.Store && f.Method != zip.Deflate:
+			skip(InputSkipUnsupported, fmt.Sprintf("压缩方式 %d", f.Method))
+			continue
+		}
+
+		size := int64(f.UncompressedSize64)
+		if f.UncompressedSize64 > uint64(limits.MaxEntrySize) {
+			skip(InputSkipTooLarge, fmt.Sprintf("%d 字节", f.UncompressedSize64))
+			continue
+		}
+		if f.Method == zip.Deflate && size > int64(f.CompressedSize64)*limits.MaxRatio {
+			skip(InputSkipZipBomb, fmt.Sprintf("压缩比超过 %d", limits.MaxRatio))
+			continue
+		}
+		if len(items) >= limits.MaxEntries || total+size > limits.MaxTotalSize {
+			skip(InputSkipArchiveLimit, "")
+			continue
+		}
+		total += size
+
+		items = append(items, BatchItem{
+			Path:       archivePath,
+			Entry:      name,
+			OriginPath: display,
+			Name:       path.Base(name),
+			Size:       size,
+		})
+	}
+	return items, dropped
+}
+
+// safeZipEntryName 校验条目名只包含相对路径，返回规范化后的名字
+func safeZipEntryName(name string) (string, bool) {
+	if strings.ContainsAny(name, `\:`) {
+		return "", false
+	}
+	if !fs.ValidPath(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// decryptInput 是解密器的输入：普通文件或压缩包中的条目，Close 可重复调用
+type decryptInput struct {
+	io.ReadSeeker
+	size    int64
+	closers []func() error
+	closed  bool
+}
+
+func (d *decryptInput) Close() error {
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	var first error
+	for i := len(d.closers) - 1; i >= 0; i-- {
+		if err := d.closers[i](); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// openDecryptInput 打开普通文件，或 entry 非空时打开压缩包中的条目
+func openDecryptInput(inPath, entry string, temp *TempTracker) (*decryptInput, error) {
+	f, err := os.Open(inPath)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if entry == "" {
+		return &decryptInput{ReadSeeker: f, size: st.Size(), closers: []func() error{f.Close}}, nil
+	}
+
+	in, err := openZipEntry(f, st.Size(), entry, temp)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return in, nil
+}
+
+// openZipEntry 以只读方式打开压缩包条目。未压缩 (Store) 的条目直接在压缩包上随机访问，
+// Deflate 条目解压到临时文件 (计入 temp)，解压长度超过声明大小时视为损坏。
+func openZipEntry(f *os.File, size int64, entry string, temp *TempTracker) (*decryptInput, error) {
+	zr, err := zip.NewReader(f, size)
+	if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+		return nil, fmt.Errorf("%w: %v", ErrDecryptProcess, err)
+	}
+	var zf *zip.File
+	for _, candidate := range zr.File {
+		if candidate.Name == entry {
+			zf = candidate
+			break
+		}
+	}
+	if zf == nil {
+		return nil, fmt.Errorf("%w: 压缩包中不存在 %s", ErrUnsupportedInput, entry)
+	}
+
+	if zf.Method == zip.Store {
+		offset, err := zf.DataOffset()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDecryptProcess, err)
+		}
+		return &decryptInput{
+			ReadSeeker: io.NewSectionReader(f, offset, int64(zf.UncompressedSize64)),
+			size:       int64(zf.UncompressedSize64),
+			closers:    []func() error{f.Close},
+		}, nil
+	}
+
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryptProcess, err)
+	}
+	defer rc.Close()
+	tmp, err := os.CreateTemp(utils.TempDir(), "kgg-zip-*"+path.Ext(entry))
+	if err != nil {
+		return nil, err
+	}
+	limit := int64(zf.UncompressedSize64)
+	counted := &tempWriter{w: tmp, temp: trackerOrGlobal(temp)}
+	n, err := io.Copy(counted, io.LimitReader(rc, limit+1))
+	if err == nil && n > limit {
+		err = fmt.Errorf("%w: 条目 %s 解压后超过声明大小", ErrDecryptProcess, entry)
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		counted.release()
+		return nil, err
+	}
+	// 条目已解压，压缩包本身不再需要
+	_ = f.Close()
+	return &decryptInput{
+		ReadSeeker: tmp,
+		size:       n,
+		closers: []func() error{
+			func() error {
+				defer counted.release()
+				return os.Remove(tmp.Name())
+			},
+			tmp.Close,
+		},
+	}, nil
+}
@@ -0,0 +1,292 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kugo-music-converter/internal/utils"
+)
+
+type zipEntry struct {
+	name   string
+	data   []byte
+	method uint16
+}
+
+// writeZip 在临时目录中写出包含给定条目的压缩包
+func writeZip(t *testing.T, entries ...zipEntry) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, e := range entries {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Method: e.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSafeZipEntryName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"song.kgg", true},
+		{"专辑/CD1/01.kgg", true},
+		{"../song.kgg", false},
+		{"album/../../song.kgg", false},
+		{"/etc/song.kgg", false},
+		{`album\song.kgg`, false},
+		{`..\song.kgg`, false},
+		{"C:/song.kgg", false},
+		{"C:song.kgg", false},
+		{"./song.kgg", false},
+		{"album//song.kgg", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		got, ok := safeZipEntryName(tt.name)
+		if ok != tt.ok {
+			t.Errorf("safeZipEntryName(%q) ok = %v, want %v", tt.name, ok, tt.ok)
+		}
+		if ok && got != tt.name {
+			t.Errorf("safeZipEntryName(%q) = %q", tt.name, got)
+		}
+	}
+}
+
+func TestExpandZip(t *testing.T) {
+	small := bytes.Repeat([]byte("kgg"), 100)
+	zeros := make([]byte, 1<<20)
+	tests := []struct {
+		name    string
+		entries []zipEntry
+		limits  ZipLimits
+		items   []string
+		dropped map[string]string
+	}{
+		{
+			name: "unsafe names",
+			entries: []zipEntry{
+				{name: "ok/01.kgg", data: small},
+				{name: "../02.kgg", data: small},
+				{name: "/abs/03.kgg", data: small},
+				{name: `dir\04.kgg`, data: small},
+				{name: "D:/05.kgg", data: small},
+			},
+			items: []string{"ok/01.kgg"},
+			dropped: map[string]string{
+				"../02.kgg":   InputSkipUnsafePath,
+				"/abs/03.kgg": InputSkipUnsafePath,
+				`dir\04.kgg`:  InputSkipUnsafePath,
+				"D:/05.kgg":   InputSkipUnsafePath,
+			},
+		},
+		{
+			name: "unsupported extension",
+			entries: []zipEntry{
+				{name: "cover.jpg", data: small},
+				{name: "01.ncm", data: small},
+			},
+			items:   []string{"01.ncm"},
+			dropped: map[string]string{"cover.jpg": InputSkipUnsupported},
+		},
+		{
+			name: "compression ratio",
+			entries: []zipEntry{
+				{name: "bomb.kgg", data: zeros, method: zip.Deflate},
+				{name: "stored.kgg", data: zeros, method: zip.Store},
+			},
+			limits:  ZipLimits{MaxRatio: 100},
+			items:   []string{"stored.kgg"},
+			dropped: map[string]string{"bomb.kgg": InputSkipZipBomb},
+		},
+		{
+			name: "entry size",
+			entries: []zipEntry{
+				{name: "big.kgg", data: zeros},
+				{name: "small.kgg", data: small},
+			},
+			limits:  ZipLimits{MaxEntrySize: 1 << 10},
+			items:   []string{"small.kgg"},
+			dropped: map[string]string{"big.kgg": InputSkipTooLarge},
+		},
+		{
+			name: "total size",
+			entries: []zipEntry{
+				{name: "01.kgg", data: small},
+				{name: "02.kgg", data: small},
+				{name: "03.kgg", data: small},
+			},
+			limits:  ZipLimits{MaxTotalSize: int64(2 * len(small))},
+			items:   []string{"01.kgg", "02.kgg"},
+			dropped: map[string]string{"03.kgg": InputSkipArchiveLimit},
+		},
+		{
+			name: "entry count",
+			entries: []zipEntry{
+				{name: "01.kgg", data: small},
+				{name: "02.kgg", data: small},
+			},
+			limits:  ZipLimits{MaxEntries: 1},
+			items:   []string{"01.kgg"},
+			dropped: map[string]string{"02.kgg": InputSkipArchiveLimit},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeZip(t, tt.entries...)
+			items, dropped := ExpandZip(path, "a.zip", tt.limits)
+
+			var got []string
+			for _, item := range items {
+				got = append(got, item.Entry)
+				if item.Path != path || item.OriginPath != ArchiveOriginPath("a.zip", item.Entry) {
+					t.Errorf("item %+v has wrong paths", item)
+				}
+			}
+			if len(got) != len(tt.items) {
+				t.Fatalf("items = %v, want %v", got, tt.items)
+			}
+			for i := range got {
+				if got[i] != tt.items[i] {
+					t.Fatalf("items = %v, want %v", got, tt.items)
+				}
+			}
+
+			if len(dropped) != len(tt.dropped) {
+				t.Fatalf("dropped = %+v, want %v", dropped, tt.dropped)
+			}
+			for _, d := range dropped {
+				entry := d.Path[len("a.zip/"):]
+				if want, ok := tt.dropped[entry]; !ok || d.Reason != want {
+					t.Errorf("dropped %q reason = %q, want %q", entry, d.Reason, want)
+				}
+				if d.Root != "a.zip" {
+					t.Errorf("dropped %q root = %q", entry, d.Root)
+				}
+			}
+		})
+	}
+}
+
+func TestExpandZipInvalidArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.zip")
+	if err := os.WriteFile(path, []byte("not a zip"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	items, dropped := ExpandZip(path, "broken.zip", ZipLimits{})
+	if len(items) != 0 || len(dropped) != 1 || dropped[0].Reason != InputSkipInvalidArchive {
+		t.Fatalf("items = %v, dropped = %+v", items, dropped)
+	}
+}
+
+func TestOpenZipEntry(t *testing.T) {
+	utils.SetTempDir(t.TempDir())
+	defer utils.SetTempDir("")
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	path := writeZip(t,
+		zipEntry{name: "stored.kgg", data: data, method: zip.Store},
+		zipEntry{name: "deflated.kgg", data: data, method: zip.Deflate},
+	)
+	for _, entry := range []string{"stored.kgg", "deflated.kgg"} {
+		temp := &TempTracker{}
+		in, err := openDecryptInput(path, entry, temp)
+		if err != nil {
+			t.Fatalf("%s: %v", entry, err)
+		}
+		got, err := io.ReadAll(in)
+		if err != nil {
+			t.Fatalf("%s: %v", entry, err)
+		}
+		if !bytes.Equal(got, data) || in.size != int64(len(data)) {
+			t.Errorf("%s: read %d bytes, size %d", entry, len(got), in.size)
+		}
+		if err := in.Close(); err != nil {
+			t.Errorf("%s: close: %v", entry, err)
+		}
+		if temp.InUse() != 0 {
+			t.Errorf("%s: temp in use after close = %d", entry, temp.InUse())
+		}
+	}
+	assertTempDirEmpty(t)
+
+	if _, err := openDecryptInput(path, "missing.kgg", nil); err == nil {
+		t.Error("missing entry: expected error")
+	}
+}
+
+// TestOpenZipEntryOversized 构造解压长度超过中央目录声明大小的 Deflate 条目
+func TestOpenZipEntryOversized(t *testing.T) {
+	utils.SetTempDir(t.TempDir())
+	defer utils.SetTempDir("")
+
+	data := bytes.Repeat([]byte("a"), 4096)
+	var compressed bytes.Buffer
+	fw, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+	fw.Write(data)
+	fw.Close()
+
+	path := filepath.Join(t.TempDir(), "oversized.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "lying.kgg",
+		Method:             zip.Deflate,
+		CRC32:              crc32.ChecksumIEEE(data[:1024]),
+		CompressedSize64:   uint64(compressed.Len()),
+		UncompressedSize64: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(compressed.Bytes())
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	temp := &TempTracker{}
+	in, err := openDecryptInput(path, "lying.kgg", temp)
+	if err == nil {
+		in.Close()
+		t.Fatal("expected error for entry larger than declared size")
+	}
+	if temp.InUse() != 0 {
+		t.Errorf("temp in use after failure = %d", temp.InUse())
+	}
+	assertTempDirEmpty(t)
+}
+
+func assertTempDirEmpty(t *testing.T) {
+	t.Helper()
+	left, err := os.ReadDir(utils.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("temp files left behind: %d", len(left))
+	}
+}
@@ -0,0 +1,303 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// AudioInfo 是纯 Go 解析容器头得到的基础音频参数，未知字段为零值
+type AudioInfo struct {
+	Container     string        `json:"container"`
+	SampleRate    int           `json:"sampleRate,omitempty"`
+	Channels      int           `json:"channels,omitempty"`
+	BitsPerSample int           `json:"bitsPerSample,omitempty"`
+	TotalSamples  int64         `json:"totalSamples,omitempty"`
+	Duration      time.Duration `json:"-"`
+	DurationMs    int64         `json:"durationMs,omitempty"`
+	FLACMD5       [16]byte      `json:"-"`
+}
+
+// ProbeAudio 解析 FLAC STREAMINFO 或 WAV fmt/data 块，其他容器只返回类型
+func ProbeAudio(path string) (AudioInfo, error) {
+	ext, err := DetectAudioExt(path)
+	if err != nil {
+		return AudioInfo{}, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return AudioInfo{}, err
+	}
+	defer f.Close()
+	return probeAudio(ext, bufio.NewReader(f))
+}
+
+// ProbeAudioHead 与 ProbeAudio 相同，但只解析内存中的文件开头部分 (如解密得到的前 64KB)
+func ProbeAudioHead(head []byte) (AudioInfo, error) {
+	n := len(head)
+	if n > 12 {
+		n = 12
+	}
+	ext, err := detectAudioHeader(head[:n])
+	if err != nil {
+		return AudioInfo{}, err
+	}
+	return probeAudio(ext, bytes.NewReader(head))
+}
+
+func probeAudio(ext string, r io.Reader) (AudioInfo, error) {
+	info := AudioInfo{Container: ext[1:]}
+	var err error
+	switch ext {
+	case ".flac":
+		err = probeFLAC(r, &info)
+	case ".wav":
+		err = probeWAV(r, &info)
+	}
+	if err != nil {
+		return info, fmt.Errorf("%w: %v", ErrUnknownAudio, err)
+	}
+	if info.SampleRate > 0 && info.TotalSamples > 0 && info.Duration == 0 {
+		info.Duration = time.Duration(info.TotalSamples) * time.Second / time.Duration(info.SampleRate)
+	}
+	info.DurationMs = info.Duration.Milliseconds()
+	return info, nil
+}
+
+func probeFLAC(r io.Reader, info *AudioInfo) error {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(magic[:], []byte("fLaC")) {
+		return fmt.Errorf("missing fLaC marker")
+	}
+
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return err
+		}
+		last := hdr[0]&0x80 != 0
+		blockType := hdr[0] & 0x7F
+		length := int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+
+		if blockType != 0 {
+			if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+				return err
+			}
+			if last {
+				return fmt.Errorf("STREAMINFO not found")
+			}
+			continue
+		}
+
+		if length < 34 {
+			return fmt.Errorf("STREAMINFO too short")
+		}
+		// STREAMINFO 固定为 34 字节，不按文件中的块长度分配内存
+		block := make([]byte, 34)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return err
+		}
+		// 10 字节块/帧大小之后：采样率 20 bit、声道数-1 3 bit、位深-1 5 bit、总采样数 36 bit
+		packed := binary.BigEndian.Uint64(block[10:18])
+		info.SampleRate = int(packed >> 44)
+		info.Channels = int((packed>>41)&0x7) + 1
+		info.BitsPerSample = int((packed>>36)&0x1F) + 1
+		info.TotalSamples = int64(packed & 0xFFFFFFFFF)
+		copy(info.FLACMD5[:], block[18:34])
+		return nil
+	}
+}
+
+func probeWAV(r io.Reader, info *AudioInfo) error {
+	hdr, err := readWAVHeader(r)
+	if err != nil {
+		return err
+	}
+	info.Channels = hdr.channels
+	info.SampleRate = hdr.sampleRate
+	info.BitsPerSample = hdr.bitsPerSample
+	if blockAlign := int64(hdr.channels * hdr.bitsPerSample / 8); blockAlign > 0 {
+		info.TotalSamples = hdr.dataSize / blockAlign
+	}
+	info.Duration = time.Duration(hdr.dataSize) * time.Second / time.Duration(hdr.byteRate)
+	return nil
+}
+
+// wavHeader 是 fmt 块的关键字段与 data 块长度
+type wavHeader struct {
+	formatTag     uint16
+	channels      int
+	sampleRate    int
+	byteRate      uint32
+	bitsPerSample int
+	dataSize      int64
+}
+
+// isIntegerPCM 判断是否为整数 PCM（含 WAVE_FORMAT_EXTENSIBLE 的 PCM 子格式）
+func (h wavHeader) isIntegerPCM() bool {
+	return h.formatTag == wavFormatPCM || h.formatTag == wavFormatExtensible
+}
+
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatExtensible = 0xFFFE
+	// maxWAVFmtSize 为 WAVE_FORMAT_EXTENSIBLE 的 fmt 块长度 (40 字节) 留出余量
+	maxWAVFmtSize = 64
+)
+
+// readWAVHeader 解析到 data 块为止，返回后 r 位于音频数据起点
+func readWAVHeader(r io.Reader) (wavHeader, error) {
+	var hdr wavHeader
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return hdr, err
+	}
+	if !bytes.Equal(riff[0:4], []byte("RIFF")) || !bytes.Equal(riff[8:12], []byte("WAVE")) {
+		return hdr, fmt.Errorf("not a RIFF/WAVE file")
+	}
+
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return hdr, err
+		}
+		id := string(chunk[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return hdr, fmt.Errorf("fmt chunk too short")
+			}
+			// 块长度来自文件，只读取需要的前 maxWAVFmtSize 字节，其余跳过，避免按损坏的长度分配内存
+			body := make([]byte, min(size, maxWAVFmtSize))
+			if _, err := io.ReadFull(r, body); err != nil {
+				return hdr, err
+			}
+			if _, err := io.CopyN(io.Discard, r, size-int64(len(body))); err != nil {
+				return hdr, err
+			}
+			hdr.formatTag = binary.LittleEndian.Uint16(body[0:2])
+			hdr.channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			hdr.sampleRate = int(binary.LittleEndian.Uint32(body[4:8]))
+			hdr.byteRate = binary.LittleEndian.Uint32(body[8:12])
+			hdr.bitsPerSample = int(binary.LittleEndian.Uint16(body[14:16]))
+			if hdr.formatTag == wavFormatExtensible && len(body) >= 26 {
+				// 扩展格式的子格式 GUID 前两字节即实际格式码
+				if binary.LittleEndian.Uint16(body[24:26]) != wavFormatPCM {
+					hdr.formatTag = binary.LittleEndian.Uint16(body[24:26])
+				}
+			}
+		case "data":
+			if hdr.byteRate == 0 {
+				return hdr, fmt.Errorf("data chunk before fmt chunk")
+			}
+			hdr.dataSize = size
+			return hdr, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, size); err != nil {
+				return hdr, err
+			}
+		}
+		if size%2 == 1 {
+			// RIFF 块按偶数字节对齐
+			if _, err := io.CopyN(io.Discard, r, 1); err != nil {
+				return hdr, err
+			}
+		}
+	}
+}
+
+// detectAudioCodec 识别同一容器可承载多种编码时的实际编码：Ogg 中的 vorbis/opus，
+// MP4 中的 aac/alac；其他容器或无法识别时返回空串
+func detectAudioCodec(path, ext string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	switch ext {
+	case ".ogg":
+		// 首页只含标识头包，编码标识位于前几十字节
+		head := make([]byte, 128)
+		n, _ := io.ReadFull(f, head)
+		switch {
+		case bytes.Contains(head[:n], []byte("OpusHead")):
+			return "opus"
+		case bytes.Contains(head[:n], []byte("\x01vorbis")):
+			return "vorbis"
+		}
+	case ".m4a":
+		st, err := f.Stat()
+		if err != nil {
+			return ""
+		}
+		entry, err := findMP4SampleEntry(f, 0, st.Size(), []string{"moov", "trak", "mdia", "minf", "stbl", "stsd"})
+		if err != nil {
+			return ""
+		}
+		switch entry {
+		case "mp4a":
+			return "aac"
+		case "alac":
+			return "alac"
+		}
+	}
+	return ""
+}
+
+// findMP4SampleEntry 沿 boxPath 逐层查找 box，返回 stsd 中首个采样描述的格式标识 (如 mp4a、alac)；
+// moov 可能位于文件末尾，按 box 长度跳转而不读取 mdat
+func findMP4SampleEntry(r io.ReadSeeker, pos, end int64, boxPath []string) (string, error) {
+	for pos+8 <= end {
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return "", err
+		}
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return "", err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		headerLen := int64(8)
+		switch size {
+		case 0:
+			size = end - pos
+		case 1:
+			var large [8]byte
+			if _, err := io.ReadFull(r, large[:]); err != nil {
+				return "", err
+			}
+			size = int64(binary.BigEndian.Uint64(large[:]))
+			headerLen = 16
+		}
+		if size < headerLen || size > end-pos {
+			return "", fmt.Errorf("invalid mp4 box size")
+		}
+
+		if string(hdr[4:8]) == boxPath[0] {
+			if len(boxPath) == 1 {
+				// stsd：版本/标志 4 字节、条目数 4 字节，随后为首个条目的长度与格式标识
+				var body [16]byte
+				if _, err := io.ReadFull(r, body[:]); err != nil {
+					return "", err
+				}
+				return string(body[12:16]), nil
+			}
+			// 同名 box 可能有多个 (如多条 trak)，在其中找不到时继续查找后续同级 box
+			if entry, err := findMP4SampleEntry(r, pos+headerLen, pos+size, boxPath[1:]); err == nil {
+				return entry, nil
+			}
+		}
+		pos += size
+	}
+	return "", fmt.Errorf("mp4 box %s not found", boxPath[0])
+}
@@ -14,6 +14,10 @@ type BatchItem struct {
 	Size       int64
 	Temporary  bool
 	Current    int
+	// Entry 非空时 Path 为 ZIP 压缩包，Entry 为包内文件名 (使用 /)，OriginPath 为压缩包路径加条目名
+	Entry string
+	// Root 为该文件所属的扫描根目录，保留目录结构时据此计算输出子目录；为空时直接输出到输出目录
+	Root string
 }
 
 type BatchFileError struct {
@@ -30,17 +34,23 @@ type BatchProgressEvent struct {
 	Current int    `json:"current"`
 	Total   int    `json:"total"`
 	Percent int    `json:"percent"`
+	// QueuePosition 在 Phase 为 queued 时给出批次在调度队列中的位置 (从 1 开始)
+	QueuePosition int `json:"queuePosition,omitempty"`
 }
 
+// PhaseQueued 表示批次正在等待调度器开始运行
+const PhaseQueued = "queued"
+
 type BatchFileDoneEvent struct {
-	File    string          `json:"file"`
-	Input   string          `json:"input,omitempty"`
-	Status  string          `json:"status"`
-	Output  string          `json:"output,omitempty"`
-	Error   *BatchFileError `json:"error,omitempty"`
-	Current int             `json:"current"`
-	Total   int             `json:"total"`
-	Percent int             `json:"percent"`
+	File      string          `json:"file"`
+	Input     string          `json:"input,omitempty"`
+	Status    string          `json:"status"`
+	Output    string          `json:"output,omitempty"`
+	KeySource string          `json:"keySource,omitempty"`
+	Error     *BatchFileError `json:"error,omitempty"`
+	Current   int             `json:"current"`
+	Total     int             `json:"total"`
+	Percent   int             `json:"percent"`
 }
 
 type BatchSummary struct {
@@ -53,6 +63,17 @@ type BatchSummary struct {
 	OutputFormat string               `json:"outputFormat"`
 	MP3Quality   int                  `json:"mp3Quality"`
 	Results      []BatchFileDoneEvent `json:"results"`
+	// Dropped 是输入路径中未加入批次的文件或目录及原因
+	Dropped []ScanPathError `json:"dropped,omitempty"`
+	// Duplicates/SkippedDuplicates 在按组选择最佳音质时给出，被跳过的文件不计入 Total
+	Duplicates        []DuplicateGroup `json:"duplicates,omitempty"`
+	SkippedDuplicates []string         `json:"skippedDuplicates,omitempty"`
+	// JobID 为 HTTP 转换任务 ID，结束后可通过 /api/jobs/{id}/download 以 ZIP 下载输出文件
+	JobID string `json:"jobId,omitempty"`
+	// TempPeakBytes 为批次运行期间临时文件占用的峰值
+	TempPeakBytes int64 `json:"tempPeakBytes,omitempty"`
+	// Warnings 为不影响转换的提示，如磁盘剩余空间偏少
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 type BatchOptions struct {
@@ -62,10 +83,12 @@ type BatchOptions struct {
 	OutputFormat string
 	MP3Quality   int
 	ShouldStop   func() bool
-	Convert      func(context.Context, BatchItem, func(phase string, filePercent int)) (string, error)
+	Convert      func(context.Context, BatchItem, func(phase string, filePercent int)) (ConvertResult, error)
 	ErrorMapper  func(error) *BatchFileError
 	OnProgress   func(BatchProgressEvent)
 	OnFileDone   func(BatchFileDoneEvent)
+	// Slots 非空时每个文件转换前从全局调度器获取槽位，Concurrency 仍限制本批次的并发数
+	Slots *BatchTicket
 }
 
 func computePercent(doneFiles int, filePercent int, total int) int {
@@ -114,12 +137,17 @@ func RunBatch(ctx context.Context, opts BatchOptions) BatchSummary {
 	worker := func() {
 		defer wg.Done()
 		for item := range jobs {
-			if opts.ShouldStop != nil && opts.ShouldStop() {
-				cancelled.Store(true)
-				continue
+			if opts.Slots != nil {
+				if err := opts.Slots.Acquire(ctx); err != nil {
+					cancelled.Store(true)
+					continue
+				}
 			}
-			if ctx.Err() != nil {
+			if (opts.ShouldStop != nil && opts.ShouldStop()) || ctx.Err() != nil {
 				cancelled.Store(true)
+				if opts.Slots != nil {
+					opts.Slots.Release()
+				}
 				continue
 			}
 
@@ -137,7 +165,10 @@ func RunBatch(ctx context.Context, opts BatchOptions) BatchSummary {
 				})
 			}
 
-			outputPath, err := opts.Convert(ctx, item, progress)
+			result, err := opts.Convert(ctx, item, progress)
+			if opts.Slots != nil {
+				opts.Slots.Release()
+			}
 			doneNow := int(atomic.AddInt32(&completed, 1))
 
 			evt := BatchFileDoneEvent{
@@ -160,7 +191,8 @@ func RunBatch(ctx context.Context, opts BatchOptions) BatchSummary {
 			} else {
 				atomic.AddInt32(&success, 1)
 				evt.Status = "ok"
-				evt.Output = outputPath
+				evt.Output = result.Output
+				evt.KeySource = result.KeySource
 			}
 
 			mu.Lock()
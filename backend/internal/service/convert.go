@@ -0,0 +1,329 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"kugo-music-converter/internal/logger"
+)
+
+// SupportedInputExts 列出可解密的输入扩展名
+var SupportedInputExts = []string{".kgg", ".kgm", ".kgma", ".vpr", ".ncm"}
+
+func IsSupportedInput(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, item := range SupportedInputExts {
+		if ext == item {
+			return true
+		}
+	}
+	return false
+}
+
+// ConvertParams 是一次批量转换中所有文件共享的输出参数
+type ConvertParams struct {
+	OutputDir string
+	Transcode TranscodeOptions
+	KeyMap    map[string]string
+	Loudness  LoudnessOptions
+	AlbumGain *AlbumGainTracker // 仅 replaygain 模式使用，批次结束后调用 Apply
+	Verify    bool              // 输出后校验容器、FLAC MD5 与时长
+	// WriteManifest 在输出目录的 .kugo-manifest.jsonl 中记录成功转换的源文件
+	WriteManifest bool
+	// KeyMapSource 描述 KeyMap 的来源 (如 "db:tools/KGMusicV3.db")，会作为密钥来源回报
+	KeyMapSource string
+	// PreserveStructure 在输出目录下重建源文件相对扫描根目录的子目录
+	PreserveStructure bool
+	// Temp 统计本批次的临时空间占用，nil 时只计入全局统计
+	Temp *TempTracker
+}
+
+// ConvertResult 是单个文件的转换结果
+type ConvertResult struct {
+	Output    string // 输出文件路径
+	KeySource string // KGG 试解密通过的密钥来源，其他格式为空
+}
+
+// Converter 串联解密、格式识别与转码，供 HTTP 与 CLI 共用
+type Converter struct {
+	decrypt   *DecryptService
+	ffmpegBin string
+
+	capsMu    sync.RWMutex
+	caps      FFmpegCapabilities
+	capsKnown bool
+}
+
+func NewConverter(decrypt *DecryptService, ffmpegBin string) *Converter {
+	return &Converter{decrypt: decrypt, ffmpegBin: ffmpegBin}
+}
+
+// SetFFmpegCapabilities 更新 ffmpeg 探测结果；未设置时视为 ffmpeg 完整可用
+func (c *Converter) SetFFmpegCapabilities(caps FFmpegCapabilities) {
+	c.capsMu.Lock()
+	c.caps = caps
+	c.capsKnown = true
+	c.capsMu.Unlock()
+}
+
+// ffmpegUsable 表示 ffmpeg 可执行；未设置探测结果时视为可用
+func (c *Converter) ffmpegUsable() bool {
+	c.capsMu.RLock()
+	defer c.capsMu.RUnlock()
+	return !c.capsKnown || c.caps.Available
+}
+
+// missingEncoder 表示本机 ffmpeg 无法输出该格式，需要走纯 Go 或直通路径
+func (c *Converter) missingEncoder(format string) bool {
+	c.capsMu.RLock()
+	defer c.capsMu.RUnlock()
+	return c.capsKnown && len(c.caps.MissingFor(format)) > 0
+}
+
+func UniqueOutputPath(path string) (string, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return path, nil
+	}
+
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; i < 10000; i++ {
+		candidate := fmt.Sprintf("%s_%d%s", base, i, ext)
+		if _, err := os.Stat(candidate); errors.Is(err, os.ErrNotExist) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%w: 输出文件重名过多，无法生成唯一文件名", ErrTranscodeProcess)
+}
+
+// ItemOutputDir 返回保留目录结构时的输出目录：outputDir 加上源文件所在目录相对 item.Root 的路径，
+// 压缩包条目再加上包内子目录，并确保目录存在。没有可保留的子目录时返回 outputDir。
+func ItemOutputDir(outputDir string, item BatchItem) (string, error) {
+	dir := outputDir
+	if item.Root != "" {
+		rel, err := filepath.Rel(item.Root, filepath.Dir(item.Path))
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel) {
+			dir = filepath.Join(dir, rel)
+		}
+	}
+	// 条目名在 ExpandZip 中已校验为安全的相对路径
+	if item.Entry != "" {
+		if sub := path.Dir(item.Entry); sub != "." {
+			dir = filepath.Join(dir, filepath.FromSlash(sub))
+		}
+	}
+	if dir == outputDir {
+		return outputDir, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// ConvertItem 解密单个文件并写入输出目录，返回输出文件路径与密钥来源
+func (c *Converter) ConvertItem(ctx context.Context, item BatchItem, p ConvertParams, progress func(phase string, filePercent int)) (ConvertResult, error) {
+	report := func(phase string, filePercent int) {
+		if progress != nil {
+			progress(phase, filePercent)
+		}
+	}
+
+	report("prepare", 5)
+	if err := ctx.Err(); err != nil {
+		return ConvertResult{}, err
+	}
+
+	// 单文件进度分段：解密 5~50，响度分析 50，转码 55~99
+	lastDecrypt := -1
+	onDecrypt := func(done, total int64) {
+		if total <= 0 {
+			return
+		}
+		pct := 5 + int(min(done, total)*45/total)
+		if pct != lastDecrypt {
+			lastDecrypt = pct
+			report("decrypt", pct)
+		}
+	}
+
+	var keyMap map[string]string
+	if strings.EqualFold(filepath.Ext(item.Name), ".kgg") {
+		keyMap = p.KeyMap
+	}
+	phaseStart := time.Now()
+	raw, rawCleanup, err := c.decrypt.DecryptFile(item.Path, DecryptOptions{
+		KeyMap:       keyMap,
+		KeyMapSource: p.KeyMapSource,
+		OnProgress:   onDecrypt,
+		Entry:        item.Entry,
+		Temp:         p.Temp,
+	})
+	if err != nil {
+		return ConvertResult{}, err
+	}
+	rawPath := raw.Path
+	if rawCleanup != nil {
+		defer rawCleanup()
+	}
+
+	observePhase("decrypt", phaseStart)
+	report("decrypt", 50)
+
+	rawAudioExt, err := DetectAudioExt(rawPath)
+	if err != nil {
+		return ConvertResult{}, err
+	}
+
+	transcode := p.Transcode
+	var measurement LoudnessMeasurement
+	replayGain := false
+	if p.Loudness.Enabled() {
+		report("analyze", 50)
+		phaseStart = time.Now()
+		measurement, err = MeasureLoudness(ctx, c.ffmpegBin, rawPath, p.Loudness)
+		observePhase("analyze", phaseStart)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ConvertResult{}, ctx.Err()
+			}
+			return ConvertResult{}, err
+		}
+		if measurement.Usable() {
+			switch p.Loudness.Mode {
+			case LoudnessNormalize:
+				transcode.AudioFilter = NormalizeFilter(p.Loudness, measurement, transcode.SampleRate)
+			case LoudnessReplayGain:
+				replayGain = true
+			}
+		}
+	}
+
+	baseName := strings.TrimSuffix(item.Name, filepath.Ext(item.Name))
+	outputDir := p.OutputDir
+	if p.PreserveStructure {
+		if outputDir, err = ItemOutputDir(p.OutputDir, item); err != nil {
+			return ConvertResult{}, fmt.Errorf("%w: 创建输出子目录失败: %v", ErrTranscodeProcess, err)
+		}
+	}
+
+	var outputPath, outputFormat string
+	if transcode.Format == "copy" {
+		outputFormat = strings.TrimPrefix(rawAudioExt, ".")
+		outputPath, err = UniqueOutputPath(filepath.Join(outputDir, baseName+rawAudioExt))
+	} else {
+		outputFormat = transcode.Format
+		outputPath, err = UniqueOutputPath(BuildOutputPath(outputDir, baseName, transcode.Format))
+	}
+	if err != nil {
+		return ConvertResult{}, err
+	}
+
+	report("transcode", 55)
+	onTranscode := func(percent int) {
+		report("transcode", 55+percent*40/100)
+	}
+
+	tagged := false
+	phase := "transcode"
+	phaseStart = time.Now()
+	switch {
+	case transcode.Format == "copy" || canPassthrough(rawPath, rawAudioExt, transcode):
+		phase = "copy"
+		if err := CopyFile(rawPath, outputPath); err != nil {
+			return ConvertResult{}, fmt.Errorf("%w: 写入输出文件失败: %v", ErrTranscodeProcess, err)
+		}
+		if replayGain {
+			if tagged, err = c.tagReplayGain(ctx, outputPath, outputFormat, measurement); err != nil {
+				return ConvertResult{}, err
+			}
+		}
+	case c.missingEncoder(transcode.Format):
+		// 降级模式：ffmpeg 不可用时仅支持纯 Go 的 FLAC/WAV 互转
+		if !canConvertNative(rawAudioExt, transcode) {
+			return ConvertResult{}, fmt.Errorf("%w: %s 转 %s 需要 ffmpeg", ErrFFmpegUnavailable, strings.TrimPrefix(rawAudioExt, "."), transcode.Format)
+		}
+		if err := ConvertNative(ctx, rawPath, outputPath, transcode, onTranscode); err != nil {
+			return ConvertResult{}, err
+		}
+	default:
+		if replayGain {
+			transcode.Tags = TrackGainTags(measurement, transcode.Format)
+			tagged = true
+		}
+		if err := TranscodeToFormat(ctx, c.ffmpegBin, rawPath, outputPath, transcode, onTranscode); err != nil {
+			if ctx.Err() != nil {
+				return ConvertResult{}, ctx.Err()
+			}
+			return ConvertResult{}, err
+		}
+	}
+	observePhase(phase, phaseStart)
+
+	if p.Verify {
+		report("verify", 95)
+		phaseStart = time.Now()
+		if err := VerifyOutput(ctx, c.ffmpegBin, c.ffmpegUsable(), rawPath, outputPath); err != nil {
+			// 校验失败的输出不可信，删除以免被当作成功结果使用
+			_ = os.Remove(outputPath)
+			if ctx.Err() != nil {
+				return ConvertResult{}, ctx.Err()
+			}
+			return ConvertResult{}, err
+		}
+		observePhase("verify", phaseStart)
+	}
+	if tagged {
+		p.AlbumGain.Add(item.OriginPath, outputPath, outputFormat, measurement)
+	}
+	if p.WriteManifest {
+		c.appendManifest(item, p.OutputDir, outputPath, outputFormat)
+	}
+
+	recordProcessedBytes(item, rawPath, outputPath)
+	report("transcode", 100)
+	return ConvertResult{Output: outputPath, KeySource: raw.KeySource}, nil
+}
+
+// appendManifest 记录转换结果，写入失败只记录警告，不影响转换本身
+func (c *Converter) appendManifest(item BatchItem, outputDir, outputPath, format string) {
+	entry := ManifestEntry{
+		Source:      item.OriginPath,
+		SourceName:  item.Name,
+		SourceSize:  item.Size,
+		Output:      outputPath,
+		Format:      format,
+		ConvertedAt: time.Now().Format(time.RFC3339),
+	}
+	if st, err := os.Stat(item.Path); err == nil && item.Entry == "" {
+		entry.SourceSize = st.Size()
+	}
+	if rel, err := filepath.Rel(outputDir, outputPath); err == nil {
+		entry.Output = filepath.ToSlash(rel)
+	}
+	if err := AppendManifest(outputDir, entry); err != nil {
+		logger.Warnf("写入转换清单失败: %v", err)
+	}
+}
+
+// tagReplayGain 为未经转码直接复制的输出补写单曲增益，返回是否已写入
+func (c *Converter) tagReplayGain(ctx context.Context, outputPath, format string, m LoudnessMeasurement) (bool, error) {
+	if format == "wav" {
+		logger.Warnf("WAV 无法写入 ReplayGain 标签，已跳过: %s", outputPath)
+		return false, nil
+	}
+	if err := WriteTags(ctx, c.ffmpegBin, outputPath, TrackGainTags(m, format)); err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		return false, err
+	}
+	return true, nil
+}
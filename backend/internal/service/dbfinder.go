@@ -90,11 +90,7 @@ func DetectKGMusicDB(baseDir string) DBStatus {
 	return DBStatus{Found: false, Source: "missing"}
 }
 
+// LoadDBKeyMap 解密 KGMusicV3.db 并读取密钥映射，成功时计入 DBReloads
 func LoadDBKeyMap(dbPath string) (map[string]string, error) {
-	decPath, cleanup, err := kgg.DecryptKGDatabaseToFile(dbPath)
-	if err != nil {
-		return nil, err
-	}
-	defer cleanup()
-	return kgg.ReadShareFileItems(decPath)
+	return kgg.LoadDatabaseKeys(dbPath)
 }
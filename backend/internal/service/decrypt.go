@@ -1,6 +1,9 @@
 package service
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -28,180 +31,291 @@ func NewDecryptService(cfg *config.Config) *DecryptService {
 	return &DecryptService{cfg: cfg}
 }
 
-// DecryptFileByExt selects a decryptor by extension.
-func (s *DecryptService) DecryptFileByExt(inPath string) (outPath string, cleanup func(), err error) {
-	ext := strings.ToLower(filepath.Ext(inPath))
-	switch ext {
-	case ".kgm", ".kgma", ".vpr":
-		return s.decryptKgmPureGo(inPath)
-	case ".kgg":
-		return s.decryptKggPureGo(inPath)
-	case ".ncm":
-		return s.decryptNcmPureGo(inPath)
-	default:
-		return "", func() {}, fmt.Errorf("%w: %s", ErrUnsupportedInput, ext)
+// DecryptProgress receives the bytes of the encrypted input read so far and the input size.
+type DecryptProgress func(done, total int64)
+
+// DecryptOptions carries per-call inputs for DecryptFile.
+type DecryptOptions struct {
+	// KeyMap is an in-memory KGG key map (e.g. loaded from KGMusicV3.db);
+	// KeyMapSource describes where it came from and is reported as the key source.
+	KeyMap       map[string]string
+	KeyMapSource string
+	// KeyProvider, when set, replaces the provider built from KeyMap and tools/
+	// so callers decrypting many files can build it once.
+	KeyProvider kgg.KeyProvider
+	OnProgress  DecryptProgress
+	// Entry, when set, names a file inside the ZIP archive at inPath.
+	Entry string
+	// Temp accounts the temp files written while decrypting; nil counts them in TempUsage only.
+	Temp *TempTracker
+}
+
+// DecryptedFile is the raw audio produced by DecryptFile.
+type DecryptedFile struct {
+	Path string
+	// KeySource names the provider whose KGG key passed trial decryption; empty for other formats.
+	KeySource string
+}
+
+// DecryptFile decrypts by extension with optional in-memory KGG keys and progress reporting.
+func (s *DecryptService) DecryptFile(inPath string, opts DecryptOptions) (out DecryptedFile, cleanup func(), err error) {
+	stream, err := s.openDecoded(inPath, opts)
+	if err != nil {
+		return out, func() {}, err
 	}
+	defer stream.Close()
+	out.KeySource = stream.keySource
+
+	prefix := strings.TrimPrefix(strings.ToLower(filepath.Ext(stream.name)), ".")
+	outPath := filepath.Join(utils.TempDir(), fmt.Sprintf("%s_dec_%s.bin", prefix, utils.RandHex(8)))
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		return DecryptedFile{}, func() {}, err
+	}
+	defer outFile.Close()
+
+	counted := &tempWriter{w: outFile, temp: trackerOrGlobal(opts.Temp)}
+	if err := stream.copyTo(counted); err != nil {
+		_ = outFile.Close()
+		_ = os.Remove(outPath)
+		counted.release()
+		return DecryptedFile{}, func() {}, err
+	}
+	out.Path = outPath
+	return out, func() {
+		_ = os.Remove(outPath)
+		counted.release()
+	}, nil
 }
 
-// DecryptFileByExtWithMemKey prefers in-memory key map for .kgg.
-func (s *DecryptService) DecryptFileByExtWithMemKey(inPath string, memKey map[string]string) (outPath string, cleanup func(), err error) {
-	ext := strings.ToLower(filepath.Ext(inPath))
-	if ext == ".kgg" && len(memKey) > 0 {
-		return s.decryptKggWithProvider(inPath, kgg.MemoryKeyProvider{Cache: memKey})
+// DecryptHead returns up to n decoded bytes from the start of the audio stream.
+func (s *DecryptService) DecryptHead(inPath string, opts DecryptOptions, n int) ([]byte, error) {
+	stream, err := s.openDecoded(inPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var buf bytes.Buffer
+	err = stream.copyTo(&limitWriter{w: &buf, remaining: int64(n)})
+	if err != nil && !errors.Is(err, errLimitReached) {
+		return nil, err
 	}
-	return s.DecryptFileByExt(inPath)
+	return buf.Bytes(), nil
 }
 
-func (s *DecryptService) decryptKgmPureGo(inPath string) (outPath string, cleanup func(), err error) {
-	in, err := os.Open(inPath)
+// DecryptHash returns the hex SHA-256 of the whole decoded audio stream without writing it to disk.
+func (s *DecryptService) DecryptHash(inPath string, opts DecryptOptions) (string, error) {
+	stream, err := s.openDecoded(inPath, opts)
 	if err != nil {
-		return "", func() {}, err
+		return "", err
 	}
-	defer in.Close()
+	defer stream.Close()
 
-	dec := kgm.NewDecoder(&common.DecoderParams{Reader: in})
-	if err := dec.Validate(); err != nil {
-		return "", func() {}, fmt.Errorf("%w: invalid KGM/KGMA/VPR: %v", ErrDecryptProcess, err)
+	h := sha256.New()
+	if err := stream.copyTo(h); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// decodedStream is a validated decoder over an encrypted input file or archive entry.
+type decodedStream struct {
+	dec       io.Reader
+	in        *decryptInput
+	name      string
+	keySource string
+	// readErr maps decoder read errors to service errors.
+	readErr func(error) error
+}
 
-	outPath = filepath.Join(os.TempDir(), fmt.Sprintf("kgm_dec_%s.bin", utils.RandHex(8)))
-	out, e := os.Create(outPath)
-	if e != nil {
-		return "", func() {}, e
+func (d *decodedStream) Close() {
+	if c, ok := d.dec.(io.Closer); ok {
+		_ = c.Close()
 	}
-	defer out.Close()
+	_ = d.in.Close()
+}
 
-	buf := make([]byte, 64*1024)
-	for {
-		n, e := dec.Read(buf)
-		if n > 0 {
-			if _, werr := out.Write(buf[:n]); werr != nil {
-				_ = os.Remove(outPath)
-				return "", func() {}, werr
-			}
-		}
-		if errors.Is(e, io.EOF) {
-			break
-		}
-		if e != nil {
-			return "", func() {}, fmt.Errorf("%w: %v", ErrDecryptProcess, e)
+var errLimitReached = errors.New("limit reached")
+
+// limitWriter stops the copy once remaining bytes have been written.
+type limitWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (l *limitWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) >= l.remaining {
+		n, err := l.w.Write(b[:l.remaining])
+		l.remaining = 0
+		if err == nil {
+			err = errLimitReached
 		}
+		return n, err
 	}
-	return outPath, func() { _ = os.Remove(outPath) }, nil
+	n, err := l.w.Write(b)
+	l.remaining -= int64(n)
+	return n, err
 }
 
-func (s *DecryptService) decryptNcmPureGo(inPath string) (outPath string, cleanup func(), err error) {
+// copyTo streams decoded audio to w. The NCM decoder may panic on malformed input,
+// so panics are converted to ErrDecryptProcess.
+func (d *decodedStream) copyTo(w io.Writer) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			logger.Errorf("NCM decoder panic: %v", r)
-			outPath = ""
-			cleanup = func() {}
-			err = fmt.Errorf("%w: ncm decoder panic: %v", ErrDecryptProcess, r)
+			logger.Errorf("decoder panic: %v", r)
+			err = fmt.Errorf("%w: decoder panic: %v", ErrDecryptProcess, r)
 		}
 	}()
 
-	in, err := os.Open(inPath)
-	if err != nil {
-		return "", func() {}, err
-	}
-	defer in.Close()
-
-	dec := ncm.NewDecoder(&common.DecoderParams{
-		Reader:    in,
-		Extension: strings.ToLower(filepath.Ext(inPath)),
-		FilePath:  inPath,
-		Logger:    noopZapLogger,
-	})
-	if err := dec.Validate(); err != nil {
-		return "", func() {}, fmt.Errorf("%w: invalid NCM: %v", ErrDecryptProcess, err)
-	}
-
-	outPath = filepath.Join(os.TempDir(), fmt.Sprintf("ncm_dec_%s.bin", utils.RandHex(8)))
-	out, e := os.Create(outPath)
-	if e != nil {
-		return "", func() {}, e
-	}
-	defer out.Close()
-
 	buf := make([]byte, 64*1024)
 	for {
-		n, e := dec.Read(buf)
+		n, e := d.dec.Read(buf)
 		if n > 0 {
-			if _, werr := out.Write(buf[:n]); werr != nil {
-				_ = os.Remove(outPath)
-				return "", func() {}, werr
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
 			}
 		}
 		if errors.Is(e, io.EOF) {
-			break
+			return nil
 		}
 		if e != nil {
-			return "", func() {}, fmt.Errorf("%w: %v", ErrDecryptProcess, e)
+			return d.readErr(e)
 		}
 	}
-	return outPath, func() { _ = os.Remove(outPath) }, nil
 }
 
-// decryptKggPureGo prefers keys discovered from tools/KGMusicV3.db.
-func (s *DecryptService) decryptKggPureGo(inPath string) (outPath string, cleanup func(), err error) {
-	work := filepath.Dir(inPath)
-	provider := kgg.TryKeyProviders("", "", work)
-	if provider == nil {
-		provider = kgg.TryKeyProviders(filepath.Join("tools", "KGMusicV3.db"), "", work)
+// openDecoded selects a decoder by extension and validates the input header.
+func (s *DecryptService) openDecoded(inPath string, opts DecryptOptions) (stream *decodedStream, err error) {
+	name := inPath
+	if opts.Entry != "" {
+		name = ArchiveOriginPath(inPath, opts.Entry)
 	}
-	if provider == nil {
-		return "", func() {}, fmt.Errorf("%w: KGMusicV3.db or kgg.key not found", ErrMissingKGGKey)
-	}
-
-	return s.decryptKggWithProvider(inPath, provider)
-}
-
-func (s *DecryptService) decryptKggWithProvider(inPath string, provider kgg.KeyProvider) (outPath string, cleanup func(), err error) {
-	f, err := os.Open(inPath)
-	if err != nil {
-		return "", func() {}, err
+	ext := strings.ToLower(filepath.Ext(name))
+	switch ext {
+	case ".kgm", ".kgma", ".vpr", ".kgg", ".ncm":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedInput, ext)
 	}
 
-	dec, err := kgg.NewDecoder(&kgg.DecoderParams{Reader: f, Path: inPath}, provider)
+	in, err := openDecryptInput(inPath, opts.Entry, opts.Temp)
 	if err != nil {
-		_ = f.Close()
-		switch {
-		case errors.Is(err, kgg.ErrUnsupportedMode):
-			return "", func() {}, fmt.Errorf("%w: %v", ErrUnsupportedInput, err)
-		case errors.Is(err, kgg.ErrKeyNotFound):
-			return "", func() {}, fmt.Errorf("%w: %v", ErrMissingKGGKey, err)
-		default:
-			return "", func() {}, fmt.Errorf("%w: %v", ErrDecryptProcess, err)
-		}
+		return nil, err
 	}
-	// kgg.Decoder owns the underlying file and closes it.
-	defer dec.Close()
-
-	outPath = filepath.Join(os.TempDir(), fmt.Sprintf("kgg_dec_%s.bin", utils.RandHex(8)))
-	out, e := os.Create(outPath)
-	if e != nil {
-		return "", func() {}, e
+	if opts.OnProgress != nil {
+		in.ReadSeeker = &progressReader{ReadSeeker: in.ReadSeeker, total: in.size, onProgress: opts.OnProgress}
 	}
-	defer out.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("decoder panic: %v", r)
+			err = fmt.Errorf("%w: decoder panic: %v", ErrDecryptProcess, r)
+		}
+		if err != nil {
+			_ = in.Close()
+		}
+	}()
 
-	buf := make([]byte, 64*1024)
-	for {
-		n, e := dec.Read(buf)
-		if n > 0 {
-			if _, werr := out.Write(buf[:n]); werr != nil {
-				_ = os.Remove(outPath)
-				return "", func() {}, werr
-			}
+	processErr := func(e error) error { return fmt.Errorf("%w: %v", ErrDecryptProcess, e) }
+	switch ext {
+	case ".kgm", ".kgma", ".vpr":
+		dec := kgm.NewDecoder(&common.DecoderParams{Reader: in})
+		if err := dec.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: invalid KGM/KGMA/VPR: %v", ErrDecryptProcess, err)
 		}
-		if errors.Is(e, io.EOF) {
-			break
+		return &decodedStream{dec: dec, in: in, name: name, readErr: processErr}, nil
+	case ".ncm":
+		dec := ncm.NewDecoder(&common.DecoderParams{
+			Reader:    in,
+			Extension: ext,
+			FilePath:  name,
+			Logger:    noopZapLogger,
+		})
+		if err := dec.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: invalid NCM: %v", ErrDecryptProcess, err)
 		}
-		if e != nil {
-			if errors.Is(e, kgg.ErrKeyNotFound) {
-				return "", func() {}, fmt.Errorf("%w: %v", ErrMissingKGGKey, e)
+		return &decodedStream{dec: dec, in: in, name: name, readErr: processErr}, nil
+	default:
+		provider := opts.KeyProvider
+		if provider == nil {
+			provider = kggKeyProvider(inPath, opts)
+		}
+		if provider == nil {
+			return nil, fmt.Errorf("%w: KGMusicV3.db or kgg.key not found", ErrMissingKGGKey)
+		}
+		dec, err := kgg.NewDecoder(&kgg.DecoderParams{Reader: in}, provider)
+		if err != nil {
+			switch {
+			case errors.Is(err, kgg.ErrUnsupportedMode):
+				return nil, fmt.Errorf("%w: %v", ErrUnsupportedInput, err)
+			case errors.Is(err, kgg.ErrKeyNotFound), errors.Is(err, kgg.ErrKeyMismatch):
+				return nil, fmt.Errorf("%w: %v", ErrMissingKGGKey, err)
+			default:
+				return nil, fmt.Errorf("%w: %v", ErrDecryptProcess, err)
 			}
-			return "", func() {}, fmt.Errorf("%w: %v", ErrDecryptProcess, e)
 		}
+		logger.Debugf("KGG 密钥来源: %s (%s)", dec.KeySource(), filepath.Base(name))
+		return &decodedStream{dec: dec, in: in, name: name, keySource: dec.KeySource(), readErr: func(e error) error {
+			if errors.Is(e, kgg.ErrKeyNotFound) {
+				return fmt.Errorf("%w: %v", ErrMissingKGGKey, e)
+			}
+			return processErr(e)
+		}}, nil
+	}
+}
+
+// progressReader reports how far the decoder has read into the encrypted input,
+// so the ratio against the input size is exact regardless of headers or cover art.
+// Decoders seek back after validating headers; only the furthest position is reported.
+type progressReader struct {
+	io.ReadSeeker
+	pos        int64
+	furthest   int64
+	total      int64
+	onProgress DecryptProgress
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.ReadSeeker.Read(b)
+	p.pos += int64(n)
+	if p.pos > p.furthest {
+		p.furthest = p.pos
+		p.onProgress(p.furthest, p.total)
+	}
+	return n, err
+}
+
+func (p *progressReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := p.ReadSeeker.Seek(offset, whence)
+	if err == nil {
+		p.pos = pos
+	}
+	return pos, err
+}
+
+// validateKGMHeader 只校验 KGM/KGMA/VPR 文件头
+func validateKGMHeader(inPath string) error {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return kgm.NewDecoder(&common.DecoderParams{Reader: in}).Validate()
+}
+
+// kggKeyProvider tries the in-memory key map first, then keys discovered from
+// tools/kgg.key and tools/KGMusicV3.db. Disk sources are cached by path and only
+// read once the earlier candidates fail trial decryption. Returns nil when no
+// source is available.
+func kggKeyProvider(inPath string, opts DecryptOptions) kgg.KeyProvider {
+	var providers []kgg.KeyProvider
+	if len(opts.KeyMap) > 0 {
+		providers = append(providers, kgg.MemoryKeyProvider{Cache: opts.KeyMap, Name: opts.KeyMapSource})
+	}
+	if p := kgg.TryKeyProviders("", "", filepath.Dir(inPath)); p != nil {
+		providers = append(providers, p)
+	}
+	if len(providers) == 0 {
+		return nil
 	}
-	return outPath, func() { _ = os.Remove(outPath) }, nil
+	return kgg.NewCombinedProvider(providers...)
 }
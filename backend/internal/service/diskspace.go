@@ -0,0 +1,204 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// TempUsage 统计本进程当前占用的临时空间 (解密中间文件与解压的压缩包条目)
+var TempUsage = &TempTracker{}
+
+// TempTracker 记录临时文件占用的字节数与峰值；批次使用 TempUsage.Child()，写入同时计入全局统计
+type TempTracker struct {
+	parent *TempTracker
+	cur    atomic.Int64
+	peak   atomic.Int64
+}
+
+func (t *TempTracker) Child() *TempTracker {
+	return &TempTracker{parent: t}
+}
+
+func (t *TempTracker) add(n int64) {
+	for ; t != nil; t = t.parent {
+		v := t.cur.Add(n)
+		for p := t.peak.Load(); v > p && !t.peak.CompareAndSwap(p, v); p = t.peak.Load() {
+		}
+	}
+}
+
+// InUse 返回当前占用的字节数
+func (t *TempTracker) InUse() int64 {
+	return t.cur.Load()
+}
+
+// Peak 返回占用的峰值
+func (t *TempTracker) Peak() int64 {
+	return t.peak.Load()
+}
+
+// trackerOrGlobal 在未指定批次统计时计入全局统计
+func trackerOrGlobal(t *TempTracker) *TempTracker {
+	if t == nil {
+		return TempUsage
+	}
+	return t
+}
+
+// tempWriter 在写入临时文件的同时累计占用
+type tempWriter struct {
+	w    io.Writer
+	temp *TempTracker
+	n    int64
+}
+
+func (w *tempWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	w.temp.add(int64(n))
+	return n, err
+}
+
+// release 在临时文件删除后扣除其占用
+func (w *tempWriter) release() {
+	w.temp.add(-w.n)
+	w.n = 0
+}
+
+// SpaceEstimate 是批次预计需要的临时空间与输出空间 (字节)
+type SpaceEstimate struct {
+	Temp   int64
+	Output int64
+}
+
+// EstimateSpace 按输入大小与输出格式估算所需空间。解密中间文件与输入大小相当，
+// 最多同时存在 concurrency 个；压缩包条目需要额外解压一份。输出大小按格式粗略估计：
+// WAV 未压缩，按输入的 4 倍计算，其余格式按与输入相当计算。
+func EstimateSpace(items []BatchItem, format string, concurrency int) SpaceEstimate {
+	var est SpaceEstimate
+	temps := make([]int64, 0, len(items))
+	for _, item := range items {
+		size := item.Size
+		if size <= 0 {
+			continue
+		}
+		temp := size
+		if item.Entry != "" {
+			temp *= 2
+		}
+		temps = append(temps, temp)
+		if format == "wav" {
+			est.Output += size * 4
+		} else {
+			est.Output += size
+		}
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sort.Slice(temps, func(i, j int) bool { return temps[i] > temps[j] })
+	for i := 0; i < len(temps) && i < concurrency; i++ {
+		est.Temp += temps[i]
+	}
+	return est
+}
+
+// lowSpaceMargin 为剩余空间低于需求加该余量 (或需求的一半) 时给出警告
+const lowSpaceMargin = 512 << 20
+
+// SpaceCheck 是一个磁盘的空间检查结果，Dirs 为位于该磁盘上的临时目录或输出目录
+type SpaceCheck struct {
+	Dirs     []string `json:"dirs"`
+	Required int64    `json:"required"`
+	Free     int64    `json:"free"`
+}
+
+// Insufficient 表示剩余空间不足以完成批次
+func (c SpaceCheck) Insufficient() bool {
+	return c.Free < c.Required
+}
+
+// Low 表示剩余空间够用但余量很小，估算偏低时可能中途写满
+func (c SpaceCheck) Low() bool {
+	margin := c.Required / 2
+	if margin < lowSpaceMargin {
+		margin = lowSpaceMargin
+	}
+	return c.Free < c.Required+margin
+}
+
+// CheckSpace 按磁盘汇总临时目录与输出目录的需求并查询剩余空间；
+// 位于同一磁盘的目录合并计算，无法查询的磁盘不返回结果
+func CheckSpace(tempDir, outputDir string, est SpaceEstimate) []SpaceCheck {
+	var checks []SpaceCheck
+	index := map[string]int{}
+	add := func(dir string, required int64) {
+		if strings.TrimSpace(dir) == "" || required <= 0 {
+			return
+		}
+		free, volume, err := diskUsage(existingParent(dir))
+		if err != nil {
+			return
+		}
+		if i, ok := index[volume]; ok {
+			checks[i].Dirs = append(checks[i].Dirs, dir)
+			checks[i].Required += required
+			return
+		}
+		index[volume] = len(checks)
+		checks = append(checks, SpaceCheck{Dirs: []string{dir}, Required: required, Free: free})
+	}
+	add(tempDir, est.Temp)
+	add(outputDir, est.Output)
+	return checks
+}
+
+// existingParent 返回 dir 或其最近的已存在上级目录，输出目录可能尚未创建
+func existingParent(dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return dir
+	}
+	for {
+		if _, err := os.Stat(abs); err == nil {
+			return abs
+		}
+		parent := filepath.Dir(abs)
+		if parent == abs {
+			return abs
+		}
+		abs = parent
+	}
+}
+
+// IsDiskFull 判断错误是否由磁盘空间不足 (或配额用尽) 引起；ffmpeg 的错误只能按输出文本判断
+func IsDiskFull(err error) bool {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		for _, e := range diskFullErrnos {
+			if errno == e {
+				return true
+			}
+		}
+	}
+	if errors.Is(err, ErrTranscodeProcess) {
+		msg := strings.ToLower(err.Error())
+		return strings.Contains(msg, "no space left on device") || strings.Contains(msg, "not enough space on the disk")
+	}
+	return false
+}
+
+// IsPermissionDenied 判断错误是否由没有读写权限 (EACCES/EPERM) 引起
+func IsPermissionDenied(err error) bool {
+	if errors.Is(err, fs.ErrPermission) {
+		return true
+	}
+	return errors.Is(err, ErrTranscodeProcess) && strings.Contains(strings.ToLower(err.Error()), "permission denied")
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package service
+
+import (
+	"errors"
+	"syscall"
+)
+
+var diskFullErrnos = []syscall.Errno{syscall.ENOSPC}
+
+// errSpaceUnsupported 表示当前平台无法查询磁盘剩余空间，此时跳过预检
+var errSpaceUnsupported = errors.New("disk space query unsupported")
+
+func diskUsage(dir string) (int64, string, error) {
+	return 0, "", errSpaceUnsupported
+}
@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd
+
+package service
+
+import (
+	"fmt"
+	"syscall"
+)
+
+var diskFullErrnos = []syscall.Errno{syscall.ENOSPC, syscall.EDQUOT}
+
+// diskUsage 返回 dir 所在文件系统对当前用户可用的字节数，volume 为设备号，用于合并同一磁盘上的目录
+func diskUsage(dir string) (free int64, volume string, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, "", err
+	}
+	var fi syscall.Stat_t
+	if err := syscall.Stat(dir, &fi); err != nil {
+		return 0, "", err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), fmt.Sprint(fi.Dev), nil
+}
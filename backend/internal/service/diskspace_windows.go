@@ -0,0 +1,29 @@
+//go:build windows
+
+package service
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// ERROR_HANDLE_DISK_FULL (39) 与 ERROR_DISK_FULL (112)
+var diskFullErrnos = []syscall.Errno{39, 112}
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskUsage 返回 dir 所在磁盘对当前用户可用的字节数，volume 为盘符或 UNC 共享名
+func diskUsage(dir string) (free int64, volume string, err error) {
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, "", err
+	}
+	var avail uint64
+	r, _, callErr := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&avail)), 0, 0)
+	if r == 0 {
+		return 0, "", callErr
+	}
+	return int64(avail), strings.ToUpper(filepath.VolumeName(dir)), nil
+}
@@ -0,0 +1,244 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"kugo-music-converter/internal/algo/kgg"
+)
+
+// 重复检测模式：header 只比较文件头中的标识 (KGG 音频哈希、NCM 歌曲 ID)，
+// content 额外解密并比较音频内容的 SHA-256，可以识别 .kgg 与 .kgm 等跨格式重复
+const (
+	DuplicateByHeader  = "header"
+	DuplicateByContent = "content"
+)
+
+// duplicateHeadSize 是评估音质时解密的音频开头长度
+const duplicateHeadSize = 64 << 10
+
+// DuplicateGroup 是被判定为同一首歌的一组文件，Best 为音质最好的文件路径
+type DuplicateGroup struct {
+	Keys  []string        `json:"keys"`
+	Files []DuplicateFile `json:"files"`
+	Best  string          `json:"best"`
+}
+
+// DuplicateFile 是组内单个文件的音质信息，解密失败时 Audio 为空
+type DuplicateFile struct {
+	Path     string     `json:"path"`
+	Size     int64      `json:"size"`
+	Format   string     `json:"format"`
+	Lossless bool       `json:"lossless"`
+	Audio    *AudioInfo `json:"audio,omitempty"`
+	// Bitrate 为估算码率 (kbps)，只在已知时长时给出
+	Bitrate int `json:"bitrate,omitempty"`
+}
+
+// NormalizeDuplicateMode 返回规范化的重复检测模式，空字符串表示不检测
+func NormalizeDuplicateMode(raw string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(raw)); mode {
+	case "", "off", "none", "false":
+		return "", nil
+	case DuplicateByHeader, DuplicateByContent:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("不支持的重复检测模式: %s (可选 header/content)", raw)
+	}
+}
+
+// FindDuplicates 按 KGG 音频哈希、NCM 歌曲 ID 以及 (content 模式下) 解密内容哈希分组，
+// 任一标识相同的文件归为一组；只返回包含两个及以上文件的组。
+func (c *Converter) FindDuplicates(ctx context.Context, paths []string, mode string, p InspectParams) ([]DuplicateGroup, error) {
+	// 同一目录的文件共用一个密钥 provider，内容哈希与音质评估都不再逐个文件重建
+	providers := make(map[string]kgg.KeyProvider)
+	optsFor := func(path string) DecryptOptions {
+		opts := DecryptOptions{KeyMap: p.KeyMap, KeyMapSource: p.KeyMapSource}
+		if !strings.EqualFold(filepath.Ext(path), ".kgg") {
+			return opts
+		}
+		dir := filepath.Dir(path)
+		provider, ok := providers[dir]
+		if !ok {
+			provider = kggKeyProvider(path, opts)
+			providers[dir] = provider
+		}
+		opts.KeyProvider = provider
+		return opts
+	}
+	parent := make([]int, len(paths))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	owner := make(map[string]int)
+	keysOf := make([][]string, len(paths))
+	for i, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		keys := duplicateKeys(path)
+		if mode == DuplicateByContent {
+			if sum, err := c.decrypt.DecryptHash(path, optsFor(path)); err == nil {
+				keys = append(keys, "content:"+sum)
+			}
+		}
+		keysOf[i] = keys
+		for _, key := range keys {
+			if j, ok := owner[key]; ok {
+				parent[find(i)] = find(j)
+				continue
+			}
+			owner[key] = i
+		}
+	}
+
+	members := make(map[int][]int)
+	for i := range paths {
+		root := find(i)
+		members[root] = append(members[root], i)
+	}
+
+	groups := make([]DuplicateGroup, 0)
+	for _, idx := range members {
+		if len(idx) < 2 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var g DuplicateGroup
+		count := make(map[string]int)
+		for _, i := range idx {
+			for _, key := range keysOf[i] {
+				count[key]++
+			}
+			g.Files = append(g.Files, c.describeDuplicate(paths[i], optsFor(paths[i])))
+		}
+		// 只报告组内确实共享的标识
+		for key, n := range count {
+			if n > 1 {
+				g.Keys = append(g.Keys, key)
+			}
+		}
+		sort.Strings(g.Keys)
+		sort.SliceStable(g.Files, func(a, b int) bool { return betterQuality(g.Files[a], g.Files[b]) })
+		g.Best = g.Files[0].Path
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(a, b int) bool { return groups[a].Best < groups[b].Best })
+	return groups, nil
+}
+
+// duplicateKeys 读取文件头中的歌曲标识，读取失败时返回空
+func duplicateKeys(path string) []string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".kgg":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		h, err := kgg.ReadHeader(f)
+		if err != nil || h.AudioHash == "" {
+			return nil
+		}
+		return []string{"kgg:" + strings.ToLower(h.AudioHash)}
+	case ".ncm":
+		info, err := ReadNCMInfo(path)
+		if err != nil || info.MusicID == 0 {
+			return nil
+		}
+		return []string{"ncm:" + strconv.FormatInt(info.MusicID, 10)}
+	}
+	return nil
+}
+
+// describeDuplicate 解密音频开头识别容器与采样参数；NCM 解密失败时回落到元数据中的格式
+func (c *Converter) describeDuplicate(path string, opts DecryptOptions) DuplicateFile {
+	f := DuplicateFile{Path: path, Format: strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")}
+	if st, err := os.Stat(path); err == nil {
+		f.Size = st.Size()
+	}
+
+	var durationMs int64
+	if f.Format == "ncm" {
+		if info, err := ReadNCMInfo(path); err == nil {
+			durationMs = info.DurationMs
+			if info.Format != "" {
+				f.Audio = &AudioInfo{Container: strings.ToLower(info.Format)}
+			}
+		}
+	}
+	if head, err := c.decrypt.DecryptHead(path, opts, duplicateHeadSize); err == nil {
+		if audio, err := ProbeAudioHead(head); audio.Container != "" {
+			f.Audio = &audio
+			if err == nil && audio.DurationMs > 0 {
+				durationMs = audio.DurationMs
+			}
+		}
+	}
+	if f.Audio != nil {
+		f.Lossless = f.Audio.Container == "flac" || f.Audio.Container == "wav"
+	}
+	if durationMs > 0 {
+		f.Bitrate = int(f.Size * 8 / durationMs)
+	}
+	return f
+}
+
+// betterQuality 依次比较无损、位深、采样率、码率与文件大小
+func betterQuality(a, b DuplicateFile) bool {
+	if a.Lossless != b.Lossless {
+		return a.Lossless
+	}
+	var aa, ba AudioInfo
+	if a.Audio != nil {
+		aa = *a.Audio
+	}
+	if b.Audio != nil {
+		ba = *b.Audio
+	}
+	if aa.BitsPerSample != ba.BitsPerSample {
+		return aa.BitsPerSample > ba.BitsPerSample
+	}
+	if aa.SampleRate != ba.SampleRate {
+		return aa.SampleRate > ba.SampleRate
+	}
+	if a.Bitrate != b.Bitrate {
+		return a.Bitrate > b.Bitrate
+	}
+	return a.Size > b.Size
+}
+
+// SelectBestPerGroup 从 items 中去掉每组中非最佳的文件，返回保留与被跳过的条目
+func SelectBestPerGroup(items []BatchItem, groups []DuplicateGroup) (kept, skipped []BatchItem) {
+	drop := make(map[string]struct{})
+	for _, g := range groups {
+		for _, f := range g.Files {
+			if f.Path != g.Best {
+				drop[f.Path] = struct{}{}
+			}
+		}
+	}
+	for _, item := range items {
+		if _, ok := drop[item.Path]; ok {
+			skipped = append(skipped, item)
+			continue
+		}
+		kept = append(kept, item)
+	}
+	return kept, skipped
+}
@@ -0,0 +1,344 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"kugo-music-converter/internal/config"
+)
+
+// 码率模式：vbr 使用各格式自身的质量参数，cbr/abr 使用统一的 Bitrate
+const (
+	RateModeVBR = "vbr"
+	RateModeCBR = "cbr"
+	RateModeABR = "abr"
+)
+
+// TranscodeOptions 汇总输出格式与编码参数，数值 0 表示保持源文件/编码器默认
+type TranscodeOptions struct {
+	Format        string
+	MP3Quality    int // libmp3lame VBR -q:a，取值 0/2/5/7
+	AACBitrate    int // VBR 模式下 AAC 码率 kbps
+	OpusBitrate   int // VBR 模式下 Opus 码率 kbps
+	VorbisQuality int // libvorbis -q:a，取值 0~10
+
+	RateMode        string // vbr/cbr/abr，空值等同 vbr
+	Bitrate         int    // cbr/abr 模式下的目标码率 kbps
+	SampleRate      int    // 目标采样率 Hz
+	Channels        int    // 目标声道数
+	BitDepth        int    // 无损格式的目标位深
+	FLACCompression int    // FLAC 压缩等级 0~12
+
+	// 以下由转换流水线按文件填充，不来自请求参数
+	AudioFilter string            // 额外的 -af 滤镜链，如响度标准化
+	Tags        map[string]string // 额外写入的元数据标签，如 ReplayGain
+}
+
+type bitrateRange struct{ min, max int }
+
+var lossyBitrateRanges = map[string]bitrateRange{
+	"mp3":  {32, 320},
+	"m4a":  {32, 512},
+	"opus": {6, 510},
+	"ogg":  {45, 500},
+}
+
+var validSampleRates = map[int]struct{}{
+	8000: {}, 11025: {}, 12000: {}, 16000: {}, 22050: {}, 24000: {}, 32000: {},
+	44100: {}, 48000: {}, 88200: {}, 96000: {}, 176400: {}, 192000: {},
+}
+
+var opusSampleRates = map[int]struct{}{8000: {}, 12000: {}, 16000: {}, 24000: {}, 48000: {}}
+
+var validBitDepths = map[string][]int{
+	"wav":  {16, 24, 32},
+	"flac": {16, 24},
+	"alac": {16, 24},
+}
+
+func isLosslessFormat(format string) bool {
+	_, ok := validBitDepths[format]
+	return ok
+}
+
+func NormalizeRateMode(raw string) string {
+	return strings.ToLower(strings.TrimSpace(raw))
+}
+
+func (o TranscodeOptions) rateMode() string {
+	if o.RateMode == "" {
+		return RateModeVBR
+	}
+	return o.RateMode
+}
+
+// altersStream 表示参数要求改变音频流本身，此时即使格式相同也必须转码
+func (o TranscodeOptions) altersStream() bool {
+	return o.SampleRate > 0 || o.Channels > 0 || o.BitDepth > 0 || o.rateMode() != RateModeVBR || o.AudioFilter != ""
+}
+
+// Validate 按输出格式校验编码参数组合，错误包装 ErrInvalidEncode
+func (o TranscodeOptions) Validate() error {
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrInvalidEncode, fmt.Sprintf(format, args...))
+	}
+
+	if o.Format == "copy" {
+		if o.altersStream() {
+			return invalid("copy 模式不转码，不能指定码率、采样率、声道或位深")
+		}
+		return nil
+	}
+
+	switch o.rateMode() {
+	case RateModeVBR:
+		if o.Bitrate != 0 {
+			return invalid("bitrate 仅在 cbr/abr 模式下生效")
+		}
+		if msg := o.vbrQualityError(); msg != "" {
+			return invalid("%s", msg)
+		}
+	case RateModeCBR, RateModeABR:
+		if isLosslessFormat(o.Format) {
+			return invalid("%s 为无损格式，不支持 %s 码率模式", o.Format, o.RateMode)
+		}
+		r := lossyBitrateRanges[o.Format]
+		if o.Bitrate < r.min || o.Bitrate > r.max {
+			return invalid("%s 码率需在 %d~%d kbps 之间", o.Format, r.min, r.max)
+		}
+	default:
+		return invalid("未知码率模式 %q，可选 vbr/cbr/abr", o.RateMode)
+	}
+
+	if o.SampleRate != 0 {
+		if _, ok := validSampleRates[o.SampleRate]; !ok {
+			return invalid("不支持的采样率 %d Hz", o.SampleRate)
+		}
+		switch o.Format {
+		case "mp3":
+			if o.SampleRate > 48000 {
+				return invalid("MP3 采样率不能超过 48000 Hz")
+			}
+		case "m4a":
+			if o.SampleRate > 96000 {
+				return invalid("AAC 采样率不能超过 96000 Hz")
+			}
+		case "opus":
+			if _, ok := opusSampleRates[o.SampleRate]; !ok {
+				return invalid("Opus 仅支持 8000/12000/16000/24000/48000 Hz")
+			}
+		}
+	}
+
+	if o.Channels != 0 {
+		if o.Channels < 1 || o.Channels > 8 {
+			return invalid("声道数需在 1~8 之间")
+		}
+		if o.Format == "mp3" && o.Channels > 2 {
+			return invalid("MP3 最多支持 2 声道")
+		}
+	}
+
+	if o.BitDepth != 0 {
+		depths, ok := validBitDepths[o.Format]
+		if !ok {
+			return invalid("%s 为有损格式，不支持指定位深", o.Format)
+		}
+		if !containsInt(depths, o.BitDepth) {
+			return invalid("%s 位深仅支持 %v", o.Format, depths)
+		}
+	}
+
+	if o.FLACCompression < 0 || o.FLACCompression > 12 {
+		return invalid("FLAC 压缩等级需在 0~12 之间")
+	}
+	return nil
+}
+
+// vbrQualityError 校验当前输出格式在 vbr 模式下使用的质量参数，其他格式的质量字段不参与编码，不校验
+func (o TranscodeOptions) vbrQualityError() string {
+	switch o.Format {
+	case "mp3":
+		if _, ok := validMP3Qualities[o.MP3Quality]; !ok {
+			return "MP3 VBR 质量仅支持 0/2/5/7"
+		}
+	case "m4a":
+		if o.AACBitrate != 0 && (o.AACBitrate < 64 || o.AACBitrate > 320) {
+			return "AAC 码率需在 64~320 kbps 之间"
+		}
+	case "opus":
+		if o.OpusBitrate != 0 && (o.OpusBitrate < 32 || o.OpusBitrate > 256) {
+			return "Opus 码率需在 32~256 kbps 之间"
+		}
+	case "ogg":
+		if o.VorbisQuality < 0 || o.VorbisQuality > 10 {
+			return "Vorbis 质量需在 0~10 之间"
+		}
+	}
+	return ""
+}
+
+// EncodeDefaults 取配置默认编码参数中适用于 format 的部分。各项默认值逐一按该格式校验，
+// 不适用的 (如无损格式的 cbr、MP3 的 96000 Hz 采样率) 直接忽略，不会让该格式的请求失败；
+// copy 不经过编码器，不使用任何默认值
+func EncodeDefaults(format string, enc config.EncodeConfig) TranscodeOptions {
+	if format == "copy" {
+		return TranscodeOptions{Format: format}
+	}
+	out := TranscodeOptions{
+		Format:          format,
+		MP3Quality:      defaultMP3Quality,
+		VorbisQuality:   defaultVorbisQuality,
+		FLACCompression: defaultFLACCompression,
+	}
+	apply := func(set func(o *TranscodeOptions)) {
+		candidate := out
+		set(&candidate)
+		if candidate.Validate() == nil {
+			out = candidate
+		}
+	}
+	apply(func(o *TranscodeOptions) { o.MP3Quality = enc.MP3Quality })
+	apply(func(o *TranscodeOptions) { o.AACBitrate = enc.AACBitrate })
+	apply(func(o *TranscodeOptions) { o.OpusBitrate = enc.OpusBitrate })
+	apply(func(o *TranscodeOptions) { o.VorbisQuality = enc.VorbisQuality })
+	apply(func(o *TranscodeOptions) { o.RateMode, o.Bitrate = NormalizeRateMode(enc.RateMode), enc.Bitrate })
+	if out.RateMode == "" {
+		// 码率不适用 (如 vbr 模式下配置了 bitrate) 时仍保留码率模式
+		apply(func(o *TranscodeOptions) { o.RateMode = NormalizeRateMode(enc.RateMode) })
+	}
+	apply(func(o *TranscodeOptions) { o.SampleRate = enc.SampleRate })
+	apply(func(o *TranscodeOptions) { o.Channels = enc.Channels })
+	apply(func(o *TranscodeOptions) { o.BitDepth = enc.BitDepth })
+	apply(func(o *TranscodeOptions) { o.FLACCompression = enc.FLACCompression })
+	return out
+}
+
+// buildEncodeArgs 生成编码相关的 ffmpeg 参数；sourceBits 为源位深，用于避免无损输出被截断
+func buildEncodeArgs(o TranscodeOptions, sourceBits int) []string {
+	bitDepth := o.BitDepth
+	if bitDepth == 0 && sourceBits > 16 && isLosslessFormat(o.Format) {
+		bitDepth = 24
+		if sourceBits > 24 && o.Format == "wav" {
+			bitDepth = 32
+		}
+	}
+
+	movflags := "+faststart"
+	if len(o.Tags) > 0 {
+		// MP4 容器默认丢弃自定义标签
+		movflags += "+use_metadata_tags"
+	}
+
+	var args []string
+	if o.AudioFilter != "" {
+		args = append(args, "-af", o.AudioFilter)
+	}
+	args = append(args, metadataArgs(o.Tags)...)
+
+	switch o.Format {
+	case "wav":
+		codec := "pcm_s16le"
+		switch bitDepth {
+		case 24:
+			codec = "pcm_s24le"
+		case 32:
+			codec = "pcm_s32le"
+		}
+		args = append(args, "-c:a", codec)
+	case "flac":
+		args = append(args, "-c:a", "flac", "-compression_level", fmt.Sprintf("%d", o.FLACCompression))
+		switch bitDepth {
+		case 16:
+			args = append(args, "-sample_fmt", "s16")
+		case 24:
+			args = append(args, "-sample_fmt", "s32", "-bits_per_raw_sample", "24")
+		}
+	case "alac":
+		args = append(args, "-c:a", "alac")
+		switch bitDepth {
+		case 16:
+			args = append(args, "-sample_fmt", "s16p")
+		case 24:
+			args = append(args, "-sample_fmt", "s32p", "-bits_per_raw_sample", "24")
+		}
+		args = append(args, "-c:v", "copy", "-disposition:v", "attached_pic", "-movflags", movflags)
+	case "m4a":
+		bitrate := defaultIfZero(o.AACBitrate, defaultAACBitrate)
+		if o.rateMode() != RateModeVBR {
+			bitrate = o.Bitrate
+		}
+		args = append(args, "-c:a", "aac", "-b:a", fmt.Sprintf("%dk", bitrate),
+			"-c:v", "copy", "-disposition:v", "attached_pic", "-movflags", movflags)
+	case "opus":
+		// Ogg 容器中的封面流会导致 ffmpeg 报错，直接丢弃视频流
+		args = append(args, "-vn", "-c:a", "libopus")
+		switch o.rateMode() {
+		case RateModeCBR:
+			args = append(args, "-b:a", fmt.Sprintf("%dk", o.Bitrate), "-vbr", "off")
+		case RateModeABR:
+			args = append(args, "-b:a", fmt.Sprintf("%dk", o.Bitrate), "-vbr", "constrained")
+		default:
+			args = append(args, "-b:a", fmt.Sprintf("%dk", defaultIfZero(o.OpusBitrate, defaultOpusBitrate)), "-vbr", "on")
+		}
+	case "ogg":
+		args = append(args, "-vn", "-c:a", "libvorbis")
+		switch o.rateMode() {
+		case RateModeCBR:
+			kbps := fmt.Sprintf("%dk", o.Bitrate)
+			args = append(args, "-b:a", kbps, "-minrate", kbps, "-maxrate", kbps)
+		case RateModeABR:
+			args = append(args, "-b:a", fmt.Sprintf("%dk", o.Bitrate))
+		default:
+			args = append(args, "-q:a", fmt.Sprintf("%d", o.VorbisQuality))
+		}
+	default:
+		args = append(args, "-c:a", "libmp3lame")
+		switch o.rateMode() {
+		case RateModeCBR:
+			args = append(args, "-b:a", fmt.Sprintf("%dk", o.Bitrate))
+		case RateModeABR:
+			args = append(args, "-abr", "1", "-b:a", fmt.Sprintf("%dk", o.Bitrate))
+		default:
+			args = append(args, "-q:a", fmt.Sprintf("%d", o.MP3Quality))
+		}
+	}
+
+	if o.SampleRate > 0 {
+		args = append(args, "-ar", fmt.Sprintf("%d", o.SampleRate))
+	}
+	if o.Channels > 0 {
+		args = append(args, "-ac", fmt.Sprintf("%d", o.Channels))
+	}
+	return args
+}
+
+func metadataArgs(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	args := make([]string, 0, len(keys)*2)
+	for _, k := range keys {
+		args = append(args, "-metadata", k+"="+tags[k])
+	}
+	return args
+}
+
+func containsInt(list []int, v int) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultIfZero(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
@@ -3,9 +3,15 @@ package service
 import "errors"
 
 var (
-	ErrUnsupportedInput = errors.New("unsupported input format")
-	ErrMissingKGGKey    = errors.New("kgg key missing")
-	ErrDecryptProcess   = errors.New("decrypt process failed")
-	ErrUnknownAudio     = errors.New("unknown audio format")
-	ErrTranscodeProcess = errors.New("transcode process failed")
+	ErrUnsupportedInput  = errors.New("unsupported input format")
+	ErrUnsupportedOutput = errors.New("unsupported output format")
+	ErrInvalidEncode     = errors.New("invalid encode options")
+	ErrMissingKGGKey     = errors.New("kgg key missing")
+	ErrDecryptProcess    = errors.New("decrypt process failed")
+	ErrUnknownAudio      = errors.New("unknown audio format")
+	ErrTranscodeProcess  = errors.New("transcode process failed")
+	ErrFFmpegUnavailable = errors.New("ffmpeg unavailable")
+	ErrVerifyFailed      = errors.New("output verification failed")
+	ErrPathNotAllowed    = errors.New("path not allowed")
+	ErrQueueFull         = errors.New("conversion queue full")
 )
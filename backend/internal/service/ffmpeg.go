@@ -0,0 +1,185 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const ffmpegProbeTimeout = 10 * time.Second
+
+// FFmpegCapabilities 是对本机 ffmpeg 的探测结果
+type FFmpegCapabilities struct {
+	Path             string    `json:"path"`
+	Available        bool      `json:"available"`
+	Version          string    `json:"version,omitempty"`
+	Encoders         []string  `json:"encoders"`
+	Muxers           []string  `json:"muxers"`
+	SupportedOutputs []string  `json:"supportedOutputs"`
+	Error            string    `json:"error,omitempty"`
+	ProbedAt         time.Time `json:"probedAt"`
+
+	encoders map[string]struct{}
+	muxers   map[string]struct{}
+}
+
+// ProbeFFmpeg 运行 ffmpeg 获取版本、音频编码器与封装器列表；不可执行时 Available 为 false
+func ProbeFFmpeg(ctx context.Context, ffmpegBin string) FFmpegCapabilities {
+	ctx, cancel := context.WithTimeout(ctx, ffmpegProbeTimeout)
+	defer cancel()
+
+	caps := FFmpegCapabilities{Path: ffmpegBin, ProbedAt: time.Now()}
+	versionOut, err := runFFmpegQuery(ctx, ffmpegBin, "-version")
+	if err != nil {
+		caps.Error = err.Error()
+		return caps
+	}
+	caps.Version = parseFFmpegVersion(versionOut)
+
+	encodersOut, err := runFFmpegQuery(ctx, ffmpegBin, "-hide_banner", "-encoders")
+	if err != nil {
+		caps.Error = err.Error()
+		return caps
+	}
+	muxersOut, err := runFFmpegQuery(ctx, ffmpegBin, "-hide_banner", "-muxers")
+	if err != nil {
+		caps.Error = err.Error()
+		return caps
+	}
+
+	caps.Available = true
+	caps.encoders = parseFFmpegEncoders(encodersOut)
+	caps.muxers = parseFFmpegMuxers(muxersOut)
+	caps.Encoders = sortedKeys(caps.encoders)
+	caps.Muxers = sortedKeys(caps.muxers)
+	for _, format := range OutputFormats() {
+		if len(caps.MissingFor(format)) == 0 {
+			caps.SupportedOutputs = append(caps.SupportedOutputs, format)
+		}
+	}
+	return caps
+}
+
+// MissingFor 返回输出格式所需但本机 ffmpeg 缺少的编码器/封装器；copy 不依赖 ffmpeg
+func (c FFmpegCapabilities) MissingFor(format string) []string {
+	spec, ok := outputFormatSpecs[format]
+	if !ok || spec.encoder == "" {
+		return nil
+	}
+	if !c.Available {
+		return []string{"ffmpeg"}
+	}
+	var missing []string
+	if _, ok := c.encoders[spec.encoder]; !ok {
+		missing = append(missing, spec.encoder)
+	}
+	if _, ok := c.muxers[spec.muxer]; !ok {
+		missing = append(missing, spec.muxer)
+	}
+	return missing
+}
+
+// 输出格式当前的可用方式
+const (
+	OutputModeFFmpeg      = "ffmpeg"      // 由 ffmpeg 完整支持
+	OutputModeNative      = "native"      // 无需 ffmpeg：copy，或 FLAC/WAV 源的纯 Go 互转
+	OutputModePassthrough = "passthrough" // 仅当解密结果已是该格式时可直接输出
+)
+
+// OutputAvailability 描述某个输出格式在当前环境下能否使用
+type OutputAvailability struct {
+	Format string `json:"format"`
+	Mode   string `json:"mode"`
+}
+
+// OutputAvailability 按 OutputFormats 顺序列出各输出格式的可用方式
+func (c FFmpegCapabilities) OutputAvailability() []OutputAvailability {
+	formats := OutputFormats()
+	result := make([]OutputAvailability, 0, len(formats))
+	for _, format := range formats {
+		mode := OutputModeFFmpeg
+		switch {
+		case format == "copy":
+			mode = OutputModeNative
+		case len(c.MissingFor(format)) == 0:
+		case format == "flac" || format == "wav":
+			mode = OutputModeNative
+		default:
+			mode = OutputModePassthrough
+		}
+		result = append(result, OutputAvailability{Format: format, Mode: mode})
+	}
+	return result
+}
+
+func runFFmpegQuery(ctx context.Context, ffmpegBin string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, ffmpegBin, args...)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	defer trackFFmpeg()()
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// parseFFmpegVersion 取首行 "ffmpeg version 6.1.1 Copyright ..." 中的版本号
+func parseFFmpegVersion(out string) string {
+	line, _, _ := strings.Cut(out, "\n")
+	fields := strings.Fields(line)
+	if len(fields) >= 3 && fields[1] == "version" {
+		return fields[2]
+	}
+	return strings.TrimSpace(line)
+}
+
+// parseFFmpegEncoders 解析 -encoders 输出，仅保留音频编码器（标志位以 A 开头）
+func parseFFmpegEncoders(out string) map[string]struct{} {
+	result := map[string]struct{}{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	started := false
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if !started {
+			started = len(fields) == 1 && strings.HasPrefix(fields[0], "---")
+			continue
+		}
+		if len(fields) >= 2 && strings.HasPrefix(fields[0], "A") {
+			result[fields[1]] = struct{}{}
+		}
+	}
+	return result
+}
+
+// parseFFmpegMuxers 解析 -muxers 输出，标志位含 E 表示可封装
+func parseFFmpegMuxers(out string) map[string]struct{} {
+	result := map[string]struct{}{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	started := false
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if !started {
+			started = len(fields) == 1 && strings.HasPrefix(fields[0], "--")
+			continue
+		}
+		if len(fields) >= 2 && strings.Contains(fields[0], "E") {
+			for _, name := range strings.Split(fields[1], ",") {
+				result[name] = struct{}{}
+			}
+		}
+	}
+	return result
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
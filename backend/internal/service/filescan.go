@@ -1,23 +1,44 @@
 package service
 
-import (
-	"os"
-	"path/filepath"
-	"sort"
-	"strings"
-	"time"
-)
+import "strings"
 
 type ScanFileInfo struct {
-	Name     string `json:"name"`
-	Ext      string `json:"ext"`
-	Size     int64  `json:"size"`
-	ModTime  string `json:"modTime"`
-	FullPath string `json:"fullPath"`
+	Name     string           `json:"name"`
+	Ext      string           `json:"ext"`
+	Size     int64            `json:"size"`
+	ModTime  string           `json:"modTime"`
+	FullPath string           `json:"fullPath"`
+	Details  *ScanFileDetails `json:"details,omitempty"`
 }
 
+// ScanFileDetails 是扫描时按需附加的可转换性信息，只读取文件头，不做完整解密
+type ScanFileDetails struct {
+	Valid       bool   `json:"valid"`
+	Convertible bool   `json:"convertible"`
+	Reason      string `json:"reason,omitempty"` // 不可转换原因，见 ScanReason* 常量
+
+	// KGG
+	AudioHash    string `json:"audioHash,omitempty"`
+	KeyAvailable bool   `json:"keyAvailable,omitempty"`
+	KeySource    string `json:"keySource,omitempty"`
+
+	// NCM
+	Title   string   `json:"title,omitempty"`
+	Artists []string `json:"artists,omitempty"`
+}
+
+const (
+	ScanReasonUnsupported     = "unsupported_format"
+	ScanReasonInvalidHeader   = "invalid_header"
+	ScanReasonUnsupportedMode = "unsupported_mode"
+	ScanReasonKeyMissing      = "key_missing"
+	ScanReasonKeyMismatch     = "key_mismatch"
+)
+
 type ScanFolderInfo struct {
-	Path  string         `json:"path"`
+	Path string `json:"path"`
+	// Root 为流式扫描时该目录所属的扫描根目录
+	Root  string         `json:"root,omitempty"`
 	Files []ScanFileInfo `json:"files"`
 }
 
@@ -25,6 +46,14 @@ type ScanResult struct {
 	TotalFiles int              `json:"totalFiles"`
 	TotalSize  int64            `json:"totalSize"`
 	Folders    []ScanFolderInfo `json:"folders"`
+	// FilteredOut 是被 convertibleOnly 过滤掉的文件数
+	FilteredOut int             `json:"filteredOut,omitempty"`
+	Errors      []ScanPathError `json:"errors,omitempty"`
+	Truncated   bool            `json:"truncated,omitempty"`
+	// SkippedExisting 是因输出目录中已有结果而跳过的文件数
+	SkippedExisting int `json:"skippedExisting,omitempty"`
+	// Duplicates 是按 duplicates 模式检测到的重复文件分组
+	Duplicates []DuplicateGroup `json:"duplicates,omitempty"`
 }
 
 func ParseExtFilter(raw string) map[string]struct{} {
@@ -48,63 +77,3 @@ func ParseExtFilter(raw string) map[string]struct{} {
 	}
 	return set
 }
-
-func ScanSingleFolder(path string, recursive bool, extFilter map[string]struct{}) ([]ScanFileInfo, int64, error) {
-	abs, err := filepath.Abs(path)
-	if err != nil {
-		return nil, 0, err
-	}
-
-	entries := make([]ScanFileInfo, 0, 32)
-	var totalSize int64
-
-	walkFn := func(current string, d os.DirEntry, walkErr error) error {
-		if walkErr != nil {
-			return nil
-		}
-		if d.IsDir() {
-			if current != abs && !recursive {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-		if !d.Type().IsRegular() {
-			return nil
-		}
-
-		ext := strings.ToLower(filepath.Ext(d.Name()))
-		if extFilter != nil {
-			if _, ok := extFilter[ext]; !ok {
-				return nil
-			}
-		}
-
-		st, err := d.Info()
-		if err != nil {
-			return nil
-		}
-
-		entries = append(entries, ScanFileInfo{
-			Name:     d.Name(),
-			Ext:      ext,
-			Size:     st.Size(),
-			ModTime:  st.ModTime().Format(time.RFC3339),
-			FullPath: current,
-		})
-		totalSize += st.Size()
-		return nil
-	}
-
-	if err := filepath.WalkDir(abs, walkFn); err != nil {
-		return nil, 0, err
-	}
-
-	sort.Slice(entries, func(i, j int) bool {
-		if strings.EqualFold(entries[i].Name, entries[j].Name) {
-			return entries[i].FullPath < entries[j].FullPath
-		}
-		return strings.ToLower(entries[i].Name) < strings.ToLower(entries[j].Name)
-	})
-
-	return entries, totalSize, nil
-}
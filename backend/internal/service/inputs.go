@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 输入路径被跳过的原因；目录展开时的遍历错误沿用 ScanErr* 原因
+const (
+	InputSkipInvalidPath = "invalid_path"
+	InputSkipUnsupported = "unsupported_format"
+	InputSkipNotRegular  = "not_regular"
+	InputSkipDuplicate   = "duplicate"
+)
+
+// ExpandInputOptions 控制输入目录的展开
+type ExpandInputOptions struct {
+	Recursive bool
+	// ExtFilter 为 nil 时使用全部支持的输入格式
+	ExtFilter map[string]struct{}
+	// MaxFiles 达到后停止展开目录；0 表示不限
+	MaxFiles int
+	// Zip 限制 .zip 输入的展开；目录中的 .zip 只有 ExtFilter 包含 .zip 时才会展开
+	Zip ZipLimits
+	// Allow 非空时拒绝允许目录之外的路径，包括目录中指向外部的符号链接
+	Allow *PathAllowlist
+	// Roots 是已知的扫描根目录：直接列出的文件位于其中某个目录之下时，记录最长匹配的根目录，
+	// 使其与目录展开得到的文件一样可以保留目录结构
+	Roots []string
+}
+
+// ExpandInputPaths 把文件与目录混合的输入列表展开为 BatchItem，
+// 不能转换的路径连同原因一起返回，而不是静默忽略。
+func ExpandInputPaths(ctx context.Context, paths []string, opts ExpandInputOptions) ([]BatchItem, []ScanPathError) {
+	filter := opts.ExtFilter
+	if filter == nil {
+		filter = ParseExtFilter(strings.Join(SupportedInputExts, ","))
+	}
+
+	roots := make([]string, 0, len(opts.Roots))
+	for _, r := range opts.Roots {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(r); err == nil {
+			roots = append(roots, abs)
+		}
+	}
+
+	items := make([]BatchItem, 0, len(paths))
+	dropped := make([]ScanPathError, 0)
+	seen := make(map[string]struct{}, len(paths))
+	add := func(path, root string, size int64) {
+		if _, ok := seen[path]; ok {
+			dropped = append(dropped, ScanPathError{Path: path, Root: root, Reason: InputSkipDuplicate})
+			return
+		}
+		seen[path] = struct{}{}
+		if root == "" {
+			root = matchInputRoot(path, roots)
+		}
+		if IsZipInput(path) {
+			entries, skipped := ExpandZip(path, path, opts.Zip)
+			dropped = append(dropped, skipped...)
+			for _, e := range entries {
+				e.Root = root
+				items = append(items, e)
+			}
+			return
+		}
+		if !IsSupportedInput(path) {
+			dropped = append(dropped, ScanPathError{Path: path, Root: root, Reason: InputSkipUnsupported, Detail: filepath.Ext(path)})
+			return
+		}
+		items = append(items, BatchItem{
+			Path:       path,
+			OriginPath: path,
+			Name:       filepath.Base(path),
+			Size:       size,
+			Root:       root,
+		})
+	}
+
+	for _, raw := range paths {
+		trimmed := strings.TrimSpace(raw)
+		if trimmed == "" {
+			continue
+		}
+		abs, err := filepath.Abs(trimmed)
+		if err != nil {
+			dropped = append(dropped, ScanPathError{Path: trimmed, Reason: InputSkipInvalidPath, Detail: err.Error()})
+			continue
+		}
+		if opts.Allow != nil && !opts.Allow.Allows(abs) {
+			dropped = append(dropped, ScanPathError{Path: abs, Reason: ScanErrNotAllowed})
+			continue
+		}
+		st, err := os.Stat(abs)
+		if err != nil {
+			dropped = append(dropped, ScanPathError{Path: abs, Reason: scanErrReason(err), Detail: err.Error()})
+			continue
+		}
+		if st.Mode().IsRegular() {
+			add(abs, "", st.Size())
+			continue
+		}
+		if !st.IsDir() {
+			dropped = append(dropped, ScanPathError{Path: abs, Reason: InputSkipNotRegular})
+			continue
+		}
+
+		scanOpts := ScanOptions{Recursive: opts.Recursive, ExtFilter: filter, Allow: opts.Allow}
+		if opts.MaxFiles > 0 {
+			scanOpts.MaxFiles = opts.MaxFiles - len(items)
+			if scanOpts.MaxFiles <= 0 {
+				break
+			}
+		}
+		var files []ScanFileInfo
+		WalkScanRoots(ctx, []string{abs}, scanOpts, ScanHooks{
+			OnFolder: func(folder ScanFolderInfo) {
+				files = append(files, folder.Files...)
+			},
+			OnError: func(e ScanPathError) {
+				dropped = append(dropped, e)
+			},
+		})
+		SortScanFiles(files)
+		for _, f := range files {
+			add(f.FullPath, abs, f.Size)
+		}
+	}
+
+	for i := range items {
+		items[i].Current = i + 1
+	}
+	return items, dropped
+}
+
+// matchInputRoot 返回包含 path 的最长根目录，没有时返回空
+func matchInputRoot(path string, roots []string) string {
+	best := ""
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if len(root) > len(best) {
+			best = root
+		}
+	}
+	return best
+}
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kugo-music-converter/internal/algo/kgg"
+)
+
+// InspectParams 是文件检查时使用的 KGG 密钥与解密方式
+type InspectParams struct {
+	KeyMap       map[string]string
+	KeyMapSource string
+	// FullDecrypt 为 true 时完整解密一次，以便用 ffmpeg 读取 MP3/M4A 等容器的时长；
+	// 默认只解密开头 inspectHeadSize 字节解析容器头
+	FullDecrypt bool
+}
+
+// inspectHeadSize 是默认检查时解密的音频开头长度，足以覆盖 FLAC STREAMINFO 与 WAV fmt/data 块
+const inspectHeadSize = 64 << 10
+
+// InspectResult 是单个加密文件的诊断信息，用于在不转换的情况下排查用户文件
+type InspectResult struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	Format  string `json:"format"`
+	Decoder string `json:"decoder,omitempty"`
+
+	KGG *KGGInspect `json:"kgg,omitempty"`
+	NCM *NCMInfo    `json:"ncm,omitempty"`
+
+	// Audio 为解密后的容器参数；DurationSource 说明时长来自 container/ffmpeg/ncm-meta
+	Audio          *AudioInfo      `json:"audio,omitempty"`
+	DurationSource string          `json:"durationSource,omitempty"`
+	Error          *BatchFileError `json:"error,omitempty"`
+}
+
+// KGGInspect 是 KGG 文件头与各密钥来源的试解密结果
+type KGGInspect struct {
+	kgg.Header
+	KeyAvailable bool           `json:"keyAvailable"`
+	KeySource    string         `json:"keySource,omitempty"`
+	KeyType      string         `json:"keyType,omitempty"`
+	Keys         []kgg.KeyCheck `json:"keys"`
+}
+
+var inspectDecoders = map[string]string{
+	".kgm":  "unlock-music/kgm",
+	".kgma": "unlock-music/kgm",
+	".vpr":  "unlock-music/kgm",
+	".ncm":  "unlock-music/ncm",
+	".kgg":  "kgg/qmc2",
+}
+
+// Inspect 解析文件头并解密音频开头以识别容器与时长，不写入输出目录；
+// p.FullDecrypt 为 true 时才完整解密。出错时仍返回已得到的部分结果。
+func (c *Converter) Inspect(ctx context.Context, path string, p InspectParams) (InspectResult, error) {
+	result := InspectResult{Path: path}
+	st, err := os.Stat(path)
+	if err != nil {
+		return result, err
+	}
+	if st.IsDir() {
+		return result, fmt.Errorf("%w: %s 是目录", ErrUnsupportedInput, path)
+	}
+	result.Size = st.Size()
+
+	ext := strings.ToLower(filepath.Ext(path))
+	result.Format = strings.TrimPrefix(ext, ".")
+	decoder, ok := inspectDecoders[ext]
+	if !ok {
+		return result, fmt.Errorf("%w: %s", ErrUnsupportedInput, ext)
+	}
+	result.Decoder = decoder
+
+	opts := DecryptOptions{}
+	switch ext {
+	case ".kgg":
+		opts.KeyMap = p.KeyMap
+		opts.KeyMapSource = p.KeyMapSource
+		info, err := inspectKGG(path, opts)
+		result.KGG = info
+		if err != nil {
+			return result, err
+		}
+		if !info.KeyAvailable {
+			if len(info.Keys) == 0 {
+				return result, fmt.Errorf("%w: %s", ErrMissingKGGKey, kgg.ErrKeyNotFound)
+			}
+			return result, fmt.Errorf("%w: %s", ErrMissingKGGKey, kgg.ErrKeyMismatch)
+		}
+	case ".ncm":
+		info, err := ReadNCMInfo(path)
+		if err != nil {
+			return result, err
+		}
+		result.NCM = &info
+	}
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	var audio AudioInfo
+	var probeErr error
+	rawPath := ""
+	if p.FullDecrypt {
+		raw, cleanup, err := c.decrypt.DecryptFile(path, opts)
+		if err != nil {
+			return result, err
+		}
+		defer cleanup()
+		rawPath = raw.Path
+		audio, probeErr = ProbeAudio(raw.Path)
+	} else {
+		head, err := c.decrypt.DecryptHead(path, opts, inspectHeadSize)
+		if err != nil {
+			return result, err
+		}
+		audio, probeErr = ProbeAudioHead(head)
+	}
+	if audio.Container != "" {
+		result.Audio = &audio
+	}
+	if probeErr != nil {
+		return result, probeErr
+	}
+	switch {
+	case audio.Duration > 0:
+		result.DurationSource = "container"
+	case rawPath != "" && c.ffmpegUsable():
+		// 只有开头部分时 ffmpeg 给出的时长不可信，仅对完整解密的文件读取
+		if d := probeDuration(ctx, c.ffmpegBin, rawPath); d > 0 {
+			audio.Duration = d
+			result.DurationSource = "ffmpeg"
+		}
+	}
+	if audio.Duration == 0 && result.NCM != nil && result.NCM.DurationMs > 0 {
+		audio.Duration = time.Duration(result.NCM.DurationMs) * time.Millisecond
+		result.DurationSource = "ncm-meta"
+	}
+	audio.DurationMs = audio.Duration.Milliseconds()
+	result.Audio = &audio
+	return result, nil
+}
+
+// inspectKGG 读取文件头并对每个候选密钥试解密。已加载密钥映射时只检查映射中的密钥，
+// 目录扫描逐个文件调用时不会读取 tools 中的 kgg.key 或解密 KGMusicV3.db
+func inspectKGG(path string, opts DecryptOptions) (*KGGInspect, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h, err := kgg.ReadHeader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid KGG header: %v", ErrDecryptProcess, err)
+	}
+	info := &KGGInspect{Header: h, Keys: []kgg.KeyCheck{}}
+	if h.Mode != 5 {
+		return info, fmt.Errorf("%w: %v: %d", ErrUnsupportedInput, kgg.ErrUnsupportedMode, h.Mode)
+	}
+
+	checks, err := kgg.CheckKeys(f, h, inspectKeyProvider(path, opts))
+	if checks != nil {
+		info.Keys = checks
+	}
+	if err != nil {
+		return info, fmt.Errorf("%w: %v", ErrDecryptProcess, err)
+	}
+	for _, check := range checks {
+		if check.Valid {
+			info.KeyAvailable = true
+			info.KeySource = check.Source
+			info.KeyType = check.Type
+			break
+		}
+	}
+	return info, nil
+}
+
+// inspectKeyProvider 在已加载密钥映射时只返回映射本身，未加载时才使用磁盘上的密钥来源
+func inspectKeyProvider(path string, opts DecryptOptions) kgg.KeyProvider {
+	if len(opts.KeyMap) > 0 {
+		return kgg.MemoryKeyProvider{Cache: opts.KeyMap, Name: opts.KeyMapSource}
+	}
+	return kggKeyProvider(path, opts)
+}
+
+// DescribeScanFile 校验文件头并检查 KGG 密钥可用性、读取 NCM 标题与歌手，供目录扫描使用
+func DescribeScanFile(path string, p InspectParams) *ScanFileDetails {
+	d := &ScanFileDetails{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".kgm", ".kgma", ".vpr":
+		if err := validateKGMHeader(path); err != nil {
+			d.Reason = ScanReasonInvalidHeader
+			return d
+		}
+	case ".ncm":
+		info, err := ReadNCMInfo(path)
+		if err != nil {
+			d.Reason = ScanReasonInvalidHeader
+			return d
+		}
+		d.Title = info.Title
+		d.Artists = info.Artists
+	case ".kgg":
+		info, err := inspectKGG(path, DecryptOptions{KeyMap: p.KeyMap, KeyMapSource: p.KeyMapSource})
+		if info == nil {
+			d.Reason = ScanReasonInvalidHeader
+			return d
+		}
+		d.AudioHash = info.AudioHash
+		switch {
+		case info.Mode != 5:
+			d.Reason = ScanReasonUnsupportedMode
+			return d
+		case err != nil:
+			d.Reason = ScanReasonInvalidHeader
+			return d
+		}
+		d.Valid = true
+		d.KeyAvailable = info.KeyAvailable
+		d.KeySource = info.KeySource
+		if !info.KeyAvailable {
+			d.Reason = ScanReasonKeyMissing
+			if len(info.Keys) > 0 {
+				d.Reason = ScanReasonKeyMismatch
+			}
+			return d
+		}
+	default:
+		d.Reason = ScanReasonUnsupported
+		return d
+	}
+	d.Valid = true
+	d.Convertible = true
+	return d
+}
@@ -0,0 +1,285 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"kugo-music-converter/internal/logger"
+)
+
+// 响度处理模式
+const (
+	LoudnessOff        = "off"
+	LoudnessNormalize  = "normalize"
+	LoudnessReplayGain = "replaygain"
+)
+
+// 专辑增益分组方式
+const (
+	AlbumGroupFolder = "folder"
+	AlbumGroupAlbum  = "album"
+)
+
+// replayGainReference 为 ReplayGain 2.0 参考响度 (LUFS)，r128Reference 为 Opus R128_*_GAIN 参考响度
+const (
+	replayGainReference = -18.0
+	r128Reference       = -23.0
+)
+
+// LoudnessOptions 控制转码前的 EBU R128 测量与后续处理
+type LoudnessOptions struct {
+	Mode       string
+	TargetLUFS float64
+	TruePeak   float64
+	AlbumGroup string
+}
+
+// LoudnessMeasurement 是 ffmpeg loudnorm 分析阶段的输出
+type LoudnessMeasurement struct {
+	IntegratedLUFS float64
+	TruePeakDB     float64
+	LRA            float64
+	Threshold      float64
+	TargetOffset   float64
+	SampleRate     int
+	Album          string
+}
+
+func NormalizeLoudnessMode(raw string) string {
+	v := strings.ToLower(strings.TrimSpace(raw))
+	if v == "" {
+		return LoudnessOff
+	}
+	return v
+}
+
+func (o LoudnessOptions) Enabled() bool {
+	return o.Mode != "" && o.Mode != LoudnessOff
+}
+
+// Validate 校验响度参数与输出格式的组合，错误包装 ErrInvalidEncode
+func (o LoudnessOptions) Validate(format string) error {
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrInvalidEncode, fmt.Sprintf(format, args...))
+	}
+
+	switch o.Mode {
+	case "", LoudnessOff:
+		return nil
+	case LoudnessNormalize:
+		if format == "copy" {
+			return invalid("copy 模式不转码，无法进行响度标准化")
+		}
+		if o.TargetLUFS < -70 || o.TargetLUFS > -5 {
+			return invalid("目标响度需在 -70~-5 LUFS 之间")
+		}
+		if o.TruePeak < -9 || o.TruePeak > 0 {
+			return invalid("真峰值上限需在 -9~0 dBTP 之间")
+		}
+	case LoudnessReplayGain:
+		if format == "wav" {
+			return invalid("WAV 无法写入 ReplayGain 标签")
+		}
+		switch o.AlbumGroup {
+		case "", AlbumGroupFolder, AlbumGroupAlbum:
+		default:
+			return invalid("专辑增益分组仅支持 folder/album")
+		}
+	default:
+		return invalid("未知响度模式 %q，可选 off/normalize/replaygain", o.Mode)
+	}
+	return nil
+}
+
+var (
+	loudnormJSONPattern    = regexp.MustCompile(`(?s)\{[^{}]*"input_i"[^{}]*\}`)
+	albumTagPattern        = regexp.MustCompile(`(?mi)^\s+album\s*:\s*(.+?)\s*$`)
+	inputSampleRatePattern = regexp.MustCompile(`Audio: [^\n]*?(\d+) Hz`)
+)
+
+// MeasureLoudness 运行 loudnorm 分析阶段，获取积分响度、真峰值等测量值
+func MeasureLoudness(ctx context.Context, ffmpegBin, path string, o LoudnessOptions) (LoudnessMeasurement, error) {
+	filter := fmt.Sprintf("loudnorm=I=%.1f:TP=%.1f:LRA=11:print_format=json", o.TargetLUFS, o.TruePeak)
+	stderr, err := runFFmpeg(ctx, ffmpegBin,
+		"-hide_banner", "-nostats", "-loglevel", "info",
+		"-i", path, "-map", "0:a:0", "-af", filter, "-f", "null", "-")
+	if err != nil {
+		return LoudnessMeasurement{}, err
+	}
+
+	raw := loudnormJSONPattern.FindString(stderr)
+	if raw == "" {
+		return LoudnessMeasurement{}, fmt.Errorf("%w: loudnorm 未输出测量结果", ErrTranscodeProcess)
+	}
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+		return LoudnessMeasurement{}, fmt.Errorf("%w: 解析 loudnorm 输出失败: %v", ErrTranscodeProcess, err)
+	}
+
+	parse := func(key string) float64 {
+		v, err := strconv.ParseFloat(strings.TrimSpace(fields[key]), 64)
+		if err != nil {
+			return math.Inf(-1)
+		}
+		return v
+	}
+	m := LoudnessMeasurement{
+		IntegratedLUFS: parse("input_i"),
+		TruePeakDB:     parse("input_tp"),
+		LRA:            parse("input_lra"),
+		Threshold:      parse("input_thresh"),
+		TargetOffset:   parse("target_offset"),
+	}
+	if match := albumTagPattern.FindStringSubmatch(stderr); match != nil {
+		m.Album = match[1]
+	}
+	if match := inputSampleRatePattern.FindStringSubmatch(stderr); match != nil {
+		m.SampleRate, _ = strconv.Atoi(match[1])
+	}
+	return m, nil
+}
+
+// Usable 表示测量值有效；静音文件的积分响度为 -inf，不做增益处理
+func (m LoudnessMeasurement) Usable() bool {
+	return !math.IsInf(m.IntegratedLUFS, 0) && !math.IsNaN(m.IntegratedLUFS) &&
+		!math.IsInf(m.TruePeakDB, 0) && !math.IsNaN(m.TruePeakDB)
+}
+
+// NormalizeFilter 生成 loudnorm 第二遍（线性模式）滤镜；loudnorm 内部上采样到 192kHz，需重采样回目标采样率
+func NormalizeFilter(o LoudnessOptions, m LoudnessMeasurement, sampleRate int) string {
+	filter := fmt.Sprintf(
+		"loudnorm=I=%.1f:TP=%.1f:LRA=11:measured_I=%.2f:measured_TP=%.2f:measured_LRA=%.2f:measured_thresh=%.2f:offset=%.2f:linear=true",
+		o.TargetLUFS, o.TruePeak, m.IntegratedLUFS, m.TruePeakDB, m.LRA, m.Threshold, m.TargetOffset,
+	)
+	if sampleRate <= 0 {
+		sampleRate = m.SampleRate
+	}
+	if sampleRate > 0 {
+		filter += fmt.Sprintf(",aresample=%d", sampleRate)
+	}
+	return filter
+}
+
+// TrackGainTags 根据测量值生成 ReplayGain 单曲标签，Opus 额外写入 R128_TRACK_GAIN
+func TrackGainTags(m LoudnessMeasurement, format string) map[string]string {
+	tags := map[string]string{
+		"REPLAYGAIN_TRACK_GAIN": fmt.Sprintf("%.2f dB", replayGainReference-m.IntegratedLUFS),
+		"REPLAYGAIN_TRACK_PEAK": fmt.Sprintf("%.6f", math.Pow(10, m.TruePeakDB/20)),
+	}
+	if format == "opus" {
+		tags["R128_TRACK_GAIN"] = strconv.Itoa(int(math.Round((r128Reference - m.IntegratedLUFS) * 256)))
+	}
+	return tags
+}
+
+// WriteTags 以流复制方式重新封装文件并写入标签，原文件被替换
+func WriteTags(ctx context.Context, ffmpegBin, path string, tags map[string]string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	ext := filepath.Ext(path)
+	tmp := strings.TrimSuffix(path, ext) + ".tagging" + ext
+
+	args := []string{"-y", "-hide_banner", "-loglevel", "error", "-i", path, "-map", "0", "-c", "copy", "-map_metadata", "0"}
+	args = append(args, metadataArgs(tags)...)
+	if strings.EqualFold(ext, ".m4a") {
+		args = append(args, "-movflags", "+faststart+use_metadata_tags")
+	}
+	args = append(args, tmp)
+
+	if _, err := runFFmpeg(ctx, ffmpegBin, args...); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("%w: 替换标签文件失败: %v", ErrTranscodeProcess, err)
+	}
+	return nil
+}
+
+type albumTrack struct {
+	output string
+	format string
+	m      LoudnessMeasurement
+}
+
+// AlbumGainTracker 收集同一批次内各文件的测量值，批次结束后按专辑/文件夹写入专辑增益
+type AlbumGainTracker struct {
+	group  string
+	mu     sync.Mutex
+	albums map[string][]albumTrack
+}
+
+func NewAlbumGainTracker(group string) *AlbumGainTracker {
+	if group == "" {
+		group = AlbumGroupFolder
+	}
+	return &AlbumGainTracker{group: group, albums: map[string][]albumTrack{}}
+}
+
+// Add 记录一个已成功输出的文件；originPath 用于按文件夹分组
+func (t *AlbumGainTracker) Add(originPath, outputPath, format string, m LoudnessMeasurement) {
+	if t == nil || !m.Usable() {
+		return
+	}
+	key := "dir:" + filepath.Dir(originPath)
+	if t.group == AlbumGroupAlbum && strings.TrimSpace(m.Album) != "" {
+		key = "album:" + strings.ToLower(strings.TrimSpace(m.Album))
+	}
+
+	t.mu.Lock()
+	t.albums[key] = append(t.albums[key], albumTrack{output: outputPath, format: format, m: m})
+	t.mu.Unlock()
+}
+
+// Apply 计算每组的专辑响度（能量平均）与专辑峰值，并写回各输出文件
+func (t *AlbumGainTracker) Apply(ctx context.Context, ffmpegBin string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	keys := make([]string, 0, len(t.albums))
+	for k := range t.albums {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		tracks := t.albums[key]
+		var energy float64
+		peak := math.Inf(-1)
+		for _, tr := range tracks {
+			energy += math.Pow(10, tr.m.IntegratedLUFS/10)
+			peak = math.Max(peak, tr.m.TruePeakDB)
+		}
+		albumLUFS := 10 * math.Log10(energy/float64(len(tracks)))
+
+		for _, tr := range tracks {
+			if ctx.Err() != nil {
+				return
+			}
+			tags := map[string]string{
+				"REPLAYGAIN_ALBUM_GAIN": fmt.Sprintf("%.2f dB", replayGainReference-albumLUFS),
+				"REPLAYGAIN_ALBUM_PEAK": fmt.Sprintf("%.6f", math.Pow(10, peak/20)),
+			}
+			if tr.format == "opus" {
+				tags["R128_ALBUM_GAIN"] = strconv.Itoa(int(math.Round((r128Reference - albumLUFS) * 256)))
+			}
+			if err := WriteTags(ctx, ffmpegBin, tr.output, tags); err != nil {
+				logger.Warnf("写入专辑增益失败: %s: %v", tr.output, err)
+			}
+		}
+	}
+}
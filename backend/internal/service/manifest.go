@@ -0,0 +1,173 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ManifestFileName 是输出目录根部的转换清单，每行一条 JSON 记录
+const ManifestFileName = ".kugo-manifest.jsonl"
+
+// ManifestEntry 记录一个已成功转换的源文件
+type ManifestEntry struct {
+	Source      string `json:"source"`
+	SourceName  string `json:"sourceName"`
+	SourceSize  int64  `json:"sourceSize"`
+	Output      string `json:"output"` // 相对输出目录的路径
+	Format      string `json:"format"`
+	ConvertedAt string `json:"convertedAt"`
+}
+
+var manifestMu sync.Mutex
+
+// AppendManifest 以追加方式写入一条记录，并发转换时串行化写入
+func AppendManifest(outputDir string, e ManifestEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(outputDir, ManifestFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// ReadManifest 读取输出目录中的清单；清单不存在时返回空，损坏的行被跳过
+func ReadManifest(outputDir string) ([]ManifestEntry, error) {
+	f, err := os.Open(filepath.Join(outputDir, ManifestFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []ManifestEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var e ManifestEntry
+		if json.Unmarshal(sc.Bytes(), &e) == nil && e.SourceName != "" {
+			entries = append(entries, e)
+		}
+	}
+	return entries, sc.Err()
+}
+
+// 已存在输出的比对方式
+const (
+	SkipExistingByBaseName = "basename"
+	SkipExistingByManifest = "manifest"
+)
+
+type manifestKey struct {
+	name string
+	size int64
+}
+
+// OutputIndex 用于扫描时排除输出目录中已有结果的源文件
+type OutputIndex struct {
+	mode     string
+	stems    map[string]struct{}
+	manifest map[manifestKey]struct{}
+}
+
+// LoadOutputIndex 按 mode 建立索引：basename 比较输出目录 (含子目录) 中的文件名主干，
+// manifest 比较清单中的源文件名与大小
+func LoadOutputIndex(outputDir, mode string) (*OutputIndex, error) {
+	abs, err := filepath.Abs(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	st, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("%s 不是目录", abs)
+	}
+
+	switch mode {
+	case "", SkipExistingByBaseName:
+		idx := &OutputIndex{mode: SkipExistingByBaseName, stems: make(map[string]struct{})}
+		err := filepath.WalkDir(abs, func(_ string, d fs.DirEntry, walkErr error) error {
+			if walkErr != nil || d.IsDir() || d.Name() == ManifestFileName {
+				return nil
+			}
+			idx.stems[fileStem(d.Name())] = struct{}{}
+			return nil
+		})
+		return idx, err
+	case SkipExistingByManifest:
+		entries, err := ReadManifest(abs)
+		if err != nil {
+			return nil, err
+		}
+		idx := &OutputIndex{mode: mode, manifest: make(map[manifestKey]struct{}, len(entries))}
+		for _, e := range entries {
+			idx.manifest[manifestKey{strings.ToLower(e.SourceName), e.SourceSize}] = struct{}{}
+		}
+		return idx, nil
+	default:
+		return nil, fmt.Errorf("未知的比对方式 %q，可选 basename/manifest", mode)
+	}
+}
+
+// Has 判断源文件是否已有输出
+func (x *OutputIndex) Has(f *ScanFileInfo) bool {
+	if x == nil {
+		return false
+	}
+	if x.mode == SkipExistingByManifest {
+		_, ok := x.manifest[manifestKey{strings.ToLower(f.Name), f.Size}]
+		return ok
+	}
+	_, ok := x.stems[fileStem(f.Name)]
+	return ok
+}
+
+func fileStem(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+}
+
+// ParseScanTime 解析修改时间过滤条件：RFC3339、2006-01-02、2006-01-02 15:04，
+// 或相对当前时间的 7d / 36h 形式
+func ParseScanTime(raw string, now time.Time) (time.Time, error) {
+	s := strings.TrimSpace(raw)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("无法识别的时间 %q，支持 RFC3339、2006-01-02 或 7d/36h", raw)
+}
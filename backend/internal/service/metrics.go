@@ -0,0 +1,218 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kugo-music-converter/internal/algo/kgg"
+)
+
+var (
+	phaseBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+	httpBuckets  = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+)
+
+// 进程级运行指标，由 /metrics 以 Prometheus 文本格式输出
+var (
+	ConversionsTotal = newCounterVec("kugo_conversions_total", "按输入格式、输出格式与结果代码统计的文件转换数", "input_format", "output_format", "code")
+	PhaseDuration    = newHistogramVec("kugo_phase_duration_seconds", "单个文件各转换阶段 (decrypt/analyze/transcode/copy/verify) 的耗时", phaseBuckets, "phase")
+	BytesProcessed   = newCounterVec("kugo_bytes_processed_total", "成功转换的文件读取 (input) 与写出 (output) 的字节数", "direction")
+	DBReloads        = newCounterVec("kugo_db_reloads_total", "KGMusicV3.db 密钥表加载次数")
+	HTTPRequests     = newCounterVec("kugo_http_requests_total", "按路由与状态码统计的 HTTP 请求数", "handler", "code")
+	HTTPDuration     = newHistogramVec("kugo_http_request_duration_seconds", "HTTP 请求耗时 (SSE 与 ZIP 流按整个响应计算)", httpBuckets, "handler")
+
+	metricsOrder = []interface{ write(io.Writer) }{ConversionsTotal, PhaseDuration, BytesProcessed, DBReloads, HTTPRequests, HTTPDuration}
+)
+
+// 手动加载与解密时按需读取 tools/KGMusicV3.db 都经过 kgg.LoadDatabaseKeys，统一在此计数
+func init() {
+	kgg.OnDatabaseLoad = func(string) { DBReloads.Inc() }
+}
+
+// ffmpegProcesses 为当前运行中的 ffmpeg 进程数
+var ffmpegProcesses atomic.Int64
+
+// trackFFmpeg 登记一个 ffmpeg 进程，返回的函数在进程结束后调用
+func trackFFmpeg() func() {
+	ffmpegProcesses.Add(1)
+	return func() { ffmpegProcesses.Add(-1) }
+}
+
+func FFmpegProcesses() int64 {
+	return ffmpegProcesses.Load()
+}
+
+// observePhase 记录从 start 开始的阶段耗时
+func observePhase(phase string, start time.Time) {
+	PhaseDuration.Observe(time.Since(start).Seconds(), phase)
+}
+
+// recordProcessedBytes 累计成功转换文件的源文件大小与输出文件大小
+func recordProcessedBytes(item BatchItem, rawPath, outputPath string) {
+	input := item.Size
+	if input <= 0 {
+		if st, err := os.Stat(rawPath); err == nil {
+			input = st.Size()
+		}
+	}
+	BytesProcessed.Add(float64(input), "input")
+	if st, err := os.Stat(outputPath); err == nil {
+		BytesProcessed.Add(float64(st.Size()), "output")
+	}
+}
+
+// WriteMetrics 按 Prometheus 文本格式写出全部计数器与直方图
+func WriteMetrics(w io.Writer) {
+	for _, m := range metricsOrder {
+		m.write(w)
+	}
+}
+
+// WriteGauge 写出一个无标签的瞬时值，供 /metrics 在采集时汇总调度器、密钥表等状态
+func WriteGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]*counterValue{}}
+}
+
+// Add 为给定标签值的计数器加上 v，标签值顺序与定义一致
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cv := c.values[key]
+	if cv == nil {
+		cv = &counterValue{labels: append([]string(nil), labelValues...)}
+		c.values[key] = cv
+	}
+	cv.value += v
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+		return
+	}
+	for _, key := range metricKeys(c.values) {
+		cv := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, cv.labels, ""), formatFloat(cv.value))
+	}
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogramValue{}}
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv := h.values[key]
+	if hv == nil {
+		hv = &histogramValue{labels: append([]string(nil), labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range metricKeys(h.values) {
+		hv := h.values[key]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, hv.labels, formatFloat(le)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, hv.labels, "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, hv.labels, ""), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, hv.labels, ""), hv.count)
+	}
+}
+
+func metricKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels 生成 {name="value",...}；le 非空时追加直方图的 le 标签
+func formatLabels(names, values []string, le string) string {
+	parts := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(value)))
+	}
+	if le != "" {
+		parts = append(parts, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,395 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+)
+
+// nativeBlockSize 为纯 Go FLAC 编码的每帧采样数
+const nativeBlockSize = 4096
+
+// maxWAVDataSize 为 RIFF 头中 32 位长度字段能表示的最大 data 块长度 (扣除扩展格式头部)，
+// 更大的输出需要 RF64，交给 ffmpeg 处理
+const maxWAVDataSize = math.MaxUint32 - wavExtensibleHeaderSize
+
+const (
+	wavPCMHeaderSize        = 44
+	wavExtensibleHeaderSize = 68
+)
+
+// errWAVTooLarge 表示输出超过标准 WAV 的 4 GiB 上限
+var errWAVTooLarge = fmt.Errorf("%w: 输出超过 WAV 的 4 GiB 上限，需要 ffmpeg", ErrFFmpegUnavailable)
+
+// canConvertNative 判断能否不经 ffmpeg 完成转换：仅限 FLAC 与 WAV 互转且不改变音频流、不写入额外标签
+func canConvertNative(rawAudioExt string, opts TranscodeOptions) bool {
+	if opts.altersStream() || len(opts.Tags) > 0 {
+		return false
+	}
+	return (rawAudioExt == ".flac" && opts.Format == "wav") || (rawAudioExt == ".wav" && opts.Format == "flac")
+}
+
+// ConvertNative 以纯 Go 实现 FLAC↔WAV 转换，仅支持 16/24-bit 整数 PCM 与不超过 4 GiB 的 WAV 输出；onProgress 回报 0~100
+func ConvertNative(ctx context.Context, inputPath, outputPath string, opts TranscodeOptions, onProgress func(percent int)) error {
+	rawAudioExt, err := DetectAudioExt(inputPath)
+	if err != nil {
+		return err
+	}
+	if !canConvertNative(rawAudioExt, opts) {
+		return fmt.Errorf("%w: 纯 Go 模式不支持 %s 转 %s", ErrFFmpegUnavailable, rawAudioExt, opts.Format)
+	}
+	if onProgress == nil {
+		onProgress = func(int) {}
+	}
+
+	if rawAudioExt == ".flac" {
+		err = flacToWAV(ctx, inputPath, outputPath, onProgress)
+	} else {
+		err = wavToFLAC(ctx, inputPath, outputPath, opts.FLACCompression, onProgress)
+	}
+	if err != nil {
+		_ = os.Remove(outputPath)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrFFmpegUnavailable) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrTranscodeProcess, err)
+	}
+	onProgress(100)
+	return nil
+}
+
+func nativeBitsSupported(bits int) bool {
+	return bits == 16 || bits == 24
+}
+
+func flacToWAV(ctx context.Context, inputPath, outputPath string, onProgress func(int)) error {
+	stream, err := flac.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	info := stream.Info
+	bits := int(info.BitsPerSample)
+	channels := int(info.NChannels)
+	if !nativeBitsSupported(bits) {
+		return fmt.Errorf("%w: 纯 Go 模式仅支持 16/24-bit FLAC，当前 %d-bit", ErrFFmpegUnavailable, bits)
+	}
+	bytesPerSample := bits / 8
+	if info.NSamples > 0 && info.NSamples > uint64(maxWAVDataSize/int64(channels*bytesPerSample)) {
+		return errWAVTooLarge
+	}
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := writeWAVHeader(out, channels, int(info.SampleRate), bits, 0); err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(out, 256*1024)
+
+	var dataSize int64
+	var decoded uint64
+	buf := make([]byte, 0, nativeBlockSize*channels*bytesPerSample)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f, err := stream.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		n := int(f.BlockSize)
+		buf = buf[:0]
+		for i := 0; i < n; i++ {
+			for ch := 0; ch < channels; ch++ {
+				s := f.Subframes[ch].Samples[i]
+				if bytesPerSample == 2 {
+					buf = append(buf, byte(s), byte(s>>8))
+				} else {
+					buf = append(buf, byte(s), byte(s>>8), byte(s>>16))
+				}
+			}
+		}
+		// STREAMINFO 可能未记录采样总数，写入过程中再检查一次
+		if dataSize+int64(len(buf)) > maxWAVDataSize {
+			return errWAVTooLarge
+		}
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+		dataSize += int64(len(buf))
+		decoded += uint64(n)
+		if info.NSamples > 0 {
+			onProgress(int(min(decoded, info.NSamples) * 99 / info.NSamples))
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	// 采样总数可能未写入 STREAMINFO，按实际写入长度回填头部
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := writeWAVHeader(out, channels, int(info.SampleRate), bits, dataSize); err != nil {
+		return err
+	}
+	if dataSize%2 == 1 {
+		if _, err := out.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+		if _, err := out.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	return out.Sync()
+}
+
+// wavChannelMasks 为 FLAC 规定的 1~8 声道顺序对应的 WAVE_FORMAT_EXTENSIBLE 声道掩码
+var wavChannelMasks = [...]uint32{0x4, 0x3, 0x7, 0x33, 0x37, 0x3F, 0x70F, 0x63F}
+
+// writeWAVHeader 写入 WAV 头：16-bit 单/双声道使用 44 字节的 WAVE_FORMAT_PCM，
+// 多声道或 24-bit 按规范使用 68 字节的 WAVE_FORMAT_EXTENSIBLE 并写明声道掩码
+func writeWAVHeader(w io.Writer, channels, sampleRate, bits int, dataSize int64) error {
+	if dataSize > maxWAVDataSize {
+		return errWAVTooLarge
+	}
+	if channels < 1 || channels > len(wavChannelMasks) {
+		return fmt.Errorf("unsupported channel count %d", channels)
+	}
+	extensible := channels > 2 || bits > 16
+	size := wavPCMHeaderSize
+	fmtSize := 16
+	if extensible {
+		size = wavExtensibleHeaderSize
+		fmtSize = 40
+	}
+	blockAlign := channels * bits / 8
+	hdr := make([]byte, size)
+	copy(hdr[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(int64(size-8)+dataSize+dataSize%2))
+	copy(hdr[8:12], "WAVE")
+	copy(hdr[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(hdr[16:20], uint32(fmtSize))
+	binary.LittleEndian.PutUint16(hdr[20:22], wavFormatPCM)
+	binary.LittleEndian.PutUint16(hdr[22:24], uint16(channels))
+	binary.LittleEndian.PutUint32(hdr[24:28], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(hdr[28:32], uint32(sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(hdr[32:34], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(hdr[34:36], uint16(bits))
+	if extensible {
+		binary.LittleEndian.PutUint16(hdr[20:22], wavFormatExtensible)
+		binary.LittleEndian.PutUint16(hdr[36:38], 22)
+		binary.LittleEndian.PutUint16(hdr[38:40], uint16(bits))
+		binary.LittleEndian.PutUint32(hdr[40:44], wavChannelMasks[channels-1])
+		// KSDATAFORMAT_SUBTYPE_PCM: 00000001-0000-0010-8000-00aa00389b71
+		copy(hdr[44:60], []byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xaa, 0x00, 0x38, 0x9b, 0x71})
+	}
+	copy(hdr[size-8:size-4], "data")
+	binary.LittleEndian.PutUint32(hdr[size-4:size], uint32(dataSize))
+	_, err := w.Write(hdr)
+	return err
+}
+
+// wavToFLAC 以定阶线性预测 (0~4 阶) 加 Rice 编码压缩每个子帧：子帧以 PredVerbatim 提交，
+// 由编码器的预测分析逐帧选出编码后最小的常量/定阶/原样方式。
+// compression 为 0 时左右声道独立编码，其余等级对双声道逐帧选择声道去相关方式。
+func wavToFLAC(ctx context.Context, inputPath, outputPath string, compression int, onProgress func(int)) error {
+	in, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	br := bufio.NewReaderSize(in, 256*1024)
+	hdr, err := readWAVHeader(br)
+	if err != nil {
+		return err
+	}
+	if !hdr.isIntegerPCM() || !nativeBitsSupported(hdr.bitsPerSample) {
+		return fmt.Errorf("%w: 纯 Go 模式仅支持 16/24-bit 整数 PCM WAV", ErrFFmpegUnavailable)
+	}
+	if hdr.channels < 1 || hdr.channels > 8 {
+		return fmt.Errorf("unsupported channel count %d", hdr.channels)
+	}
+
+	bytesPerSample := hdr.bitsPerSample / 8
+	blockAlign := hdr.channels * bytesPerSample
+	totalSamples := hdr.dataSize / int64(blockAlign)
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	// 成功时由 enc.Close 关闭文件并回填 STREAMINFO
+	closed := false
+	defer func() {
+		if !closed {
+			_ = out.Close()
+		}
+	}()
+
+	info := &meta.StreamInfo{
+		BlockSizeMin:  nativeBlockSize,
+		BlockSizeMax:  nativeBlockSize,
+		SampleRate:    uint32(hdr.sampleRate),
+		NChannels:     uint8(hdr.channels),
+		BitsPerSample: uint8(hdr.bitsPerSample),
+		NSamples:      uint64(totalSamples),
+	}
+	enc, err := flac.NewEncoder(out, info)
+	if err != nil {
+		return err
+	}
+	enc.EnablePredictionAnalysis(true)
+
+	data := io.LimitReader(br, totalSamples*int64(blockAlign))
+	buf := make([]byte, nativeBlockSize*blockAlign)
+	subframes := make([]*frame.Subframe, hdr.channels)
+	var encoded int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(data, buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		samples := n / blockAlign
+		if samples == 0 {
+			break
+		}
+
+		for ch := range subframes {
+			decoded := make([]int32, samples)
+			for i := 0; i < samples; i++ {
+				off := i*blockAlign + ch*bytesPerSample
+				if bytesPerSample == 2 {
+					decoded[i] = int32(int16(binary.LittleEndian.Uint16(buf[off:])))
+				} else {
+					decoded[i] = int32(uint32(buf[off])|uint32(buf[off+1])<<8|uint32(buf[off+2])<<16) << 8 >> 8
+				}
+			}
+			subframes[ch] = &frame.Subframe{
+				SubHeader: frame.SubHeader{Pred: frame.PredVerbatim},
+				Samples:   decoded,
+				NSamples:  samples,
+			}
+		}
+		channels := frame.Channels(hdr.channels - 1)
+		if hdr.channels == 2 && compression > 0 {
+			channels = stereoAssignment(subframes[0].Samples, subframes[1].Samples)
+		}
+		f := &frame.Frame{
+			Header: frame.Header{
+				HasFixedBlockSize: true,
+				BlockSize:         uint16(samples),
+				SampleRate:        uint32(hdr.sampleRate),
+				Channels:          channels,
+				BitsPerSample:     uint8(hdr.bitsPerSample),
+			},
+			Subframes: subframes,
+		}
+		if err := enc.WriteFrame(f); err != nil {
+			return err
+		}
+
+		encoded += int64(samples)
+		if totalSamples > 0 {
+			onProgress(int(encoded * 99 / totalSamples))
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+
+	closed = true
+	return enc.Close()
+}
+
+// stereoAssignment 估算左右、左/差、差/右、中/差四种声道编码方式的残差大小，返回最小的一种。
+// 子帧仍提交左右声道采样，去相关由编码器按返回的方式完成
+func stereoAssignment(left, right []int32) frame.Channels {
+	mid := make([]int32, len(left))
+	side := make([]int32, len(left))
+	for i := range left {
+		mid[i] = int32((int64(left[i]) + int64(right[i])) >> 1)
+		side[i] = left[i] - right[i]
+	}
+	l, r, m, sd := fixedResidualCost(left), fixedResidualCost(right), fixedResidualCost(mid), fixedResidualCost(side)
+
+	best, cost := frame.ChannelsLR, l+r
+	for _, c := range []struct {
+		channels frame.Channels
+		cost     int64
+	}{
+		{frame.ChannelsLeftSide, l + sd},
+		{frame.ChannelsSideRight, sd + r},
+		{frame.ChannelsMidSide, m + sd},
+	} {
+		if c.cost < cost {
+			best, cost = c.channels, c.cost
+		}
+	}
+	return best
+}
+
+// fixedResidualCost 返回 0~4 阶定阶预测中残差绝对值之和的最小值，用作编码大小的估计
+func fixedResidualCost(x []int32) int64 {
+	var sums [5]int64
+	for i := range x {
+		e0 := int64(x[i])
+		sums[0] += abs64(e0)
+		if i < 1 {
+			continue
+		}
+		e1 := e0 - int64(x[i-1])
+		sums[1] += abs64(e1)
+		if i < 2 {
+			continue
+		}
+		e2 := e1 - (int64(x[i-1]) - int64(x[i-2]))
+		sums[2] += abs64(e2)
+		if i < 3 {
+			continue
+		}
+		e3 := e2 - (int64(x[i-1]) - 2*int64(x[i-2]) + int64(x[i-3]))
+		sums[3] += abs64(e3)
+		if i < 4 {
+			continue
+		}
+		e4 := e3 - (int64(x[i-1]) - 3*int64(x[i-2]) + 3*int64(x[i-3]) - int64(x[i-4]))
+		sums[4] += abs64(e4)
+	}
+	return min(sums[0], sums[1], sums[2], sums[3], sums[4])
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestWAV 写出正弦叠加噪声的整数 PCM WAV，返回 data 块内容
+func writeTestWAV(t *testing.T, path string, channels, bits, samples int) []byte {
+	t.Helper()
+	rng := rand.New(rand.NewSource(int64(channels*100 + bits)))
+	bytesPerSample := bits / 8
+	peak := float64(int64(1)<<(bits-1) - 1)
+	data := make([]byte, 0, samples*channels*bytesPerSample)
+	for i := 0; i < samples; i++ {
+		for ch := 0; ch < channels; ch++ {
+			v := 0.6*math.Sin(float64(i)*float64(ch+1)*0.01) + 0.05*(rng.Float64()*2-1)
+			s := int32(v * peak)
+			if bytesPerSample == 2 {
+				data = append(data, byte(s), byte(s>>8))
+			} else {
+				data = append(data, byte(s), byte(s>>8), byte(s>>16))
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeWAVHeader(&buf, channels, 48000, bits, int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// readTestWAV 返回 WAV 的格式码、声道数、位深与 data 块内容
+func readTestWAV(t *testing.T, path string) (wavHeader, []byte) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	hdr, err := readWAVHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, hdr.dataSize)
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+	return hdr, data
+}
+
+func TestNativeWAVFLACRoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		channels    int
+		bits        int
+		compression int
+		formatTag   uint16
+	}{
+		{"16-bit stereo", 2, 16, 5, wavFormatPCM},
+		{"16-bit stereo independent", 2, 16, 0, wavFormatPCM},
+		{"16-bit mono", 1, 16, 5, wavFormatPCM},
+		{"24-bit stereo", 2, 24, 5, wavFormatExtensible},
+		{"24-bit mono odd length", 1, 24, 5, wavFormatExtensible},
+		{"16-bit 5.1", 6, 16, 5, wavFormatExtensible},
+		{"24-bit 7.1", 8, 24, 5, wavFormatExtensible},
+	}
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src.wav")
+			flacPath := filepath.Join(dir, "mid.flac")
+			dst := filepath.Join(dir, "dst.wav")
+			// 采样数不是帧长的整数倍，覆盖最后一个短帧
+			want := writeTestWAV(t, src, tt.channels, tt.bits, 3*nativeBlockSize+1001)
+
+			if err := ConvertNative(ctx, src, flacPath, TranscodeOptions{Format: "flac", FLACCompression: tt.compression}, nil); err != nil {
+				t.Fatalf("wav -> flac: %v", err)
+			}
+			info, err := ProbeAudio(flacPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Channels != tt.channels || info.BitsPerSample != tt.bits || info.SampleRate != 48000 {
+				t.Fatalf("flac info = %+v", info)
+			}
+			if err := ConvertNative(ctx, flacPath, dst, TranscodeOptions{Format: "wav"}, nil); err != nil {
+				t.Fatalf("flac -> wav: %v", err)
+			}
+
+			hdr, got := readTestWAV(t, dst)
+			if hdr.formatTag != tt.formatTag || hdr.channels != tt.channels || hdr.bitsPerSample != tt.bits {
+				t.Errorf("header = %+v, want format %#x, %d ch, %d-bit", hdr, tt.formatTag, tt.channels, tt.bits)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("samples differ after round trip (%d vs %d bytes)", len(got), len(want))
+			}
+			if st, err := os.Stat(dst); err != nil || st.Size()%2 != 0 {
+				t.Errorf("output size not word aligned: %v", err)
+			}
+		})
+	}
+}
+
+func TestWriteWAVHeaderExtensible(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeWAVHeader(&buf, 6, 48000, 24, 1200); err != nil {
+		t.Fatal(err)
+	}
+	hdr := buf.Bytes()
+	if len(hdr) != wavExtensibleHeaderSize {
+		t.Fatalf("header length = %d", len(hdr))
+	}
+	if got := binary.LittleEndian.Uint32(hdr[4:8]); got != wavExtensibleHeaderSize-8+1200 {
+		t.Errorf("RIFF size = %d", got)
+	}
+	if got := binary.LittleEndian.Uint32(hdr[40:44]); got != 0x3F {
+		t.Errorf("channel mask = %#x, want 0x3f", got)
+	}
+	if got := binary.LittleEndian.Uint16(hdr[44:46]); got != wavFormatPCM {
+		t.Errorf("sub format = %#x", got)
+	}
+}
+
+func TestWriteWAVHeaderTooLarge(t *testing.T) {
+	if err := writeWAVHeader(io.Discard, 2, 48000, 16, maxWAVDataSize); err != nil {
+		t.Fatalf("max size: %v", err)
+	}
+	err := writeWAVHeader(io.Discard, 2, 48000, 16, maxWAVDataSize+1)
+	if !errors.Is(err, ErrFFmpegUnavailable) {
+		t.Fatalf("over 4 GiB = %v, want ErrFFmpegUnavailable", err)
+	}
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var (
+	ncmMagic      = []byte("CTENFDAM")
+	ncmMetaPrefix = []byte("163 key(Don't modify):")
+	ncmMetaKey    = []byte{0x23, 0x31, 0x34, 0x6C, 0x6A, 0x6B, 0x5F, 0x21, 0x5C, 0x5D, 0x26, 0x30, 0x55, 0x3C, 0x27, 0x28}
+)
+
+// ncmMaxBlockLen 限制 NCM 头中各分段的长度，防止损坏文件导致超大分配
+const ncmMaxBlockLen = 4 << 20
+
+// NCMInfo 是 NCM 文件头中的内嵌元数据与封面信息
+type NCMInfo struct {
+	MetaType  string          `json:"metaType,omitempty"` // music / dj
+	Meta      json.RawMessage `json:"meta,omitempty"`
+	CoverSize int64           `json:"coverSize"`
+
+	MusicID    int64    `json:"-"`
+	Title      string   `json:"-"`
+	Artists    []string `json:"-"`
+	Album      string   `json:"-"`
+	Format     string   `json:"-"`
+	DurationMs int64    `json:"-"`
+}
+
+type ncmMusicMeta struct {
+	MusicID  json.Number `json:"musicId"`
+	Name     string      `json:"musicName"`
+	Artist   [][]any     `json:"artist"`
+	Album    string      `json:"album"`
+	Format   string      `json:"format"`
+	Duration int64       `json:"duration"`
+}
+
+// ReadNCMInfo 只解析 NCM 文件头，不解密音频数据
+func ReadNCMInfo(path string) (NCMInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return NCMInfo{}, err
+	}
+	defer f.Close()
+
+	var info NCMInfo
+	magic := make([]byte, len(ncmMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || !bytes.Equal(magic, ncmMagic) {
+		return info, fmt.Errorf("%w: invalid NCM magic", ErrUnsupportedInput)
+	}
+	// 2 字节间隔后是 RC4 密钥块，元数据检查用不到，直接跳过
+	if _, err := f.Seek(2, io.SeekCurrent); err != nil {
+		return info, err
+	}
+	keyLen, err := readNCMBlockLen(f)
+	if err != nil {
+		return info, err
+	}
+	if _, err := f.Seek(int64(keyLen), io.SeekCurrent); err != nil {
+		return info, err
+	}
+
+	metaLen, err := readNCMBlockLen(f)
+	if err != nil {
+		return info, err
+	}
+	if metaLen > 0 {
+		raw := make([]byte, metaLen)
+		if _, err := io.ReadFull(f, raw); err != nil {
+			return info, err
+		}
+		if err := info.parseMeta(raw); err != nil {
+			return info, fmt.Errorf("%w: NCM metadata: %v", ErrDecryptProcess, err)
+		}
+	}
+
+	// CRC32 (4) 与 5 字节间隔之后是封面长度
+	if _, err := f.Seek(9, io.SeekCurrent); err != nil {
+		return info, err
+	}
+	coverLen, err := readNCMBlockLen(f)
+	if err != nil {
+		return info, err
+	}
+	info.CoverSize = int64(coverLen)
+	return info, nil
+}
+
+func readNCMBlockLen(r io.Reader) (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	n := binary.LittleEndian.Uint32(b[:])
+	if n > ncmMaxBlockLen {
+		return 0, fmt.Errorf("%w: NCM block too large: %d", ErrDecryptProcess, n)
+	}
+	return n, nil
+}
+
+// parseMeta 解出 "music:{...}" 或 "dj:{...}" 形式的元数据 JSON
+func (info *NCMInfo) parseMeta(raw []byte) error {
+	for i := range raw {
+		raw[i] ^= 0x63
+	}
+	if !bytes.HasPrefix(raw, ncmMetaPrefix) {
+		return errors.New("missing meta prefix")
+	}
+	enc, err := base64.StdEncoding.DecodeString(string(raw[len(ncmMetaPrefix):]))
+	if err != nil {
+		return err
+	}
+	plain, err := aesECBDecrypt(enc, ncmMetaKey)
+	if err != nil {
+		return err
+	}
+	typ, body, ok := bytes.Cut(plain, []byte(":"))
+	if !ok {
+		return errors.New("missing meta type")
+	}
+	info.MetaType = string(typ)
+	info.Meta = json.RawMessage(body)
+
+	var music ncmMusicMeta
+	if info.MetaType == "dj" {
+		var dj struct {
+			MainMusic ncmMusicMeta `json:"mainMusic"`
+		}
+		if err := json.Unmarshal(body, &dj); err != nil {
+			return err
+		}
+		music = dj.MainMusic
+	} else if err := json.Unmarshal(body, &music); err != nil {
+		return err
+	}
+
+	info.MusicID, _ = music.MusicID.Int64()
+	info.Title = music.Name
+	info.Album = music.Album
+	info.Format = music.Format
+	info.DurationMs = music.Duration
+	for _, a := range music.Artist {
+		if len(a) > 0 {
+			if name, ok := a[0].(string); ok && name != "" {
+				info.Artists = append(info.Artists, name)
+			}
+		}
+	}
+	return nil
+}
+
+func aesECBDecrypt(data, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid ciphertext length")
+	}
+	out := make([]byte, len(data))
+	for i := 0; i < len(data); i += aes.BlockSize {
+		block.Decrypt(out[i:i+aes.BlockSize], data[i:i+aes.BlockSize])
+	}
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize || pad > len(out) {
+		return nil, errors.New("invalid padding")
+	}
+	return out[:len(out)-pad], nil
+}
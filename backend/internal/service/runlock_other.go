@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package service
+
+import (
+	"errors"
+	"os"
+)
+
+// lockFile 在不支持文件锁的平台上返回 errors.ErrUnsupported，启动清理不删除其他进程的临时目录
+func lockFile(f *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd
+
+package service
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile 对 f 加非阻塞的 flock 独占锁，已被其他进程持有时返回 errRunDirLocked；
+// 锁随文件关闭或进程退出释放，不依赖 PID，容器间共享临时目录时同样有效
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errRunDirLocked
+	}
+	return err
+}
@@ -0,0 +1,343 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ScanOptions 控制目录遍历范围
+type ScanOptions struct {
+	Recursive bool
+	// MaxDepth 为最大目录层级，根目录为第 1 层；0 表示不限
+	MaxDepth int
+	// MaxFiles 达到后停止遍历并标记 truncated；0 表示不限
+	MaxFiles int
+	// Exclude 为 glob 列表，匹配文件/目录名或相对扫描根目录的路径 (使用 /)
+	Exclude   []string
+	ExtFilter map[string]struct{}
+	// Include 非空时文件须至少匹配一个 glob，规则同 Exclude，不作用于目录
+	Include []string
+	// MinSize/MaxSize 为字节数，0 表示不限；ModifiedAfter/ModifiedBefore 为零值时不限
+	MinSize        int64
+	MaxSize        int64
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+	// Existing 非空时跳过输出目录中已有结果的文件
+	Existing *OutputIndex
+	// Accept 在计数前调用，返回 false 的文件不计入结果
+	Accept func(*ScanFileInfo) bool
+	// Allow 非空时只遍历允许目录之内的路径，指向外部的符号链接报告为 not_allowed
+	Allow *PathAllowlist
+}
+
+// 路径错误原因
+const (
+	ScanErrNotFound     = "not_found"
+	ScanErrNotDirectory = "not_directory"
+	ScanErrPermission   = "permission_denied"
+	ScanErrSymlinkLoop  = "symlink_loop"
+	ScanErrBrokenLink   = "broken_symlink"
+	ScanErrReadFailed   = "read_failed"
+)
+
+// ScanPathError 描述单个路径的扫描失败，不会中断其他路径
+type ScanPathError struct {
+	Path   string `json:"path"`
+	Root   string `json:"root,omitempty"`
+	Reason string `json:"reason"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// ScanStats 是一次遍历的汇总
+type ScanStats struct {
+	Roots           []string `json:"roots"`
+	TotalFiles      int      `json:"totalFiles"`
+	TotalSize       int64    `json:"totalSize"`
+	Dirs            int      `json:"dirs"`
+	Errors          int      `json:"errors"`
+	SkippedExisting int      `json:"skippedExisting"`
+	Truncated       bool     `json:"truncated"`
+	TruncatedReason string   `json:"truncatedReason,omitempty"` // max_files / timeout
+	Cancelled       bool     `json:"cancelled"`
+	DurationMs      int64    `json:"durationMs"`
+}
+
+// ScanHooks 接收遍历过程中的事件；OnFolder 每个含匹配文件的目录调用一次
+type ScanHooks struct {
+	OnFolder   func(ScanFolderInfo)
+	OnError    func(ScanPathError)
+	OnProgress func(ScanStats)
+}
+
+// ValidateScanGlobs 检查 glob 语法，field 用于错误提示
+func ValidateScanGlobs(field string, patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("%s 模式无效 %q: %w", field, p, err)
+		}
+	}
+	return nil
+}
+
+type scanWalker struct {
+	ctx     context.Context
+	opts    ScanOptions
+	hooks   ScanHooks
+	stats   ScanStats
+	visited map[string]struct{}
+	stopped bool
+}
+
+// WalkScanRoots 依次遍历各根目录，跟随符号链接并检测链接环；ctx 取消或超时时提前结束
+func WalkScanRoots(ctx context.Context, roots []string, opts ScanOptions, hooks ScanHooks) ScanStats {
+	start := time.Now()
+	w := &scanWalker{ctx: ctx, opts: opts, hooks: hooks, visited: make(map[string]struct{})}
+	w.stats.Roots = []string{}
+
+	for _, raw := range roots {
+		if w.stop() {
+			break
+		}
+		root := strings.TrimSpace(raw)
+		if root == "" {
+			continue
+		}
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			w.fail(ScanPathError{Path: root, Reason: ScanErrReadFailed, Detail: err.Error()})
+			continue
+		}
+		st, err := os.Stat(abs)
+		if err != nil {
+			w.fail(ScanPathError{Path: abs, Root: abs, Reason: scanErrReason(err), Detail: err.Error()})
+			continue
+		}
+		if !st.IsDir() {
+			w.fail(ScanPathError{Path: abs, Root: abs, Reason: ScanErrNotDirectory})
+			continue
+		}
+		if w.opts.Allow != nil && !w.opts.Allow.Allows(abs) {
+			w.fail(ScanPathError{Path: abs, Root: abs, Reason: ScanErrNotAllowed})
+			continue
+		}
+		w.stats.Roots = append(w.stats.Roots, abs)
+		w.walkDir(abs, abs, 1, nil)
+	}
+
+	if err := ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			w.stats.Truncated = true
+			w.stats.TruncatedReason = "timeout"
+		} else {
+			w.stats.Cancelled = true
+		}
+	}
+	w.stats.DurationMs = time.Since(start).Milliseconds()
+	return w.stats
+}
+
+func (w *scanWalker) stop() bool {
+	if w.stopped {
+		return true
+	}
+	if w.ctx.Err() != nil {
+		w.stopped = true
+	}
+	return w.stopped
+}
+
+func (w *scanWalker) fail(e ScanPathError) {
+	w.stats.Errors++
+	if w.hooks.OnError != nil {
+		w.hooks.OnError(e)
+	}
+}
+
+func matchScanGlobs(patterns []string, name, rel string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// keep 依次应用 include、大小与修改时间过滤
+func (w *scanWalker) keep(name, rel string, info fs.FileInfo) bool {
+	o := &w.opts
+	if len(o.Include) > 0 && !matchScanGlobs(o.Include, name, rel) {
+		return false
+	}
+	if o.MinSize > 0 && info.Size() < o.MinSize {
+		return false
+	}
+	if o.MaxSize > 0 && info.Size() > o.MaxSize {
+		return false
+	}
+	if !o.ModifiedAfter.IsZero() && info.ModTime().Before(o.ModifiedAfter) {
+		return false
+	}
+	if !o.ModifiedBefore.IsZero() && !info.ModTime().Before(o.ModifiedBefore) {
+		return false
+	}
+	return true
+}
+
+// walkDir 先发送本目录的文件再进入子目录；ancestors 为当前链路上各目录的真实路径
+func (w *scanWalker) walkDir(root, dir string, depth int, ancestors []string) {
+	if w.stop() {
+		return
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		w.fail(ScanPathError{Path: dir, Root: root, Reason: scanErrReason(err), Detail: err.Error()})
+		return
+	}
+	for _, a := range ancestors {
+		if a == real {
+			w.fail(ScanPathError{Path: dir, Root: root, Reason: ScanErrSymlinkLoop, Detail: "指向上级目录 " + real})
+			return
+		}
+	}
+	if w.opts.Allow != nil && !w.opts.Allow.Allows(real) {
+		w.fail(ScanPathError{Path: dir, Root: root, Reason: ScanErrNotAllowed, Detail: "指向 " + real})
+		return
+	}
+	// 多个链接指向同一目录时只扫描一次，避免重复计数
+	if _, ok := w.visited[real]; ok {
+		return
+	}
+	w.visited[real] = struct{}{}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		w.fail(ScanPathError{Path: dir, Root: root, Reason: scanErrReason(err), Detail: err.Error()})
+		return
+	}
+	w.stats.Dirs++
+
+	files := make([]ScanFileInfo, 0, 8)
+	var subdirs []string
+	for _, e := range entries {
+		if w.stop() {
+			break
+		}
+		full := filepath.Join(dir, e.Name())
+		rel, _ := filepath.Rel(root, full)
+		if matchScanGlobs(w.opts.Exclude, e.Name(), rel) {
+			continue
+		}
+
+		var info fs.FileInfo
+		if e.Type()&fs.ModeSymlink != 0 {
+			info, err = os.Stat(full)
+			if err != nil {
+				w.fail(ScanPathError{Path: full, Root: root, Reason: ScanErrBrokenLink, Detail: err.Error()})
+				continue
+			}
+			// 目录链接在进入时检查，文件链接在此检查目标
+			if !info.IsDir() && w.opts.Allow != nil && !w.opts.Allow.Allows(full) {
+				w.fail(ScanPathError{Path: full, Root: root, Reason: ScanErrNotAllowed})
+				continue
+			}
+		} else {
+			info, err = e.Info()
+			if err != nil {
+				continue
+			}
+		}
+		if info.IsDir() {
+			subdirs = append(subdirs, full)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if w.opts.ExtFilter != nil {
+			if _, ok := w.opts.ExtFilter[ext]; !ok {
+				continue
+			}
+		}
+		if !w.keep(e.Name(), rel, info) {
+			continue
+		}
+		file := ScanFileInfo{
+			Name:     e.Name(),
+			Ext:      ext,
+			Size:     info.Size(),
+			ModTime:  info.ModTime().Format(time.RFC3339),
+			FullPath: full,
+		}
+		if w.opts.Existing.Has(&file) {
+			w.stats.SkippedExisting++
+			continue
+		}
+		if w.opts.Accept != nil && !w.opts.Accept(&file) {
+			continue
+		}
+		if w.opts.MaxFiles > 0 && w.stats.TotalFiles >= w.opts.MaxFiles {
+			w.stats.Truncated = true
+			w.stats.TruncatedReason = "max_files"
+			w.stopped = true
+			break
+		}
+		files = append(files, file)
+		w.stats.TotalFiles++
+		w.stats.TotalSize += info.Size()
+	}
+
+	if len(files) > 0 && w.hooks.OnFolder != nil {
+		SortScanFiles(files)
+		w.hooks.OnFolder(ScanFolderInfo{Path: dir, Root: root, Files: files})
+	}
+	if w.hooks.OnProgress != nil {
+		w.hooks.OnProgress(w.stats)
+	}
+
+	if !w.opts.Recursive || (w.opts.MaxDepth > 0 && depth >= w.opts.MaxDepth) {
+		return
+	}
+	sort.Strings(subdirs)
+	ancestors = append(ancestors, real)
+	for _, sub := range subdirs {
+		if w.stop() {
+			return
+		}
+		w.walkDir(root, sub, depth+1, ancestors)
+	}
+}
+
+func scanErrReason(err error) string {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return ScanErrNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return ScanErrPermission
+	default:
+		return ScanErrReadFailed
+	}
+}
+
+// SortScanFiles 按文件名 (不区分大小写) 排序，同名时按完整路径
+func SortScanFiles(files []ScanFileInfo) {
+	sort.Slice(files, func(i, j int) bool {
+		if strings.EqualFold(files[i].Name, files[j].Name) {
+			return files[i].FullPath < files[j].FullPath
+		}
+		return strings.ToLower(files[i].Name) < strings.ToLower(files[j].Name)
+	})
+}
@@ -0,0 +1,242 @@
+package service
+
+import (
+	"context"
+	"sync"
+)
+
+// Scheduler 是进程级的转换调度器：所有批次共享 workers 个转换槽位 (每个槽位对应一个文件的解密与转码)，
+// 最多 maxActive 个批次同时运行并轮流分配空闲槽位，其余批次按到达顺序排队，排队数超过 maxQueued 时拒绝。
+type Scheduler struct {
+	mu        sync.Mutex
+	workers   int
+	maxActive int
+	maxQueued int
+	busy      int
+	active    []*BatchTicket
+	queued    []*BatchTicket
+	// next 为轮转分配时下一个优先考虑的运行中批次
+	next int
+}
+
+// SchedulerStats 是调度器的当前状态
+type SchedulerStats struct {
+	Workers       int `json:"workers"`
+	Busy          int `json:"busy"`
+	ActiveBatches int `json:"activeBatches"`
+	QueuedBatches int `json:"queuedBatches"`
+	MaxQueued     int `json:"maxQueued"`
+}
+
+// BatchTicket 是批次在调度器中的登记。批次先 Wait 等待开始运行，每个文件转换前 Acquire、结束后 Release，
+// 批次结束时 Done 释放登记。
+type BatchTicket struct {
+	s *Scheduler
+	// limit 为该批次最多同时占用的槽位数 (请求的并发数)
+	limit   int
+	running int
+	waiters []chan struct{}
+	started chan struct{}
+	// moved 在排队位置变化时收到通知
+	moved chan struct{}
+	done  bool
+}
+
+func NewScheduler(workers, maxActive, maxQueued int) *Scheduler {
+	if workers <= 0 {
+		workers = 1
+	}
+	if maxActive <= 0 {
+		maxActive = 1
+	}
+	if maxQueued < 0 {
+		maxQueued = 0
+	}
+	return &Scheduler{workers: workers, maxActive: maxActive, maxQueued: maxQueued}
+}
+
+// Admit 登记一个最多同时转换 limit 个文件的批次；运行中的批次已满时排队，排队数已达上限时返回 ErrQueueFull
+func (s *Scheduler) Admit(limit int) (*BatchTicket, error) {
+	if limit <= 0 {
+		limit = 1
+	}
+	t := &BatchTicket{s: s, limit: limit, started: make(chan struct{}), moved: make(chan struct{}, 1)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.active) < s.maxActive && len(s.queued) == 0 {
+		s.active = append(s.active, t)
+		close(t.started)
+		return t, nil
+	}
+	if len(s.queued) >= s.maxQueued {
+		return nil, ErrQueueFull
+	}
+	s.queued = append(s.queued, t)
+	return t, nil
+}
+
+func (s *Scheduler) Stats() SchedulerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SchedulerStats{
+		Workers:       s.workers,
+		Busy:          s.busy,
+		ActiveBatches: len(s.active),
+		QueuedBatches: len(s.queued),
+		MaxQueued:     s.maxQueued,
+	}
+}
+
+// Wait 等待批次开始运行；排队期间每次位置变化调用 onQueued (位置从 1 开始)
+func (t *BatchTicket) Wait(ctx context.Context, onQueued func(position int)) error {
+	last := 0
+	for {
+		pos := t.s.position(t)
+		if pos == 0 {
+			return nil
+		}
+		if pos != last && onQueued != nil {
+			onQueued(pos)
+		}
+		last = pos
+		select {
+		case <-t.started:
+			return nil
+		case <-t.moved:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// position 返回排队位置，已开始运行时为 0
+func (s *Scheduler) position(t *BatchTicket) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, q := range s.queued {
+		if q == t {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Acquire 等待一个转换槽位；ctx 结束时放弃等待
+func (t *BatchTicket) Acquire(ctx context.Context) error {
+	s := t.s
+	s.mu.Lock()
+	if s.busy < s.workers && t.running < t.limit {
+		s.busy++
+		t.running++
+		s.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	t.waiters = append(t.waiters, ch)
+	s.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, w := range t.waiters {
+		if w == ch {
+			t.waiters = append(t.waiters[:i], t.waiters[i+1:]...)
+			return ctx.Err()
+		}
+	}
+	// 取消与分配同时发生：已分配的槽位交还给其他批次
+	s.releaseLocked(t)
+	return ctx.Err()
+}
+
+// Run 占用一个槽位执行 fn，用于批次转换前后的重复检测、专辑增益等同样需要解密或 ffmpeg 的工作，
+// 使其受全局槽位数限制；t 为 nil 时直接执行。ctx 结束前未获得槽位时不执行 fn
+func (t *BatchTicket) Run(ctx context.Context, fn func()) error {
+	if t == nil {
+		fn()
+		return nil
+	}
+	if err := t.Acquire(ctx); err != nil {
+		return err
+	}
+	defer t.Release()
+	fn()
+	return nil
+}
+
+func (t *BatchTicket) Release() {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	t.s.releaseLocked(t)
+}
+
+func (s *Scheduler) releaseLocked(t *BatchTicket) {
+	s.busy--
+	t.running--
+	s.dispatchLocked()
+}
+
+// Done 结束批次的登记，让排队中的下一个批次开始运行；可重复调用
+func (t *BatchTicket) Done() {
+	s := t.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.done {
+		return
+	}
+	t.done = true
+	s.active = removeTicket(s.active, t)
+	s.queued = removeTicket(s.queued, t)
+	for len(s.active) < s.maxActive && len(s.queued) > 0 {
+		next := s.queued[0]
+		s.queued = s.queued[1:]
+		s.active = append(s.active, next)
+		close(next.started)
+	}
+	for _, q := range s.queued {
+		select {
+		case q.moved <- struct{}{}:
+		default:
+		}
+	}
+	s.dispatchLocked()
+}
+
+// dispatchLocked 把空闲槽位轮流分配给有等待文件的运行中批次，避免大批次占满全部槽位
+func (s *Scheduler) dispatchLocked() {
+	for s.busy < s.workers && len(s.active) > 0 {
+		granted := false
+		for i := 0; i < len(s.active); i++ {
+			idx := (s.next + i) % len(s.active)
+			t := s.active[idx]
+			if len(t.waiters) == 0 || t.running >= t.limit {
+				continue
+			}
+			close(t.waiters[0])
+			t.waiters = t.waiters[1:]
+			t.running++
+			s.busy++
+			s.next = (idx + 1) % len(s.active)
+			granted = true
+			break
+		}
+		if !granted {
+			return
+		}
+	}
+}
+
+func removeTicket(list []*BatchTicket, t *BatchTicket) []*BatchTicket {
+	for i, q := range list {
+		if q == t {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
@@ -0,0 +1,293 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitWaiters 等待批次登记 n 个等待中的 Acquire
+func waitWaiters(t *testing.T, ticket *BatchTicket, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ticket.s.mu.Lock()
+		got := len(ticket.waiters)
+		ticket.s.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("waiters = %d, want %d", got, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func admit(t *testing.T, s *Scheduler, limit int) *BatchTicket {
+	t.Helper()
+	ticket, err := s.Admit(limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ticket
+}
+
+func TestSchedulerRoundRobin(t *testing.T) {
+	s := NewScheduler(1, 2, 0)
+	a := admit(t, s, 3)
+	b := admit(t, s, 3)
+	ctx := context.Background()
+
+	if err := a.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	granted := make(chan string, 4)
+	acquire := func(ticket *BatchTicket, label string, waiting int) {
+		go func() {
+			if err := ticket.Acquire(ctx); err == nil {
+				granted <- label
+			}
+		}()
+		waitWaiters(t, ticket, waiting)
+	}
+	acquire(a, "a1", 1)
+	acquire(a, "a2", 2)
+	acquire(b, "b1", 1)
+	acquire(b, "b2", 2)
+
+	// 每次释放唯一的槽位，下一个槽位应交给另一个批次，而不是先排完 a 的全部文件
+	tickets := map[string]*BatchTicket{"a1": a, "a2": a, "b1": b, "b2": b}
+	holder := a
+	var order []string
+	for range 4 {
+		holder.Release()
+		label := <-granted
+		order = append(order, label)
+		holder = tickets[label]
+		if st := s.Stats(); st.Busy != 1 {
+			t.Fatalf("busy = %d after granting %s", st.Busy, label)
+		}
+	}
+	holder.Release()
+
+	want := []string{"a1", "b1", "a2", "b2"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("grant order = %v, want %v", order, want)
+		}
+	}
+	if st := s.Stats(); st.Busy != 0 {
+		t.Fatalf("busy = %d after all releases", st.Busy)
+	}
+}
+
+func TestSchedulerBatchLimit(t *testing.T) {
+	s := NewScheduler(2, 2, 0)
+	a := admit(t, s, 1)
+	b := admit(t, s, 1)
+	ctx := context.Background()
+
+	if err := a.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// a 已达并发上限，空闲槽位留给 b
+	done := make(chan struct{})
+	go func() {
+		if err := a.Acquire(ctx); err == nil {
+			close(done)
+		}
+	}()
+	waitWaiters(t, a, 1)
+	if err := b.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Stats(); st.Busy != 2 {
+		t.Fatalf("busy = %d, want 2", st.Busy)
+	}
+	b.Release()
+	select {
+	case <-done:
+		t.Fatal("a exceeded its limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	a.Release()
+	<-done
+	a.Release()
+}
+
+func TestSchedulerQueuePositions(t *testing.T) {
+	s := NewScheduler(1, 1, 2)
+	first := admit(t, s, 1)
+	second := admit(t, s, 1)
+	third := admit(t, s, 1)
+	if _, err := s.Admit(1); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Admit over queue limit = %v, want ErrQueueFull", err)
+	}
+	if st := s.Stats(); st.ActiveBatches != 1 || st.QueuedBatches != 2 {
+		t.Fatalf("stats = %+v", st)
+	}
+
+	positions := make(chan int, 4)
+	waited := make(chan error, 1)
+	go func() {
+		waited <- third.Wait(context.Background(), func(pos int) { positions <- pos })
+	}()
+	if pos := <-positions; pos != 2 {
+		t.Fatalf("initial position = %d, want 2", pos)
+	}
+
+	// 排在前面的批次放弃排队后位置前移
+	second.Done()
+	if pos := <-positions; pos != 1 {
+		t.Fatalf("position after second left = %d, want 1", pos)
+	}
+
+	first.Done()
+	if err := <-waited; err != nil {
+		t.Fatalf("Wait = %v", err)
+	}
+	if st := s.Stats(); st.ActiveBatches != 1 || st.QueuedBatches != 0 {
+		t.Fatalf("stats = %+v", st)
+	}
+	select {
+	case pos := <-positions:
+		t.Fatalf("unexpected position %d after start", pos)
+	default:
+	}
+	third.Done()
+	third.Done()
+	if st := s.Stats(); st.ActiveBatches != 0 {
+		t.Fatalf("stats after Done = %+v", st)
+	}
+}
+
+func TestSchedulerWaitCancelled(t *testing.T) {
+	s := NewScheduler(1, 1, 1)
+	first := admit(t, s, 1)
+	queued := admit(t, s, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := queued.Wait(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Wait = %v, want context.Canceled", err)
+	}
+	queued.Done()
+	first.Done()
+	if st := s.Stats(); st.ActiveBatches != 0 || st.QueuedBatches != 0 {
+		t.Fatalf("stats = %+v", st)
+	}
+}
+
+func TestSchedulerAcquireCancelledWhileWaiting(t *testing.T) {
+	s := NewScheduler(1, 1, 0)
+	a := admit(t, s, 2)
+	if err := a.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- a.Acquire(ctx) }()
+	waitWaiters(t, a, 1)
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Acquire = %v, want context.Canceled", err)
+	}
+	waitWaiters(t, a, 0)
+	if st := s.Stats(); st.Busy != 1 {
+		t.Fatalf("busy = %d, want 1", st.Busy)
+	}
+	a.Release()
+	if st := s.Stats(); st.Busy != 0 {
+		t.Fatalf("busy = %d, want 0", st.Busy)
+	}
+}
+
+// TestSchedulerAcquireCancelledWhileGranted 在持有调度器锁时同时取消等待并分配槽位，
+// 等待方可能走任一分支：取得槽位，或在取消后把已分配的槽位交还给其他批次。
+func TestSchedulerAcquireCancelledWhileGranted(t *testing.T) {
+	handedBack := 0
+	for range 20 {
+		s := NewScheduler(1, 2, 0)
+		a := admit(t, s, 1)
+		b := admit(t, s, 2)
+		if err := b.Acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errA := make(chan error, 1)
+		go func() { errA <- a.Acquire(ctx) }()
+		waitWaiters(t, a, 1)
+		grantedB := make(chan struct{})
+		go func() {
+			if err := b.Acquire(context.Background()); err == nil {
+				close(grantedB)
+			}
+		}()
+		waitWaiters(t, b, 1)
+
+		s.mu.Lock()
+		cancel()
+		s.releaseLocked(b) // 轮转从 a 开始，槽位分配给 a
+		s.mu.Unlock()
+
+		if err := <-errA; err != nil {
+			// 取消分支：a 交还槽位后应立即分配给 b 的等待者
+			handedBack++
+			select {
+			case <-grantedB:
+			case <-time.After(5 * time.Second):
+				t.Fatal("slot was not handed back to the other batch")
+			}
+			if st := s.Stats(); st.Busy != 1 {
+				t.Fatalf("busy = %d after hand-back, want 1", st.Busy)
+			}
+			b.Release()
+		} else {
+			if st := s.Stats(); st.Busy != 1 {
+				t.Fatalf("busy = %d after grant, want 1", st.Busy)
+			}
+			a.Release()
+			<-grantedB
+			b.Release()
+		}
+		if st := s.Stats(); st.Busy != 0 {
+			t.Fatalf("busy = %d at end, want 0", st.Busy)
+		}
+	}
+	if handedBack == 0 {
+		t.Fatal("cancel-while-granted path never taken")
+	}
+	t.Logf("slot handed back in %d/20 runs", handedBack)
+}
+
+func TestBatchTicketRun(t *testing.T) {
+	var nilTicket *BatchTicket
+	ran := false
+	if err := nilTicket.Run(context.Background(), func() { ran = true }); err != nil || !ran {
+		t.Fatalf("nil ticket Run = %v, ran = %v", err, ran)
+	}
+
+	s := NewScheduler(1, 1, 0)
+	ticket := admit(t, s, 1)
+	busy := 0
+	if err := ticket.Run(context.Background(), func() { busy = s.Stats().Busy }); err != nil {
+		t.Fatal(err)
+	}
+	if busy != 1 || s.Stats().Busy != 0 {
+		t.Fatalf("busy during Run = %d, after = %d", busy, s.Stats().Busy)
+	}
+
+	// 槽位被占满且 ctx 已结束时不执行
+	if err := ticket.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ran = false
+	if err := ticket.Run(ctx, func() { ran = true }); !errors.Is(err, context.Canceled) || ran {
+		t.Fatalf("Run with cancelled ctx = %v, ran = %v", err, ran)
+	}
+	ticket.Release()
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kugo-music-converter/internal/logger"
+	"kugo-music-converter/internal/utils"
+)
+
+// tempRunPrefix 是每个进程专属临时子目录的前缀，目录名为 kugo-run-<pid>-<随机数>
+const tempRunPrefix = "kugo-run-"
+
+// runLockName 是临时子目录中的锁文件名；进程运行期间持有其独占锁，启动清理只删除能加锁的目录
+const runLockName = ".lock"
+
+var errRunDirLocked = errors.New("temp dir is locked by another process")
+
+// runLock 为本进程临时子目录的锁文件，RemoveTempDir 时关闭
+var runLock *os.File
+
+// staleTempAge 为旧版本直接写在临时目录中的文件被视为遗留的最短时间；
+// 无法判断这些文件属于哪个进程，只清理足够旧的
+const staleTempAge = 24 * time.Hour
+
+// legacyTempPatterns 列出旧版本直接写在临时目录中的文件与目录
+func legacyTempPatterns() []string {
+	patterns := []string{"kgg-upload-*", "kgg-zip-*", "kgdb_dec_*.sqlite", "kugo-job-*"}
+	for _, ext := range SupportedInputExts {
+		patterns = append(patterns, strings.TrimPrefix(ext, ".")+"_dec_*.bin")
+	}
+	return patterns
+}
+
+// InitTempDir 在 base (为空时为系统临时目录) 下创建本进程专属的子目录并设为临时目录，
+// 上传文件、解密中间文件、解密后的数据库与 ZIP 任务目录都写在其中。
+// 同时清理已退出进程遗留的子目录 (其锁文件可以加锁)，以及旧版本留下的超过一天的临时文件。
+func InitTempDir(base string) (string, error) {
+	base = strings.TrimSpace(base)
+	if base == "" {
+		base = os.TempDir()
+	}
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(base, 0o700); err != nil {
+		return "", err
+	}
+	sweepStaleTemp(base)
+
+	dir, err := os.MkdirTemp(base, fmt.Sprintf("%s%d-", tempRunPrefix, os.Getpid()))
+	if err != nil {
+		return "", err
+	}
+	lock, err := createRunLock(dir)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	runLock = lock
+	utils.SetTempDir(dir)
+	return dir, nil
+}
+
+// createRunLock 创建并锁定 dir 中的锁文件；平台不支持文件锁时只创建文件
+func createRunLock(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, runLockName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		_ = f.Close()
+		return nil, fmt.Errorf("锁定临时目录失败: %w", err)
+	}
+	return f, nil
+}
+
+// runDirStale 判断其他进程的临时子目录能否删除：能对锁文件加锁说明持有者已退出。
+// 没有锁文件的目录可能正在创建，只在超过 staleTempAge 后删除；平台不支持文件锁时不删除
+func runDirStale(dir string, modTime time.Time) bool {
+	f, err := os.OpenFile(filepath.Join(dir, runLockName), os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return time.Since(modTime) >= staleTempAge
+	}
+	if err != nil {
+		return false
+	}
+	// 在删除前关闭，Windows 上无法删除仍打开的文件
+	defer f.Close()
+	return lockFile(f) == nil
+}
+
+// RemoveTempDir 删除本进程的临时目录，在正常退出时调用
+func RemoveTempDir() {
+	dir := utils.TempDir()
+	if !strings.HasPrefix(filepath.Base(dir), tempRunPrefix) {
+		return
+	}
+	if runLock != nil {
+		_ = runLock.Close()
+		runLock = nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		logger.Warnf("删除临时目录失败: %v", err)
+	}
+	utils.SetTempDir("")
+}
+
+// sweepStaleTemp 删除进程已退出的 kugo-run-* 目录与过期的旧版本临时文件。
+// 是否退出由目录中的锁文件判断而不是 PID：多个容器共享临时目录时各自的服务都是 PID 1
+func sweepStaleTemp(base string) {
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return
+	}
+	removed := 0
+	var freed int64
+	remove := func(path string) {
+		size := pathSize(path)
+		if err := os.RemoveAll(path); err != nil {
+			logger.Warnf("清理遗留临时文件失败: %v", err)
+			return
+		}
+		removed++
+		freed += size
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, tempRunPrefix) && entry.IsDir() {
+			if info, err := entry.Info(); err == nil && runDirStale(filepath.Join(base, name), info.ModTime()) {
+				remove(filepath.Join(base, name))
+			}
+			continue
+		}
+		if !matchesAny(name, legacyTempPatterns()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleTempAge {
+			continue
+		}
+		remove(filepath.Join(base, name))
+	}
+	if removed > 0 {
+		logger.Infof("已清理 %d 个遗留临时文件，释放 %s", removed, utils.FormatBytes(freed))
+	}
+}
+
+func matchesAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pathSize 返回文件或目录中所有文件的总大小
+func pathSize(path string) int64 {
+	var total int64
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// TempDirStats 是本进程临时目录的占用情况
+type TempDirStats struct {
+	Dir string `json:"dir"`
+	// UsedBytes 为目录中所有文件 (含上传文件与 ZIP 任务目录) 的实际大小
+	UsedBytes int64 `json:"usedBytes"`
+	// ActiveBytes/PeakBytes 为转换过程中解密中间文件与解压条目的当前占用与峰值
+	ActiveBytes int64 `json:"activeBytes"`
+	PeakBytes   int64 `json:"peakBytes"`
+	// FreeBytes 为所在磁盘的剩余空间，无法查询时为 -1
+	FreeBytes int64 `json:"freeBytes"`
+}
+
+func CurrentTempStats() TempDirStats {
+	dir := utils.TempDir()
+	stats := TempDirStats{
+		Dir:         dir,
+		UsedBytes:   pathSize(dir),
+		ActiveBytes: TempUsage.InUse(),
+		PeakBytes:   TempUsage.Peak(),
+		FreeBytes:   -1,
+	}
+	if free, _, err := diskUsage(dir); err == nil {
+		stats.FreeBytes = free
+	}
+	return stats
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweepStaleTempUsesRunLock(t *testing.T) {
+	base := t.TempDir()
+	mkdir := func(name string) string {
+		dir := filepath.Join(base, name)
+		if err := os.Mkdir(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	// 与本进程 PID 相同但锁仍被持有 (如另一个容器中的 PID 1)，不能删除
+	live := mkdir(tempRunPrefix + "1-live")
+	lock, err := createRunLock(live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	probe, err := os.Open(filepath.Join(live, runLockName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockErr := lockFile(probe)
+	probe.Close()
+	if errors.Is(lockErr, errors.ErrUnsupported) {
+		t.Skip("file locks are not supported on this platform")
+	}
+
+	// 持有者已退出：锁文件存在但可以加锁
+	dead := mkdir(tempRunPrefix + "1-dead")
+	deadLock, err := createRunLock(dead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLock.Close()
+
+	// 没有锁文件：刚创建的保留，超过 staleTempAge 的删除
+	fresh := mkdir(tempRunPrefix + "2-fresh")
+	old := mkdir(tempRunPrefix + "3-old")
+	past := time.Now().Add(-staleTempAge - time.Hour)
+	if err := os.Chtimes(old, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	sweepStaleTemp(base)
+
+	for dir, want := range map[string]bool{live: true, dead: false, fresh: true, old: false} {
+		_, err := os.Stat(dir)
+		if exists := err == nil; exists != want {
+			t.Errorf("%s exists = %v, want %v", filepath.Base(dir), exists, want)
+		}
+	}
+}
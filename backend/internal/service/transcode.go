@@ -1,6 +1,7 @@
 package service
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"fmt"
@@ -8,26 +9,87 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var validMP3Qualities = map[int]struct{}{0: {}, 2: {}, 5: {}, 7: {}}
 
-func NormalizeOutputFormat(raw string) string {
+const (
+	defaultMP3Quality      = 2
+	defaultAACBitrate      = 256
+	defaultOpusBitrate     = 160
+	defaultVorbisQuality   = 6
+	defaultFLACCompression = 5
+)
+
+// outputFormatSpec 描述输出格式对应的扩展名、ffmpeg 编码器与封装器
+type outputFormatSpec struct {
+	ext     string
+	encoder string
+	muxer   string
+}
+
+var outputFormatSpecs = map[string]outputFormatSpec{
+	"mp3":  {ext: ".mp3", encoder: "libmp3lame", muxer: "mp3"},
+	"flac": {ext: ".flac", encoder: "flac", muxer: "flac"},
+	"wav":  {ext: ".wav", encoder: "pcm_s16le", muxer: "wav"},
+	"m4a":  {ext: ".m4a", encoder: "aac", muxer: "ipod"},
+	"alac": {ext: ".m4a", encoder: "alac", muxer: "ipod"},
+	"opus": {ext: ".opus", encoder: "libopus", muxer: "opus"},
+	"ogg":  {ext: ".ogg", encoder: "libvorbis", muxer: "ogg"},
+	"copy": {},
+}
+
+var outputFormatAliases = map[string]string{
+	"aac":    "m4a",
+	"vorbis": "ogg",
+}
+
+// OutputFormats 按界面展示顺序返回全部可选输出格式
+func OutputFormats() []string {
+	return []string{"mp3", "flac", "wav", "m4a", "alac", "opus", "ogg", "copy"}
+}
+
+// NormalizeOutputFormat 校验输出格式，空值默认为 mp3，未知格式返回 ErrUnsupportedOutput
+func NormalizeOutputFormat(raw string) (string, error) {
 	v := strings.ToLower(strings.TrimSpace(raw))
-	switch v {
-	case "mp3", "flac", "wav", "copy":
-		return v
-	default:
-		return "mp3"
+	if v == "" {
+		return "mp3", nil
+	}
+	if alias, ok := outputFormatAliases[v]; ok {
+		v = alias
 	}
+	if _, ok := outputFormatSpecs[v]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedOutput, raw)
+	}
+	return v, nil
 }
 
-func NormalizeMP3Quality(raw int) int {
-	if _, ok := validMP3Qualities[raw]; ok {
-		return raw
+// OutputExt 返回输出格式对应的文件扩展名，copy 返回空串
+func OutputExt(format string) string {
+	return outputFormatSpecs[format].ext
+}
+
+// passthroughCodecs 列出同一扩展名可承载多种编码的输出格式：.m4a 可能是 AAC 或 ALAC，
+// .ogg 可能是 Vorbis 或 Opus，直出前须确认实际编码与所选格式一致
+var passthroughCodecs = map[string]string{
+	"m4a":  "aac",
+	"alac": "alac",
+	"ogg":  "vorbis",
+}
+
+// canPassthrough 判断解密结果是否已是目标格式，可直接复制而无需转码
+func canPassthrough(rawPath, rawAudioExt string, opts TranscodeOptions) bool {
+	if opts.altersStream() || !strings.EqualFold(rawAudioExt, OutputExt(opts.Format)) {
+		return false
+	}
+	if codec, ok := passthroughCodecs[opts.Format]; ok {
+		return detectAudioCodec(rawPath, rawAudioExt) == codec
 	}
-	return 2
+	return true
 }
 
 func DetectAudioExt(path string) (string, error) {
@@ -42,8 +104,11 @@ func DetectAudioExt(path string) (string, error) {
 	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return "", err
 	}
-	head = head[:n]
+	return detectAudioHeader(head[:n])
+}
 
+// detectAudioHeader 根据前 12 字节识别容器类型
+func detectAudioHeader(head []byte) (string, error) {
 	switch {
 	case bytes.HasPrefix(head, []byte("fLaC")):
 		return ".flac", nil
@@ -55,13 +120,15 @@ func DetectAudioExt(path string) (string, error) {
 		return ".wav", nil
 	case bytes.HasPrefix(head, []byte("OggS")):
 		return ".ogg", nil
+	case len(head) >= 8 && bytes.Equal(head[4:8], []byte("ftyp")):
+		return ".m4a", nil
 	default:
 		return "", fmt.Errorf("%w: unknown audio header", ErrUnknownAudio)
 	}
 }
 
 func BuildOutputPath(outputDir, baseName, outputFormat string) string {
-	return filepath.Join(outputDir, fmt.Sprintf("%s.%s", baseName, outputFormat))
+	return filepath.Join(outputDir, baseName+OutputExt(outputFormat))
 }
 
 func CopyFile(src, dst string) error {
@@ -83,32 +150,165 @@ func CopyFile(src, dst string) error {
 	return out.Sync()
 }
 
-func TranscodeToFormat(ctx context.Context, ffmpegBin, inputPath, outputPath, outputFormat string, mp3Quality int) error {
-	format := NormalizeOutputFormat(outputFormat)
+// TranscodeToFormat 调用 ffmpeg 转码；onProgress 可为 nil，否则按 out_time/时长回报 0~100 的百分比
+func TranscodeToFormat(ctx context.Context, ffmpegBin, inputPath, outputPath string, opts TranscodeOptions, onProgress func(percent int)) error {
+	format, err := NormalizeOutputFormat(opts.Format)
+	if err != nil {
+		return err
+	}
+	if format == "copy" {
+		return fmt.Errorf("%w: copy 不需要转码", ErrUnsupportedOutput)
+	}
+	opts.Format = format
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	sourceBits := 0
+	var duration time.Duration
+	if info, err := ProbeAudio(inputPath); err == nil {
+		sourceBits = info.BitsPerSample
+		duration = info.Duration
+	}
+	if opts.BitDepth != 0 || !isLosslessFormat(format) {
+		sourceBits = 0
+	}
+
 	args := []string{"-y", "-hide_banner", "-loglevel", "error", "-i", inputPath, "-map_metadata", "0"}
+	args = append(args, buildEncodeArgs(opts, sourceBits)...)
+	args = append(args, outputPath)
 
-	switch format {
-	case "wav":
-		args = append(args, "-c:a", "pcm_s16le", outputPath)
-	case "flac":
-		args = append(args, "-c:a", "flac", outputPath)
-	default:
-		args = append(args, "-q:a", fmt.Sprintf("%d", NormalizeMP3Quality(mp3Quality)), outputPath)
+	if onProgress == nil {
+		if _, err := runFFmpeg(ctx, ffmpegBin, args...); err != nil {
+			return err
+		}
+	} else {
+		if duration <= 0 {
+			duration = probeDuration(ctx, ffmpegBin, inputPath)
+		}
+		if err := runFFmpegProgress(ctx, ffmpegBin, duration, onProgress, args...); err != nil {
+			return err
+		}
 	}
 
+	if _, err := os.Stat(outputPath); err != nil {
+		return fmt.Errorf("%w: ffmpeg output missing", ErrTranscodeProcess)
+	}
+	return nil
+}
+
+// runFFmpeg 执行 ffmpeg 并返回 stderr 输出，失败时错误包装 ErrTranscodeProcess
+func runFFmpeg(ctx context.Context, ffmpegBin string, args ...string) (string, error) {
 	cmd := exec.CommandContext(ctx, ffmpegBin, args...)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
+	defer trackFFmpeg()()
 	if err := cmd.Run(); err != nil {
 		msg := strings.TrimSpace(stderr.String())
 		if msg == "" {
 			msg = err.Error()
 		}
-		return fmt.Errorf("%w: %s", ErrTranscodeProcess, msg)
+		return stderr.String(), fmt.Errorf("%w: %s", ErrTranscodeProcess, lastLines(msg, 5))
 	}
+	return stderr.String(), nil
+}
 
-	if _, err := os.Stat(outputPath); err != nil {
-		return fmt.Errorf("%w: ffmpeg output missing", ErrTranscodeProcess)
+var durationPattern = regexp.MustCompile(`Duration: (\d+):(\d{2}):(\d{2}(?:\.\d+)?)`)
+
+// probeDuration 从 ffmpeg 输入信息中读取时长，用于 MP3/M4A 等纯 Go 无法解析的容器；失败返回 0
+func probeDuration(ctx context.Context, ffmpegBin, path string) time.Duration {
+	// 未指定输出时 ffmpeg 以非零状态退出，但输入信息已经打印
+	cmd := exec.CommandContext(ctx, ffmpegBin, "-hide_banner", "-i", path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	done := trackFFmpeg()
+	_ = cmd.Run()
+	done()
+
+	match := durationPattern.FindStringSubmatch(stderr.String())
+	if match == nil {
+		return 0
 	}
-	return nil
+	hours, _ := strconv.Atoi(match[1])
+	minutes, _ := strconv.Atoi(match[2])
+	seconds, _ := strconv.ParseFloat(match[3], 64)
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second))
+}
+
+// runFFmpegProgress 以 -progress pipe:1 运行 ffmpeg，将 out_time 换算为百分比回报；时长未知时只在结束时回报 100
+func runFFmpegProgress(ctx context.Context, ffmpegBin string, duration time.Duration, onProgress func(percent int), args ...string) error {
+	last := -1
+	_, err := runFFmpegOutTime(ctx, ffmpegBin, func(outTime time.Duration, end bool) {
+		percent := -1
+		switch {
+		case end:
+			percent = 100
+		case duration > 0:
+			percent = min(int(outTime*100/duration), 99)
+		}
+		if percent > last {
+			last = percent
+			onProgress(percent)
+		}
+	}, args...)
+	return err
+}
+
+// runFFmpegOutTime 以 -progress pipe:1 运行 ffmpeg，逐条回报已处理的 out_time，结束时 end 为 true；返回 stderr 输出
+func runFFmpegOutTime(ctx context.Context, ffmpegBin string, onOutTime func(outTime time.Duration, end bool), args ...string) (string, error) {
+	fullArgs := append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+	cmd := exec.CommandContext(ctx, ffmpegBin, fullArgs...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrTranscodeProcess, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrTranscodeProcess, err)
+	}
+	defer trackFFmpeg()()
+
+	var outTime time.Duration
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "out_time_us", "out_time_ms":
+			// 历史原因 out_time_ms 实际也是微秒
+			us, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || us < 0 {
+				continue
+			}
+			outTime = time.Duration(us) * time.Microsecond
+			onOutTime(outTime, false)
+		case "progress":
+			if value == "end" {
+				onOutTime(outTime, true)
+			}
+		}
+	}
+	// 确保管道读尽，避免 ffmpeg 阻塞在写入
+	_, _ = io.Copy(io.Discard, stdout)
+
+	if err := cmd.Wait(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return stderr.String(), fmt.Errorf("%w: %s", ErrTranscodeProcess, lastLines(msg, 5))
+	}
+	return stderr.String(), nil
+}
+
+// lastLines 截取日志尾部，避免 info 级别输出把错误信息淹没
+func lastLines(text string, n int) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
 }
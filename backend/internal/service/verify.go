@@ -0,0 +1,161 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mewkiz/flac"
+)
+
+// verifyMinTolerance 为时长比对的最小容差，有损编码器的填充与帧对齐会带来少量偏差
+const verifyMinTolerance = time.Second
+
+// VerifyOutput 校验输出文件：容器可完整解析、FLAC 的 STREAMINFO MD5 一致、时长与源文件相符。
+// useFFmpeg 为 false 时 FLAC/WAV 以外的容器只做格式识别。
+func VerifyOutput(ctx context.Context, ffmpegBin string, useFFmpeg bool, sourcePath, outputPath string) error {
+	fail := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrVerifyFailed, fmt.Sprintf(format, args...))
+	}
+
+	ext, err := DetectAudioExt(outputPath)
+	if err != nil {
+		return fail("无法识别输出容器")
+	}
+
+	var actual time.Duration
+	switch {
+	case ext == ".flac":
+		actual, err = verifyFLAC(ctx, outputPath)
+	case ext == ".wav":
+		actual, err = verifyWAV(outputPath)
+	case useFFmpeg:
+		actual, err = decodeDuration(ctx, ffmpegBin, outputPath)
+	default:
+		return nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fail("%v", err)
+	}
+
+	expected := sourceDuration(ctx, ffmpegBin, useFFmpeg, sourcePath)
+	if expected <= 0 || actual <= 0 {
+		return nil
+	}
+	diff := expected - actual
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > max(verifyMinTolerance, expected/100) {
+		return fail("时长不一致：源 %s，输出 %s", expected.Round(time.Millisecond), actual.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// verifyFLAC 逐帧解码（帧 CRC 由解码器校验），核对采样总数与 MD5，返回实际时长
+func verifyFLAC(ctx context.Context, path string) (time.Duration, error) {
+	stream, err := flac.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("FLAC 头解析失败: %v", err)
+	}
+	defer stream.Close()
+
+	info := stream.Info
+	sum := md5.New()
+	var samples uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		f, err := stream.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("第 %d 个采样处解码失败: %v", samples, err)
+		}
+		f.Hash(sum)
+		samples += uint64(f.BlockSize)
+	}
+
+	if info.NSamples > 0 && samples != info.NSamples {
+		return 0, fmt.Errorf("采样数不足：STREAMINFO 记录 %d，实际解码 %d", info.NSamples, samples)
+	}
+	var zero [16]byte
+	if !bytes.Equal(info.MD5sum[:], zero[:]) && !bytes.Equal(sum.Sum(nil), info.MD5sum[:]) {
+		return 0, fmt.Errorf("FLAC MD5 校验失败")
+	}
+	if info.SampleRate == 0 {
+		return 0, nil
+	}
+	return time.Duration(samples) * time.Second / time.Duration(info.SampleRate), nil
+}
+
+// verifyWAV 检查 data 块声明的长度与文件实际长度一致
+func verifyWAV(path string) (time.Duration, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	counter := &countingReader{r: f}
+	hdr, err := readWAVHeader(counter)
+	if err != nil {
+		return 0, fmt.Errorf("WAV 头解析失败: %v", err)
+	}
+	if remain := st.Size() - counter.n; remain < hdr.dataSize {
+		return 0, fmt.Errorf("WAV 数据不完整：声明 %d 字节，实际 %d 字节", hdr.dataSize, remain)
+	}
+	return time.Duration(hdr.dataSize) * time.Second / time.Duration(hdr.byteRate), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// decodeDuration 用 ffmpeg 完整解码音频流，任何解码错误都视为校验失败，返回解码得到的时长
+func decodeDuration(ctx context.Context, ffmpegBin, path string) (time.Duration, error) {
+	var decoded time.Duration
+	stderr, err := runFFmpegOutTime(ctx, ffmpegBin, func(outTime time.Duration, end bool) {
+		decoded = outTime
+	}, "-hide_banner", "-v", "error", "-i", path, "-map", "0:a:0", "-f", "null", "-")
+	if err != nil {
+		return 0, err
+	}
+	if msg := strings.TrimSpace(stderr); msg != "" {
+		return 0, fmt.Errorf("解码出错: %s", lastLines(msg, 3))
+	}
+	return decoded, nil
+}
+
+// sourceDuration 读取源文件头部声明的时长，未知时返回 0
+func sourceDuration(ctx context.Context, ffmpegBin string, useFFmpeg bool, path string) time.Duration {
+	if info, err := ProbeAudio(path); err == nil && info.Duration > 0 {
+		return info.Duration
+	}
+	if useFFmpeg {
+		return probeDuration(ctx, ffmpegBin, path)
+	}
+	return 0
+}
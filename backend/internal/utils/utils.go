@@ -4,9 +4,11 @@ package utils
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 )
 
 func RandHex(n int) string {
@@ -36,3 +38,33 @@ func FileSizeSafe(path string) int64 {
 	}
 	return 0
 }
+
+// FormatBytes 以 B/KB/MB/GB/TB 格式化字节数，保留一位小数
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// tempDir 为本进程的临时目录，由 service.InitTempDir 设置
+var tempDir atomic.Value
+
+// TempDir 返回本进程的临时目录；未设置时为系统临时目录
+func TempDir() string {
+	if dir, ok := tempDir.Load().(string); ok && dir != "" {
+		return dir
+	}
+	return os.TempDir()
+}
+
+// SetTempDir 设置本进程的临时目录
+func SetTempDir(dir string) {
+	tempDir.Store(dir)
+}
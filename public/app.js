@@ -2,11 +2,13 @@
 import { createScanner } from "./modules/scanner.js";
 import { fadeIn, prefersReducedMotion, slideDown, stagger } from "./modules/animations.js";
 import { parseVersion, isPreviewVersion, shouldNotifyUpdate } from "./modules/version.js";
+import { apiFetch, captureTokenFromUrl, withTokenQuery } from "./modules/auth.js";
 
 const APP_VERSION = "v0.2.3";
 const HISTORY_KEY = "kgg-converter-history";
 const THEME_KEY = "kgg-converter-theme";
 const SUPPORTED_EXTS = [".kgg", ".kgm", ".kgma", ".vpr", ".ncm"];
+const ARCHIVE_EXTS = [".zip"];
 const UPDATE_CHECK_KEY = "kgg-converter-update-cache-v1";
 const UPDATE_IGNORE_KEY = "kgg-converter-update-ignore-v1";
 const UPDATE_CHECK_INTERVAL_MS = 24 * 60 * 60 * 1000;
@@ -18,7 +20,9 @@ const STORAGE_KEYS = {
   dbPath: "kgg-converter-db-path",
   outputFormat: "kgg-converter-output-format",
   mp3Quality: "kgg-converter-mp3-quality",
-  concurrency: "kgg-converter-concurrency"
+  concurrency: "kgg-converter-concurrency",
+  preserveStructure: "kgg-converter-preserve-structure",
+  downloadZip: "kgg-converter-download-zip"
 };
 
 const LOG_LEVEL_LABELS = {
@@ -58,6 +62,8 @@ const outputFormatSelect = document.getElementById("outputFormat");
 const mp3QualitySelect = document.getElementById("mp3Quality");
 const mp3QualityWrap = document.getElementById("mp3QualityWrap");
 const concurrencySelect = document.getElementById("concurrency");
+const preserveStructureCheckbox = document.getElementById("preserveStructure");
+const downloadZipCheckbox = document.getElementById("downloadZip");
 
 const pickDirBtn = document.getElementById("pickDirBtn");
 const openDirBtn = document.getElementById("openDirBtn");
@@ -95,6 +101,10 @@ const clearHistoryBtn = document.getElementById("clearHistoryBtn");
 
 const pickFoldersBtn = document.getElementById("pickFoldersBtn");
 const scanRecursive = document.getElementById("scanRecursive");
+const scanConvertibleOnly = document.getElementById("scanConvertibleOnly");
+const scanModifiedAfter = document.getElementById("scanModifiedAfter");
+const scanSkipExisting = document.getElementById("scanSkipExisting");
+const scanDuplicates = document.getElementById("scanDuplicates");
 const selectedFolders = document.getElementById("selectedFolders");
 const extFilter = document.getElementById("extFilter");
 const customExtWrap = document.getElementById("customExtWrap");
@@ -126,6 +136,7 @@ const state = {
   maxFileCount: 500,
   maxFileSizeMB: 80,
   supportedFormats: SUPPORTED_EXTS,
+  archiveFormats: ARCHIVE_EXTS,
   startedAt: 0,
   hasFileError: false,
   fileRowMap: new Map(),
@@ -680,7 +691,7 @@ async function checkForUpdates() {
 }
 
 async function fetchJson(url, options = {}) {
-  const response = await fetch(url, options);
+  const response = await apiFetch(url, options);
   const data = await response.json().catch(() => ({}));
   if (!response.ok) {
     const message = data.userMessage || data.error || data.message || "请求失败，请稍后重试";
@@ -772,7 +783,9 @@ function updateFileSummary() {
 
 function renderGlobalAlert() {
   const issues = [];
-  if (state.missingTools.length > 0) issues.push(`缺少运行时文件：${state.missingTools.join("、")}`);
+  if (state.missingTools.length > 0) {
+    issues.push(`未检测到 ffmpeg（${state.missingTools.join("、")}），当前为降级模式：仅支持 copy、同格式直出与 FLAC/WAV 互转。`);
+  }
   if (requiresDb() && !isDbReady()) issues.push("当前队列包含 KGG 文件，但未检测到可用 KGMusicV3.db。");
 
   if (issues.length === 0) {
@@ -799,8 +812,7 @@ function updateConvertButtonState() {
   const ready =
     !state.isBusy &&
     pendingCount() > 0 &&
-    state.missingTools.length === 0 &&
-    outputDirInput.value.trim() &&
+    (downloadZipCheckbox.checked || outputDirInput.value.trim()) &&
     (!requiresDb() || isDbReady());
 
   convertBtn.disabled = !ready;
@@ -819,6 +831,8 @@ function setBusy(isBusy) {
   outputFormatSelect.disabled = isBusy;
   mp3QualitySelect.disabled = isBusy;
   concurrencySelect.disabled = isBusy;
+  preserveStructureCheckbox.disabled = isBusy;
+  downloadZipCheckbox.disabled = isBusy;
   pickDirBtn.disabled = isBusy;
   pickDbBtn.disabled = isBusy;
   redetectDbBtn.disabled = isBusy;
@@ -834,6 +848,8 @@ function savePreferences() {
   localStorage.setItem(STORAGE_KEYS.outputFormat, outputFormatSelect.value);
   localStorage.setItem(STORAGE_KEYS.mp3Quality, mp3QualitySelect.value);
   localStorage.setItem(STORAGE_KEYS.concurrency, concurrencySelect.value);
+  localStorage.setItem(STORAGE_KEYS.preserveStructure, preserveStructureCheckbox.checked ? "1" : "0");
+  localStorage.setItem(STORAGE_KEYS.downloadZip, downloadZipCheckbox.checked ? "1" : "0");
 }
 
 function loadPreferences() {
@@ -848,6 +864,8 @@ function loadPreferences() {
   if (outputFormat) outputFormatSelect.value = outputFormat;
   if (mp3Quality) mp3QualitySelect.value = mp3Quality;
   if (concurrency) concurrencySelect.value = concurrency;
+  preserveStructureCheckbox.checked = localStorage.getItem(STORAGE_KEYS.preserveStructure) === "1";
+  downloadZipCheckbox.checked = localStorage.getItem(STORAGE_KEYS.downloadZip) === "1";
 }
 
 function loadHistory() {
@@ -984,6 +1002,9 @@ function applyConfig(config) {
   if (Array.isArray(config.supportedFormats) && config.supportedFormats.length > 0) {
     state.supportedFormats = config.supportedFormats.map((item) => String(item).toLowerCase());
   }
+  if (Array.isArray(config.archiveFormats)) {
+    state.archiveFormats = config.archiveFormats.map((item) => String(item).toLowerCase());
+  }
 
   if (!outputDirInput.value.trim()) outputDirInput.value = config.defaultOutputDir || "";
 
@@ -1005,7 +1026,7 @@ function applyConfig(config) {
   }
 
   if (state.missingTools.length > 0) {
-    setHintStatus(runtimeStatus, "error", `运行时缺失：${state.missingTools.join("、")}`);
+    setHintStatus(runtimeStatus, "warn", `降级模式：未检测到 ffmpeg（${state.missingTools.join("、")}）`);
   } else {
     setHintStatus(
       runtimeStatus,
@@ -1076,11 +1097,13 @@ function mergeFiles(newFiles) {
 
   for (const file of incoming) {
     const ext = getExt(file.name);
-    if (!state.supportedFormats.includes(ext)) {
+    const isArchive = state.archiveFormats.includes(ext);
+    if (!isArchive && !state.supportedFormats.includes(ext)) {
       appendLog("warn", `已跳过不支持的文件：${file.name}`);
       continue;
     }
-    if (file.size > state.maxFileSizeMB * 1024 * 1024) {
+    // 压缩包内的条目由服务端按单文件上限检查
+    if (!isArchive && file.size > state.maxFileSizeMB * 1024 * 1024) {
       appendLog("warn", `文件过大已跳过：${file.name}`);
       continue;
     }
@@ -1312,12 +1335,18 @@ function updateFileRow(data, statusClass, statusText) {
 function phaseText(phase) {
   if (phase === "prepare") return "准备中";
   if (phase === "decrypt") return "解密中";
+  if (phase === "analyze") return "响度分析中";
   if (phase === "transcode") return "转码中";
+  if (phase === "verify") return "校验中";
   return "处理中";
 }
 
 function handleProgressEvent(eventName, data) {
   if (eventName === "progress") {
+    if (data.phase === "queued") {
+      progressStatus.textContent = `排队中：前面还有 ${data.queuePosition - 1} 个转换任务`;
+      return;
+    }
     progressStatus.textContent = `${phaseText(data.phase)}：${data.file} (${data.current}/${data.total})`;
     updateProgressBar(data.percent, state.hasFileError);
     updateFileRow(data, "active", `- ${phaseText(data.phase)}...`);
@@ -1341,6 +1370,11 @@ function handleProgressEvent(eventName, data) {
     return;
   }
 
+  if (eventName === "warning") {
+    appendLog("warn", data.message);
+    return;
+  }
+
   if (eventName === "error") {
     appendPayloadError("流式转换失败：", data.error);
     return;
@@ -1354,6 +1388,17 @@ function handleProgressEvent(eventName, data) {
     progressETA.textContent = "";
     appendLog("info", doneText);
     if (data.cancelled) appendLog("warn", "任务已取消。");
+    if (data.dropped && data.dropped.length > 0) {
+      const sample = data.dropped
+        .slice(0, 3)
+        .map((item) => `${item.path}（${item.reason}）`)
+        .join("；");
+      appendLog("warn", `已跳过 ${data.dropped.length} 个输入路径：${sample}${data.dropped.length > 3 ? " 等" : ""}`);
+    }
+
+    if (data.outputMode === "zip" && data.downloadUrl && (data.success || 0) > 0) {
+      downloadJobResults(data.downloadUrl);
+    }
 
     renderDashboard(data);
     renderFailedDetails(data.results || []);
@@ -1363,8 +1408,19 @@ function handleProgressEvent(eventName, data) {
   }
 }
 
+// downloadJobResults 通过隐藏链接触发浏览器下载任务结果 ZIP
+function downloadJobResults(url) {
+  const link = document.createElement("a");
+  link.href = withTokenQuery(url);
+  link.download = "";
+  document.body.appendChild(link);
+  link.click();
+  link.remove();
+  appendLog("info", "转换结果 ZIP 已开始下载。");
+}
+
 async function startConvertStream(formData, signal) {
-  const response = await fetch("/api/convert-stream", { method: "POST", body: formData, signal });
+  const response = await apiFetch("/api/convert-stream", { method: "POST", body: formData, signal });
   const contentType = response.headers.get("content-type") || "";
 
   if (!response.ok || !contentType.includes("text/event-stream")) {
@@ -1440,7 +1496,7 @@ async function startConvert() {
     appendLog("warn", `文件数量超过限制（最多 ${state.maxFileCount} 个）。`);
     return;
   }
-  if (!outputDir) {
+  if (!outputDir && !downloadZipCheckbox.checked) {
     appendLog("warn", "请先选择输出目录。");
     return;
   }
@@ -1450,7 +1506,8 @@ async function startConvert() {
   }
 
   const formData = new FormData();
-  formData.append("outputDir", outputDir);
+  if (downloadZipCheckbox.checked) formData.append("outputMode", "zip");
+  else formData.append("outputDir", outputDir);
   formData.append("outputFormat", outputFormatSelect.value);
   formData.append("mp3Quality", mp3QualitySelect.value);
   formData.append("concurrency", concurrencySelect.value);
@@ -1459,7 +1516,10 @@ async function startConvert() {
   for (const file of state.selectedFiles) formData.append("kggFiles", file, file.name);
   if (state.pathQueue.length > 0) {
     formData.append("inputPaths", JSON.stringify(state.pathQueue.map((item) => item.fullPath)));
+    const roots = [...new Set(state.pathQueue.map((item) => item.root).filter(Boolean))];
+    if (roots.length > 0) formData.append("inputRoots", JSON.stringify(roots));
   }
+  formData.append("preserveStructure", preserveStructureCheckbox.checked ? "true" : "false");
 
   resetProgressUI(items.length);
   appendLog("info", `开始转换，共 ${items.length} 个文件...`);
@@ -1468,7 +1528,9 @@ async function startConvert() {
     state.abortController = new AbortController();
     setBusy(true);
     await startConvertStream(formData, state.abortController.signal);
-    if (state.lastSummary) appendLog("info", `输出目录：${state.lastSummary.outputDir || outputDir}`);
+    if (state.lastSummary && !downloadZipCheckbox.checked) {
+      appendLog("info", `输出目录：${state.lastSummary.outputDir || outputDir}`);
+    }
   } catch (err) {
     if (err.name === "AbortError") appendLog("warn", "用户已取消转换。");
     else if (err?.payload) appendPayloadError("转换失败：", err.payload);
@@ -1544,6 +1606,10 @@ const scanner = createScanner({
     selectedFolders,
     scanBtn,
     scanRecursive,
+    scanConvertibleOnly,
+    scanModifiedAfter,
+    scanSkipExisting,
+    scanDuplicates,
     extFilter,
     customExtWrap,
     customExtFilter,
@@ -1561,6 +1627,8 @@ const scanner = createScanner({
   iconMarkup,
   refreshIcons,
   copyTextToClipboard,
+  setButtonContent,
+  getOutputDir: () => outputDirInput.value.trim(),
   onQueueChanged: queueChanged,
   pendingCount
 });
@@ -1651,6 +1719,11 @@ function bindEvents() {
   });
   mp3QualitySelect.addEventListener("change", savePreferences);
   concurrencySelect.addEventListener("change", savePreferences);
+  preserveStructureCheckbox.addEventListener("change", savePreferences);
+  downloadZipCheckbox.addEventListener("change", () => {
+    savePreferences();
+    updateConvertButtonState();
+  });
 
   clearHistoryBtn.addEventListener("click", () => {
     state.history = [];
@@ -1682,6 +1755,7 @@ function bindEvents() {
 }
 
 (async function init() {
+  captureTokenFromUrl();
   setSkeletonLoading(true);
   updateVersionBadge();
   initTheme();
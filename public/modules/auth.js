@@ -0,0 +1,41 @@
+const TOKEN_KEY = "kgg-converter-auth-token";
+
+// 启动日志中的访问地址带有 ?token=，首次打开时保存令牌并从地址栏移除
+export function captureTokenFromUrl() {
+  const url = new URL(window.location.href);
+  const token = url.searchParams.get("token");
+  if (!token) return;
+  localStorage.setItem(TOKEN_KEY, token);
+  url.searchParams.delete("token");
+  window.history.replaceState(null, "", url.pathname + url.search + url.hash);
+}
+
+function getToken() {
+  return localStorage.getItem(TOKEN_KEY) || "";
+}
+
+function withAuthHeader(options) {
+  const token = getToken();
+  if (!token) return options;
+  const headers = new Headers(options.headers || {});
+  headers.set("Authorization", `Bearer ${token}`);
+  return { ...options, headers };
+}
+
+// apiFetch 为接口请求附加令牌；返回 401 时提示输入令牌并重试一次
+export async function apiFetch(url, options = {}) {
+  const response = await fetch(url, withAuthHeader(options));
+  if (response.status !== 401) return response;
+
+  const token = window.prompt("服务已启用访问令牌，请输入启动日志中显示的令牌：", "");
+  if (!token) return response;
+  localStorage.setItem(TOKEN_KEY, token.trim());
+  return fetch(url, withAuthHeader(options));
+}
+
+// withTokenQuery 为无法设置请求头的下载链接附加令牌
+export function withTokenQuery(url) {
+  const token = getToken();
+  if (!token) return url;
+  return `${url}${url.includes("?") ? "&" : "?"}token=${encodeURIComponent(token)}`;
+}
@@ -1,9 +1,46 @@
-﻿const ENCRYPTED_EXTS = new Set([".kgg", ".kgm", ".kgma", ".vpr", ".ncm"]);
+﻿import { readSseStream } from "./sse.js";
+import { apiFetch } from "./auth.js";
+
+const ENCRYPTED_EXTS = new Set([".kgg", ".kgm", ".kgma", ".vpr", ".ncm"]);
+
+const SCAN_REASON_TEXT = {
+  unsupported_format: "不支持的格式",
+  invalid_header: "文件头无效",
+  unsupported_mode: "不支持的 KGG 模式",
+  key_missing: "缺少密钥",
+  key_mismatch: "密钥不匹配"
+};
+
+const SCAN_ERROR_TEXT = {
+  not_found: "路径不存在",
+  not_directory: "不是文件夹",
+  permission_denied: "没有访问权限",
+  symlink_loop: "符号链接循环",
+  broken_symlink: "符号链接失效",
+  not_allowed: "不在允许访问的目录中",
+  read_failed: "读取失败"
+};
 
 function csvEscape(value) {
   return `"${String(value ?? "").replace(/"/g, '""')}"`;
 }
 
+function scanStatusText(file) {
+  const details = file.details;
+  if (!details) return "";
+  if (!details.convertible) return SCAN_REASON_TEXT[details.reason] || "不可转换";
+  return "可转换";
+}
+
+function scanDisplayName(file) {
+  const details = file.details;
+  if (details && details.title) {
+    const artists = (details.artists || []).join(" / ");
+    return artists ? `${file.name}（${artists} - ${details.title}）` : `${file.name}（${details.title}）`;
+  }
+  return file.name || "";
+}
+
 export function createScanner(ctx) {
   const {
     state,
@@ -17,10 +54,16 @@ export function createScanner(ctx) {
     iconMarkup,
     refreshIcons,
     copyTextToClipboard,
+    setButtonContent,
+    getOutputDir,
     onQueueChanged,
     pendingCount
   } = ctx;
 
+  let scanAbort = null;
+  // duplicatePaths 为重复分组中非最佳音质的文件，加入队列时跳过
+  let duplicatePaths = new Set();
+
   function renderFolderTags() {
     elements.selectedFolders.innerHTML = "";
     state.selectedFolderPaths.forEach((folderPath, index) => {
@@ -62,59 +105,143 @@ export function createScanner(ctx) {
     return elements.extFilter.value === "custom" ? elements.customExtFilter.value.trim() : elements.extFilter.value;
   }
 
-  function renderScanResult(data) {
+  function resetScanResult() {
     elements.scanResult.classList.remove("hidden");
-    elements.scanTotal.textContent = `${data.totalFiles || 0} 个文件`;
-    elements.scanSize.textContent = formatBytes(data.totalSize || 0);
+    elements.scanTotal.textContent = "0 个文件";
+    elements.scanSize.textContent = formatBytes(0);
     elements.fileNameList.innerHTML = "";
+    state.scanFiles = [];
+    duplicatePaths = new Set();
+  }
+
+  function updateScanTotals(stats, suffix = "") {
+    elements.scanTotal.textContent = `${stats.totalFiles || 0} 个文件${suffix}`;
+    elements.scanSize.textContent = formatBytes(stats.totalSize || 0);
+  }
+
+  function appendScanFolder(folder) {
+    const files = folder.files || [];
+    const header = document.createElement("div");
+    header.className = "folder-header";
+    header.textContent = `${folder.path}（${files.length} 个文件）`;
+    elements.fileNameList.appendChild(header);
+
+    files.forEach((file) => {
+      state.scanFiles.push({ ...file, root: folder.root || "" });
+      const row = document.createElement("div");
+      row.className = "file-name-item";
+      row.setAttribute("role", "listitem");
+      row.dataset.path = file.fullPath || "";
+      const status = scanStatusText(file);
+      const keyHint = file.details && file.details.keySource ? `密钥来源：${file.details.keySource}` : "";
+      if (file.details && !file.details.convertible) row.classList.add("not-convertible");
+      row.innerHTML = `
+        ${renderExtBadge(file.ext)}
+        <span class="file-name-col" title="${escapeHtml(file.fullPath || "")}">${escapeHtml(scanDisplayName(file))}</span>
+        <span class="file-status-col" title="${escapeHtml(keyHint)}">${escapeHtml(status)}</span>
+        <span class="file-size-col">${formatBytes(file.size)}</span>
+        <span class="file-date-col">${escapeHtml(new Date(file.modTime).toLocaleString("zh-CN", { hour12: false }))}</span>
+      `;
+      elements.fileNameList.appendChild(row);
+    });
+    refreshIcons();
+  }
 
-    const all = [];
-    (data.folders || []).forEach((folder) => {
-      const header = document.createElement("div");
-      header.className = "folder-header";
-      header.textContent = `${folder.path}（${(folder.files || []).length} 个文件）`;
-      elements.fileNameList.appendChild(header);
-
-      (folder.files || []).forEach((file) => {
-        all.push(file);
-        const row = document.createElement("div");
-        row.className = "file-name-item";
-        row.setAttribute("role", "listitem");
-        row.innerHTML = `
-          ${renderExtBadge(file.ext)}
-          <span class="file-name-col" title="${escapeHtml(file.fullPath || "")}">${escapeHtml(file.name || "")}</span>
-          <span class="file-size-col">${formatBytes(file.size)}</span>
-          <span class="file-date-col">${escapeHtml(new Date(file.modTime).toLocaleString("zh-CN", { hour12: false }))}</span>
-        `;
-        elements.fileNameList.appendChild(row);
+  function markDuplicates(groups) {
+    groups.forEach((group) => {
+      (group.files || []).forEach((file) => {
+        if (file.path !== group.best) duplicatePaths.add(file.path);
       });
     });
+    elements.fileNameList.querySelectorAll(".file-name-item").forEach((row) => {
+      if (!duplicatePaths.has(row.dataset.path)) return;
+      row.classList.add("duplicate");
+      const status = row.querySelector(".file-status-col");
+      if (status) status.textContent = "重复";
+    });
+    appendLog("info", `发现 ${groups.length} 组重复歌曲，${duplicatePaths.size} 个较低音质的重复文件加入队列时将跳过。`);
+  }
 
-    refreshIcons();
-    state.scanFiles = all;
+  function setScanButton(scanning) {
+    setButtonContent(elements.scanBtn, scanning ? "取消扫描" : "开始扫描", scanning ? "x" : "search");
+    elements.scanBtn.disabled = !scanning && (state.selectedFolderPaths.length === 0 || state.isBusy);
+  }
+
+  function handleScanEvent(eventName, payload) {
+    if (eventName === "folder") {
+      appendScanFolder(payload);
+      return;
+    }
+    if (eventName === "progress") {
+      updateScanTotals(payload, `（已扫描 ${payload.dirs || 0} 个目录）`);
+      return;
+    }
+    if (eventName === "error") {
+      const reason = SCAN_ERROR_TEXT[payload.reason] || payload.reason;
+      appendLog("warn", `扫描跳过 ${payload.path}：${reason}${payload.detail ? `（${payload.detail}）` : ""}`);
+      return;
+    }
+    if (eventName === "complete") {
+      let suffix = "";
+      if (payload.filteredOut) suffix += `（已过滤 ${payload.filteredOut} 个不可转换）`;
+      if (payload.skippedExisting) suffix += `（跳过 ${payload.skippedExisting} 个已转换）`;
+      if (payload.truncated) suffix += payload.truncatedReason === "timeout" ? "（已超时，结果不完整）" : "（已达上限，结果不完整）";
+      updateScanTotals(payload, suffix);
+      const blocked = state.scanFiles.filter((file) => file.details && !file.details.convertible).length;
+      appendLog("success", `扫描完成：共 ${payload.totalFiles || 0} 个文件，${payload.dirs || 0} 个目录，耗时 ${payload.durationMs || 0}ms`);
+      if (payload.errors > 0) appendLog("warn", `${payload.errors} 个路径扫描失败，详见上方日志。`);
+      if (blocked > 0) {
+        appendLog("warn", `${blocked} 个文件当前无法转换（缺少密钥或文件头无效），加入队列时将跳过。`);
+      }
+      if (payload.duplicates && payload.duplicates.length > 0) markDuplicates(payload.duplicates);
+    }
   }
 
   async function startScanFolders() {
+    if (scanAbort) {
+      scanAbort.abort();
+      return;
+    }
     if (state.selectedFolderPaths.length === 0) return;
 
+    scanAbort = new AbortController();
     try {
-      elements.scanBtn.disabled = true;
+      setScanButton(true);
+      resetScanResult();
       appendLog("info", "开始扫描文件夹...");
-      const data = await fetchJson("/api/scan-folders", {
+      const skipExistingIn = elements.scanSkipExisting.checked ? getOutputDir() : "";
+      if (elements.scanSkipExisting.checked && !skipExistingIn) {
+        appendLog("warn", "未设置输出目录，本次扫描不跳过已转换文件。");
+      }
+      const response = await apiFetch("/api/scan-folders-stream", {
         method: "POST",
         headers: { "Content-Type": "application/json" },
+        signal: scanAbort.signal,
         body: JSON.stringify({
           paths: state.selectedFolderPaths,
           recursive: elements.scanRecursive.checked,
-          filter: getScanFilterValue()
+          filter: getScanFilterValue(),
+          details: true,
+          convertibleOnly: elements.scanConvertibleOnly.checked,
+          modifiedAfter: elements.scanModifiedAfter.value,
+          skipExistingIn,
+          duplicates: elements.scanDuplicates.checked ? "header" : ""
         })
       });
-      renderScanResult(data);
-      appendLog("success", `扫描完成：共 ${data.totalFiles || 0} 个文件`);
+      const contentType = response.headers.get("content-type") || "";
+      if (!response.ok || !contentType.includes("text/event-stream")) {
+        const data = await response.json().catch(() => ({}));
+        const error = new Error(data.userMessage || "扫描请求失败");
+        error.payload = data;
+        throw error;
+      }
+      await readSseStream(response, handleScanEvent);
     } catch (err) {
-      appendPayloadError("扫描失败：", err.payload || { userMessage: err.message });
+      if (err.name === "AbortError") appendLog("warn", `已取消扫描，保留已找到的 ${state.scanFiles.length} 个文件。`);
+      else appendPayloadError("扫描失败：", err.payload || { userMessage: err.message });
     } finally {
-      elements.scanBtn.disabled = state.selectedFolderPaths.length === 0 || state.isBusy;
+      scanAbort = null;
+      setScanButton(false);
     }
   }
 
@@ -135,10 +262,10 @@ export function createScanner(ctx) {
     }
 
     const rows = [
-      "文件名,扩展名,大小(Byte),修改时间,完整路径",
+      "文件名,扩展名,大小(Byte),修改时间,完整路径,状态,标题,歌手",
       ...state.scanFiles.map(
         (file) =>
-          `${csvEscape(file.name)},${csvEscape(file.ext || "")},${csvEscape(file.size || 0)},${csvEscape(file.modTime || "")},${csvEscape(file.fullPath || "")}`
+          `${csvEscape(file.name)},${csvEscape(file.ext || "")},${csvEscape(file.size || 0)},${csvEscape(file.modTime || "")},${csvEscape(file.fullPath || "")},${csvEscape(scanStatusText(file))},${csvEscape(file.details?.title || "")},${csvEscape((file.details?.artists || []).join(" / "))}`
       )
     ];
 
@@ -152,7 +279,12 @@ export function createScanner(ctx) {
   }
 
   function addScanFilesToQueue() {
-    const candidates = state.scanFiles.filter((file) => ENCRYPTED_EXTS.has(String(file.ext || "").toLowerCase()));
+    const candidates = state.scanFiles.filter(
+      (file) =>
+        ENCRYPTED_EXTS.has(String(file.ext || "").toLowerCase()) &&
+        (!file.details || file.details.convertible) &&
+        !duplicatePaths.has(file.fullPath)
+    );
     if (candidates.length === 0) {
       appendLog("warn", "扫描结果中没有可转换的加密音频文件。");
       return;
@@ -169,7 +301,8 @@ export function createScanner(ctx) {
         fullPath: file.fullPath,
         name: file.name,
         size: file.size || 0,
-        ext: String(file.ext || "").toLowerCase()
+        ext: String(file.ext || "").toLowerCase(),
+        root: file.root || ""
       });
       existed.add(file.fullPath);
       added += 1;
@@ -31,7 +31,7 @@ if errorlevel 1 exit /b 1
 
 echo [INFO] Starting backend service...
 start "" /b cmd /c "timeout /t 2 /nobreak >nul & start http://localhost:8080"
-"%EXE%" --addr :8080 --ffmpeg "%FFMPEG%"
+"%EXE%" --addr 127.0.0.1:8080 --ffmpeg "%FFMPEG%"
 set "EXIT_CODE=%ERRORLEVEL%"
 
 echo.